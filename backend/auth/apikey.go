@@ -0,0 +1,171 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// APIKeyPrefix starts every API key so that keys can be told apart from
+// access tokens in an Authorization header and spotted in leaked text.
+const APIKeyPrefix = "bfk_"
+
+// apiKeyHintLength is how much of a key is kept in clear to identify it in
+// listings.
+const apiKeyHintLength = len(APIKeyPrefix) + 6
+
+// lastUsedResolution limits how often last_used_at is written for a busy
+// key.
+const lastUsedResolution = time.Minute
+
+// ErrUnknownPermission is returned when an API key is given a scope that is
+// not one of Permissions.
+var ErrUnknownPermission = errors.New("auth: unknown permission")
+
+// APIKey lets a machine client call the services without logging in. Only a
+// hash of the key is stored; the key itself is shown once, when it is
+// created or rotated.
+type APIKey struct {
+	ID         uint           `json:"id" gorm:"primaryKey"`
+	Name       string         `json:"name" gorm:"not null"`
+	Hint       string         `json:"hint" gorm:"not null"`
+	KeyHash    string         `json:"-" gorm:"not null;uniqueIndex"`
+	Scopes     PermissionList `json:"scopes" gorm:"type:text;not null"`
+	ExpiresAt  *time.Time     `json:"expires_at"`
+	LastUsedAt *time.Time     `json:"last_used_at"`
+	RevokedAt  *time.Time     `json:"revoked_at"`
+	CreatedBy  string         `json:"created_by" gorm:"not null;default:''"`
+	CreatedAt  time.Time      `json:"created_at"`
+	RotatedAt  *time.Time     `json:"rotated_at"`
+}
+
+// Active reports whether the key can still be used at now.
+func (k APIKey) Active(now time.Time) bool {
+	return k.RevokedAt == nil && (k.ExpiresAt == nil || now.Before(*k.ExpiresAt))
+}
+
+// claims returns the claims a request authenticated with the key carries.
+// The key's scopes become its permissions.
+func (k APIKey) claims() *Claims {
+	return &Claims{
+		Username:    "api-key:" + k.Name,
+		APIKeyID:    k.ID,
+		Permissions: []string(k.Scopes),
+	}
+}
+
+// CreateAPIKey stores a new key and returns it together with the key in
+// clear. A nil expiresAt creates a key that does not expire.
+func CreateAPIKey(db *gorm.DB, name string, scopes []string, expiresAt *time.Time, createdBy string) (APIKey, string, error) {
+	for _, scope := range scopes {
+		if !KnownPermission(scope) {
+			return APIKey{}, "", ErrUnknownPermission
+		}
+	}
+	secret, err := newAPIKey()
+	if err != nil {
+		return APIKey{}, "", err
+	}
+	key := APIKey{
+		Name:      strings.TrimSpace(name),
+		Hint:      secret[:apiKeyHintLength],
+		KeyHash:   hashToken(secret),
+		Scopes:    PermissionList(scopes),
+		ExpiresAt: expiresAt,
+		CreatedBy: createdBy,
+	}
+	return key, secret, db.Create(&key).Error
+}
+
+// RotateAPIKey replaces the secret of an active key. The old secret stops
+// working immediately.
+func RotateAPIKey(db *gorm.DB, id uint) (APIKey, string, error) {
+	var key APIKey
+	if err := db.First(&key, id).Error; err != nil {
+		return APIKey{}, "", err
+	}
+	if !key.Active(time.Now()) {
+		return APIKey{}, "", ErrInvalidToken
+	}
+	secret, err := newAPIKey()
+	if err != nil {
+		return APIKey{}, "", err
+	}
+	now := time.Now()
+	key.Hint = secret[:apiKeyHintLength]
+	key.KeyHash = hashToken(secret)
+	key.RotatedAt = &now
+	err = db.Model(&key).Updates(map[string]interface{}{
+		"hint":       key.Hint,
+		"key_hash":   key.KeyHash,
+		"rotated_at": now,
+	}).Error
+	return key, secret, err
+}
+
+// RevokeAPIKey permanently disables a key. Revoking a revoked key is a
+// no-op.
+func RevokeAPIKey(db *gorm.DB, id uint) (APIKey, error) {
+	var key APIKey
+	if err := db.First(&key, id).Error; err != nil {
+		return APIKey{}, err
+	}
+	if key.RevokedAt != nil {
+		return key, nil
+	}
+	now := time.Now()
+	key.RevokedAt = &now
+	return key, db.Model(&key).Update("revoked_at", now).Error
+}
+
+// VerifyAPIKey returns the claims of an active key and records that it was
+// used.
+func VerifyAPIKey(db *gorm.DB, secret string) (*Claims, error) {
+	if !strings.HasPrefix(secret, APIKeyPrefix) {
+		return nil, ErrInvalidToken
+	}
+	var key APIKey
+	if err := db.Where("key_hash = ?", hashToken(secret)).First(&key).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrInvalidToken
+		}
+		return nil, err
+	}
+	now := time.Now()
+	if !key.Active(now) {
+		return nil, ErrInvalidToken
+	}
+
+	// Only write when the stored time is stale so a busy key does not turn
+	// every request into an update
+	if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) >= lastUsedResolution {
+		if err := db.Model(&APIKey{}).Where("id = ?", key.ID).Update("last_used_at", now).Error; err != nil {
+			return nil, err
+		}
+	}
+	return key.claims(), nil
+}
+
+// APIKeyFrom returns the API key sent in an X-API-Key header, or in an
+// "Authorization: Bearer" header when it carries a key rather than an
+// access token.
+func APIKeyFrom(r *http.Request) string {
+	if key := strings.TrimSpace(r.Header.Get("X-API-Key")); key != "" {
+		return key
+	}
+	if token := BearerToken(r); strings.HasPrefix(token, APIKeyPrefix) {
+		return token
+	}
+	return ""
+}
+
+func newAPIKey() (string, error) {
+	token, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	return APIKeyPrefix + token, nil
+}
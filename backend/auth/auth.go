@@ -0,0 +1,186 @@
+// Package auth authenticates operators of the user and report services. It
+// issues short-lived signed access tokens (JWT, HS256) together with
+// rotating refresh tokens stored server side, manages scoped API keys for
+// machine clients, and provides the middleware both services use to verify
+// either.
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+// Default token lifetimes.
+const (
+	DefaultAccessTTL  = 15 * time.Minute
+	DefaultRefreshTTL = 7 * 24 * time.Hour
+)
+
+// MinSecretLength is the shortest signing secret accepted by New.
+const MinSecretLength = 32
+
+const issuer = "back-forms"
+
+var (
+	// ErrInvalidCredentials is returned for an unknown username, a wrong
+	// password or a disabled operator.
+	ErrInvalidCredentials = errors.New("auth: invalid username or password")
+	// ErrInvalidToken is returned for a malformed, expired or revoked token.
+	ErrInvalidToken = errors.New("auth: invalid or expired token")
+)
+
+// Claims are the claims carried by an access token. Permissions are
+// resolved from the operator's roles when the token is issued, so role
+// changes apply from the next refresh. Requests authenticated with an API
+// key carry claims too, with APIKeyID set and the key's scopes as
+// permissions.
+type Claims struct {
+	jwt.RegisteredClaims
+	Username    string   `json:"username"`
+	SessionID   uint     `json:"sid"`
+	Permissions []string `json:"perms"`
+	APIKeyID    uint     `json:"-"`
+}
+
+// OperatorID returns the ID of the operator the token was issued to.
+func (c *Claims) OperatorID() uint {
+	id, _ := strconv.ParseUint(c.Subject, 10, 64)
+	return uint(id)
+}
+
+// Authenticator signs and verifies access tokens.
+type Authenticator struct {
+	secret     []byte
+	AccessTTL  time.Duration
+	RefreshTTL time.Duration
+}
+
+// New returns an Authenticator that signs tokens with secret.
+func New(secret string) (*Authenticator, error) {
+	if len(secret) < MinSecretLength {
+		return nil, errors.New("auth: secret must be at least 32 bytes")
+	}
+	return &Authenticator{
+		secret:     []byte(secret),
+		AccessTTL:  DefaultAccessTTL,
+		RefreshTTL: DefaultRefreshTTL,
+	}, nil
+}
+
+// sign issues an access token for an operator session.
+func (a *Authenticator) sign(operator Operator, sessionID uint, now time.Time) (string, time.Time, error) {
+	expires := now.Add(a.AccessTTL)
+	claims := Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    issuer,
+			Subject:   strconv.FormatUint(uint64(operator.ID), 10),
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expires),
+		},
+		Username:    operator.Username,
+		SessionID:   sessionID,
+		Permissions: permissionsOf(operator.Roles),
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(a.secret)
+	return token, expires, err
+}
+
+// Verify checks the signature and lifetime of an access token.
+func (a *Authenticator) Verify(token string) (*Claims, error) {
+	claims := &Claims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(*jwt.Token) (interface{}, error) {
+		return a.secret, nil
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithIssuer(issuer),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	return claims, nil
+}
+
+type contextKey int
+
+const claimsKey contextKey = iota
+
+// WithClaims returns a context carrying the claims of the caller.
+func WithClaims(ctx context.Context, claims *Claims) context.Context {
+	return context.WithValue(ctx, claimsKey, claims)
+}
+
+// ClaimsFrom returns the claims stored in ctx by Middleware.
+func ClaimsFrom(ctx context.Context) (*Claims, bool) {
+	claims, ok := ctx.Value(claimsKey).(*Claims)
+	return claims, ok
+}
+
+// BearerToken returns the token of an "Authorization: Bearer" header.
+func BearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if len(header) > 7 && strings.EqualFold(header[:7], "Bearer ") {
+		return strings.TrimSpace(header[7:])
+	}
+	return ""
+}
+
+// Middleware rejects requests without a valid access token or API key with
+// 401 and stores the caller's claims in the request context. API keys are
+// looked up in db; they are not accepted when db is nil.
+func Middleware(a *Authenticator, db *gorm.DB) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var claims *Claims
+			var err error
+			if key := APIKeyFrom(r); key != "" && db != nil {
+				claims, err = VerifyAPIKey(db.WithContext(r.Context()), key)
+				if err != nil && !errors.Is(err, ErrInvalidToken) {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+			} else {
+				claims, err = a.Verify(BearerToken(r))
+			}
+			if err != nil {
+				writeUnauthorized(w)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(WithClaims(r.Context(), claims)))
+		})
+	}
+}
+
+// Optional is Middleware for routes that anonymous callers may use too:
+// requests without an access token or API key pass through without claims.
+// Credentials that are sent must still be valid.
+func Optional(a *Authenticator, db *gorm.DB) mux.MiddlewareFunc {
+	required := Middleware(a, db)
+	return func(next http.Handler) http.Handler {
+		authenticated := required(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if APIKeyFrom(r) == "" && BearerToken(r) == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			authenticated.ServeHTTP(w, r)
+		})
+	}
+}
+
+func writeUnauthorized(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="back-forms"`)
+	writeError(w, http.StatusUnauthorized, ErrorResponse{
+		Error:   "unauthorized",
+		Message: "A valid access token or API key is required",
+	})
+}
@@ -0,0 +1,165 @@
+package auth
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+// Permissions granted through roles.
+const (
+	PermUsersRead   = "users:read"
+	PermUsersWrite  = "users:write"
+	PermUsersDelete = "users:delete"
+	PermReportsRead = "reports:read"
+	// PermAdmin allows managing operators and roles and purging users.
+	PermAdmin = "admin:manage"
+)
+
+// Permissions lists every known permission.
+var Permissions = []string{PermUsersRead, PermUsersWrite, PermUsersDelete, PermReportsRead, PermAdmin}
+
+// DefaultRoles are created by Setup when missing. Existing roles are left as
+// they are so admins can change them.
+var DefaultRoles = []Role{
+	{Name: "admin", Description: "Full access, including operator and role management", Permissions: PermissionList(Permissions)},
+	{Name: "data-entry", Description: "Reads and submits forms", Permissions: PermissionList{PermUsersRead, PermUsersWrite}},
+	{Name: "reviewer", Description: "Reviews, corrects and removes submissions", Permissions: PermissionList{PermUsersRead, PermUsersWrite, PermUsersDelete}},
+	{Name: "manager", Description: "Reads reports", Permissions: PermissionList{PermReportsRead}},
+}
+
+// AdminRole is the default role given to the bootstrap operator.
+const AdminRole = "admin"
+
+// PermissionList is a set of permissions stored as a JSON array.
+type PermissionList []string
+
+// Value implements driver.Valuer.
+func (p PermissionList) Value() (driver.Value, error) {
+	if p == nil {
+		p = PermissionList{}
+	}
+	b, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+// Scan implements sql.Scanner.
+func (p *PermissionList) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		*p = nil
+		return nil
+	case string:
+		return json.Unmarshal([]byte(v), p)
+	case []byte:
+		return json.Unmarshal(v, p)
+	default:
+		return fmt.Errorf("auth: cannot scan %T into PermissionList", value)
+	}
+}
+
+// Role is a named set of permissions.
+type Role struct {
+	ID          uint           `json:"id" gorm:"primaryKey"`
+	Name        string         `json:"name" gorm:"not null;uniqueIndex"`
+	Description string         `json:"description" gorm:"not null;default:''"`
+	Permissions PermissionList `json:"permissions" gorm:"type:text;not null"`
+}
+
+// KnownPermission reports whether perm is one of Permissions.
+func KnownPermission(perm string) bool {
+	for _, p := range Permissions {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// permissionsOf returns the sorted union of the permissions of roles.
+func permissionsOf(roles []Role) []string {
+	set := map[string]bool{}
+	for _, role := range roles {
+		for _, perm := range role.Permissions {
+			set[perm] = true
+		}
+	}
+	perms := make([]string, 0, len(set))
+	for perm := range set {
+		perms = append(perms, perm)
+	}
+	sort.Strings(perms)
+	return perms
+}
+
+// ensureRoles creates the default roles that do not exist yet.
+func ensureRoles(db *gorm.DB) error {
+	for _, role := range DefaultRoles {
+		if err := db.Where(Role{Name: role.Name}).FirstOrCreate(&role).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// HasPermission reports whether the claims grant perm.
+func (c *Claims) HasPermission(perm string) bool {
+	for _, p := range c.Permissions {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// ErrorResponse is the body of 401 and 403 responses.
+type ErrorResponse struct {
+	Error    string   `json:"error"`
+	Message  string   `json:"message"`
+	Required []string `json:"required,omitempty"`
+}
+
+// WriteForbidden writes the 403 response returned whenever the caller
+// lacks a permission.
+func WriteForbidden(w http.ResponseWriter, required ...string) {
+	writeError(w, http.StatusForbidden, ErrorResponse{
+		Error:    "forbidden",
+		Message:  "You do not have permission to perform this action",
+		Required: required,
+	})
+}
+
+func writeError(w http.ResponseWriter, status int, body ErrorResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// Require only lets requests through whose claims grant every one of
+// perms. It must run after Middleware.
+func Require(perms ...string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims, ok := ClaimsFrom(r.Context())
+			if !ok {
+				writeUnauthorized(w)
+				return
+			}
+			for _, perm := range perms {
+				if !claims.HasPermission(perm) {
+					WriteForbidden(w, perms...)
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
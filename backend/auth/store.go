@@ -0,0 +1,262 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// MinPasswordLength is the shortest operator password accepted.
+const MinPasswordLength = 8
+
+// ErrWeakPassword is returned for passwords shorter than MinPasswordLength.
+var ErrWeakPassword = errors.New("auth: password must be at least 8 characters")
+
+// Operator is a member of staff allowed to use the services.
+type Operator struct {
+	ID           uint       `json:"id" gorm:"primaryKey"`
+	Username     string     `json:"username" gorm:"not null;uniqueIndex"`
+	PasswordHash string     `json:"-" gorm:"not null"`
+	Disabled     bool       `json:"disabled" gorm:"not null;default:false"`
+	CreatedAt    time.Time  `json:"created_at"`
+	LastLoginAt  *time.Time `json:"last_login_at"`
+	Roles        []Role     `json:"roles" gorm:"many2many:operator_roles"`
+}
+
+// Session is a refresh token issued at login. Refreshing revokes the
+// session and starts a new one, so each refresh token works once.
+type Session struct {
+	ID           uint      `gorm:"primaryKey"`
+	OperatorID   uint      `gorm:"not null;index"`
+	TokenHash    string    `gorm:"not null;uniqueIndex"`
+	ExpiresAt    time.Time `gorm:"not null"`
+	RevokedAt    *time.Time
+	ReplacedByID *uint
+	CreatedAt    time.Time
+}
+
+// TableName keeps the session table name descriptive.
+func (Session) TableName() string {
+	return "operator_sessions"
+}
+
+// TokenPair is returned by login and refresh.
+type TokenPair struct {
+	AccessToken  string    `json:"access_token"`
+	TokenType    string    `json:"token_type"`
+	ExpiresIn    int       `json:"expires_in"`
+	ExpiresAt    time.Time `json:"expires_at"`
+	RefreshToken string    `json:"refresh_token"`
+}
+
+// dummyHash is compared against when a username does not exist so that
+// unknown and known usernames take the same time to reject.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("not-a-real-password"), bcrypt.DefaultCost)
+
+// Setup creates the default roles. The tables are created by the
+// migrations.
+func Setup(db *gorm.DB) error {
+	return ensureRoles(db)
+}
+
+// CreateOperator stores a new operator with a bcrypt-hashed password and
+// the named roles.
+func CreateOperator(db *gorm.DB, username, password string, roles ...string) (Operator, error) {
+	username = strings.TrimSpace(username)
+	if username == "" {
+		return Operator{}, errors.New("auth: username is required")
+	}
+	if len(password) < MinPasswordLength {
+		return Operator{}, ErrWeakPassword
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return Operator{}, err
+	}
+	operator := Operator{Username: username, PasswordHash: string(hash)}
+	if len(roles) > 0 {
+		if err := db.Where("name IN ?", roles).Find(&operator.Roles).Error; err != nil {
+			return Operator{}, err
+		}
+	}
+	return operator, db.Create(&operator).Error
+}
+
+// EnsureOperator creates an operator with the admin role unless one with
+// the same username already exists. It is used to bootstrap the first
+// account.
+func EnsureOperator(db *gorm.DB, username, password string) error {
+	var count int64
+	if err := db.Model(&Operator{}).Where("username = ?", username).Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+	_, err := CreateOperator(db, username, password, AdminRole)
+	return err
+}
+
+// Login checks an operator's credentials and starts a session.
+func (a *Authenticator) Login(db *gorm.DB, username, password string) (TokenPair, error) {
+	var operator Operator
+	err := db.Preload("Roles").Where("username = ?", strings.TrimSpace(username)).First(&operator).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return TokenPair{}, ErrInvalidCredentials
+	}
+	if err != nil {
+		return TokenPair{}, err
+	}
+	if bcrypt.CompareHashAndPassword([]byte(operator.PasswordHash), []byte(password)) != nil || operator.Disabled {
+		return TokenPair{}, ErrInvalidCredentials
+	}
+
+	var pair TokenPair
+	err = db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		if err := tx.Model(&operator).Update("last_login_at", now).Error; err != nil {
+			return err
+		}
+		var err error
+		pair, _, err = a.startSession(tx, operator, now)
+		return err
+	})
+	return pair, err
+}
+
+// Refresh exchanges a refresh token for a new token pair. Presenting a
+// refresh token that was already used revokes every session of the
+// operator, since it means the token was stolen or replayed.
+func (a *Authenticator) Refresh(db *gorm.DB, refreshToken string) (TokenPair, error) {
+	var pair TokenPair
+	var reused bool
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var session Session
+		if err := tx.Where("token_hash = ?", hashToken(refreshToken)).First(&session).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrInvalidToken
+			}
+			return err
+		}
+
+		now := time.Now()
+		if session.RevokedAt != nil {
+			reused = true
+			return ErrInvalidToken
+		}
+		if now.After(session.ExpiresAt) {
+			return ErrInvalidToken
+		}
+
+		// Revoking only a session that is still live makes a concurrent
+		// refresh with the same token find nothing to revoke, so exactly
+		// one of them gets a new pair and the other counts as reuse
+		result := tx.Model(&Session{}).
+			Where("id = ? AND revoked_at IS NULL", session.ID).
+			Update("revoked_at", now)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			reused = true
+			return ErrInvalidToken
+		}
+
+		var operator Operator
+		if err := tx.Preload("Roles").First(&operator, session.OperatorID).Error; err != nil {
+			return err
+		}
+		if operator.Disabled {
+			return ErrInvalidToken
+		}
+
+		var next Session
+		var err error
+		pair, next, err = a.startSession(tx, operator, now)
+		if err != nil {
+			return err
+		}
+		return tx.Model(&session).Update("replaced_by_id", next.ID).Error
+	})
+	if reused {
+		if err := revokeOperatorSessions(db, refreshToken); err != nil {
+			return TokenPair{}, err
+		}
+	}
+	return pair, err
+}
+
+// Logout revokes the session of a refresh token. Unknown tokens are
+// ignored. Access tokens already issued stay valid until they expire, which
+// AccessTTL keeps short.
+func (a *Authenticator) Logout(db *gorm.DB, refreshToken string) error {
+	return db.Model(&Session{}).
+		Where("token_hash = ? AND revoked_at IS NULL", hashToken(refreshToken)).
+		Update("revoked_at", time.Now()).Error
+}
+
+func (a *Authenticator) startSession(tx *gorm.DB, operator Operator, now time.Time) (TokenPair, Session, error) {
+	refreshToken, err := randomToken()
+	if err != nil {
+		return TokenPair{}, Session{}, err
+	}
+	session := Session{
+		OperatorID: operator.ID,
+		TokenHash:  hashToken(refreshToken),
+		ExpiresAt:  now.Add(a.RefreshTTL),
+	}
+	if err := tx.Create(&session).Error; err != nil {
+		return TokenPair{}, Session{}, err
+	}
+
+	accessToken, expires, err := a.sign(operator, session.ID, now)
+	if err != nil {
+		return TokenPair{}, Session{}, err
+	}
+	return TokenPair{
+		AccessToken:  accessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(a.AccessTTL.Seconds()),
+		ExpiresAt:    expires,
+		RefreshToken: refreshToken,
+	}, session, nil
+}
+
+func revokeOperatorSessions(db *gorm.DB, refreshToken string) error {
+	var session Session
+	if err := db.Where("token_hash = ?", hashToken(refreshToken)).First(&session).Error; err != nil {
+		return err
+	}
+	return RevokeSessions(db, session.OperatorID)
+}
+
+// RevokeSessions ends every session of an operator, for example when the
+// operator is disabled.
+func RevokeSessions(db *gorm.DB, operatorID uint) error {
+	return db.Model(&Session{}).
+		Where("operator_id = ? AND revoked_at IS NULL", operatorID).
+		Update("revoked_at", time.Now()).Error
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashToken returns the stored form of a refresh token. Refresh tokens are
+// random, so a fast hash is enough.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
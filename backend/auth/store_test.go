@@ -0,0 +1,95 @@
+package auth_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"gorm.io/gorm"
+
+	"back-forms/auth"
+	"back-forms/config"
+	"back-forms/database"
+	"back-forms/migrations"
+)
+
+func newTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	db, err := database.Open(config.Database{
+		Driver: config.DriverSQLite,
+		Path:   filepath.Join(t.TempDir(), "auth.db"),
+	}, config.NewLevelVar("error"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+
+	m, err := migrations.New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Up(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := auth.Setup(db); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestRefreshConcurrentReuse(t *testing.T) {
+	db := newTestDB(t)
+	a, err := auth.New("0123456789abcdef0123456789abcdef")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := auth.CreateOperator(db, "admin", "correct horse battery", auth.AdminRole); err != nil {
+		t.Fatal(err)
+	}
+	pair, err := a.Login(db, "admin", "correct horse battery")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const refreshes = 4
+	var wg sync.WaitGroup
+	errs := make(chan error, refreshes)
+	for i := 0; i < refreshes; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := a.Refresh(db, pair.RefreshToken)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	succeeded := 0
+	for err := range errs {
+		switch {
+		case err == nil:
+			succeeded++
+		case !errors.Is(err, auth.ErrInvalidToken):
+			t.Fatalf("Refresh: %v", err)
+		}
+	}
+	if succeeded != 1 {
+		t.Fatalf("%d refreshes succeeded, want 1", succeeded)
+	}
+
+	// The replayed token revoked every session, including the new one
+	var live int64
+	if err := db.Model(&auth.Session{}).Where("revoked_at IS NULL").Count(&live).Error; err != nil {
+		t.Fatal(err)
+	}
+	if live != 0 {
+		t.Fatalf("%d sessions are still live, want 0", live)
+	}
+}
@@ -0,0 +1,300 @@
+// Package config holds the settings of the user and report services. Values
+// come from built-in defaults, then an optional YAML or TOML file, then
+// environment variables, then command line flags, each overriding the one
+// before. Secrets can be read from files so they stay out of the
+// environment and the process list.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"back-forms/auth"
+	"back-forms/ratelimit"
+)
+
+// Log levels, from most to least verbose.
+const (
+	LevelDebug  = "debug"
+	LevelInfo   = "info"
+	LevelWarn   = "warn"
+	LevelError  = "error"
+	LevelSilent = "silent"
+)
+
+// Database drivers.
+const (
+	DriverPostgres = "postgres"
+	DriverSQLite   = "sqlite"
+)
+
+// redacted replaces secrets when the config is printed.
+const redacted = "******"
+
+// Config is the configuration of a service. Struct tags name the file key,
+// the environment variable and the flag of each setting; settings tagged
+// secret are redacted when printed and may be read from a file.
+type Config struct {
+	Server      Server      `yaml:"server" toml:"server"`
+	Database    Database    `yaml:"database" toml:"database"`
+	CORS        CORS        `yaml:"cors" toml:"cors"`
+	Log         Log         `yaml:"log" toml:"log"`
+	Auth        Auth        `yaml:"auth" toml:"auth"`
+	RateLimit   RateLimit   `yaml:"rate_limit" toml:"rate_limit"`
+	Idempotency Idempotency `yaml:"idempotency" toml:"idempotency"`
+	Users       Users       `yaml:"users" toml:"users"`
+	OpenAPI     OpenAPI     `yaml:"openapi" toml:"openapi"`
+}
+
+// Server configures the HTTP listener.
+type Server struct {
+	Addr         string        `yaml:"addr" toml:"addr" env:"HTTP_ADDR" flag:"addr" usage:"address to listen on"`
+	ReadTimeout  time.Duration `yaml:"read_timeout" toml:"read_timeout" env:"HTTP_READ_TIMEOUT"`
+	WriteTimeout time.Duration `yaml:"write_timeout" toml:"write_timeout" env:"HTTP_WRITE_TIMEOUT"`
+	IdleTimeout  time.Duration `yaml:"idle_timeout" toml:"idle_timeout" env:"HTTP_IDLE_TIMEOUT"`
+	// PreStopDelay is how long the service keeps serving after it starts
+	// reporting not ready on shutdown, so that load balancers stop sending
+	// it traffic before it stops accepting connections.
+	PreStopDelay time.Duration `yaml:"pre_stop_delay" toml:"pre_stop_delay" env:"HTTP_PRE_STOP_DELAY"`
+	// ShutdownTimeout bounds how long in-flight requests may take to finish
+	// on shutdown.
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" toml:"shutdown_timeout" env:"HTTP_SHUTDOWN_TIMEOUT"`
+}
+
+// Database configures the database connection and its pool. Driver is
+// postgres or sqlite. DSN, when set, is used as is instead of the
+// individual connection settings; for SQLite these are just Path, the
+// database file.
+type Database struct {
+	Driver          string        `yaml:"driver" toml:"driver" env:"DB_DRIVER" flag:"db-driver" usage:"database driver, postgres or sqlite"`
+	Path            string        `yaml:"path" toml:"path" env:"DB_PATH" flag:"db-path" usage:"SQLite database file"`
+	DSN             string        `yaml:"dsn" toml:"dsn" env:"DB_DSN" secret:"true"`
+	Host            string        `yaml:"host" toml:"host" env:"DB_HOST" flag:"db-host" usage:"database host"`
+	Port            int           `yaml:"port" toml:"port" env:"DB_PORT" flag:"db-port" usage:"database port"`
+	User            string        `yaml:"user" toml:"user" env:"DB_USER" flag:"db-user" usage:"database user"`
+	Password        string        `yaml:"password" toml:"password" env:"DB_PASSWORD" secret:"true"`
+	Name            string        `yaml:"name" toml:"name" env:"DB_NAME" flag:"db-name" usage:"database name"`
+	SSLMode         string        `yaml:"sslmode" toml:"sslmode" env:"DB_SSLMODE"`
+	TimeZone        string        `yaml:"timezone" toml:"timezone" env:"DB_TIMEZONE"`
+	MaxIdleConns    int           `yaml:"max_idle_conns" toml:"max_idle_conns" env:"DB_MAX_IDLE_CONNS"`
+	MaxOpenConns    int           `yaml:"max_open_conns" toml:"max_open_conns" env:"DB_MAX_OPEN_CONNS"`
+	ConnMaxLifetime time.Duration `yaml:"conn_max_lifetime" toml:"conn_max_lifetime" env:"DB_CONN_MAX_LIFETIME"`
+	// AutoMigrate applies pending migrations when the user service starts.
+	AutoMigrate bool `yaml:"auto_migrate" toml:"auto_migrate" env:"DB_AUTO_MIGRATE"`
+}
+
+// ConnectionString returns the DSN to open the database with.
+func (d Database) ConnectionString() string {
+	if d.DSN != "" {
+		return d.DSN
+	}
+	if d.Driver == DriverSQLite {
+		// Foreign keys are off by default in SQLite, and taking the write
+		// lock when a transaction begins avoids deadlocks on upgrade
+		return d.Path + "?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_txlock=immediate"
+	}
+	parts := []string{
+		"host=" + dsnValue(d.Host),
+		fmt.Sprintf("port=%d", d.Port),
+		"user=" + dsnValue(d.User),
+		"dbname=" + dsnValue(d.Name),
+		"sslmode=" + dsnValue(d.SSLMode),
+		"TimeZone=" + dsnValue(d.TimeZone),
+	}
+	if d.Password != "" {
+		parts = append(parts, "password="+dsnValue(d.Password))
+	}
+	return strings.Join(parts, " ")
+}
+
+// dsnValue quotes a key=value DSN value when it is empty or contains
+// spaces, quotes or backslashes.
+func dsnValue(s string) string {
+	if s != "" && !strings.ContainsAny(s, ` '\`) {
+		return s
+	}
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
+
+// CORS configures cross-origin requests. An origin of "*" allows any.
+type CORS struct {
+	AllowedOrigins []string `yaml:"allowed_origins" toml:"allowed_origins" env:"CORS_ALLOWED_ORIGINS" flag:"cors-origins" usage:"comma separated allowed origins"`
+}
+
+// Log configures logging.
+type Log struct {
+	Level string `yaml:"level" toml:"level" env:"LOG_LEVEL" flag:"log-level" usage:"debug, info, warn, error or silent"`
+}
+
+// Auth configures operator authentication. The bootstrap operator is
+// created at startup when OperatorUsername is set.
+type Auth struct {
+	Secret           string        `yaml:"secret" toml:"secret" env:"AUTH_SECRET" secret:"true"`
+	AccessTTL        time.Duration `yaml:"access_ttl" toml:"access_ttl" env:"AUTH_ACCESS_TTL"`
+	RefreshTTL       time.Duration `yaml:"refresh_ttl" toml:"refresh_ttl" env:"AUTH_REFRESH_TTL"`
+	OperatorUsername string        `yaml:"operator_username" toml:"operator_username" env:"OPERATOR_USERNAME"`
+	OperatorPassword string        `yaml:"operator_password" toml:"operator_password" env:"OPERATOR_PASSWORD" secret:"true"`
+}
+
+// RateLimit configures the rate limiter; see ratelimit.ParseRules for the
+// format of Rules, which override the service's defaults.
+type RateLimit struct {
+	Rules      string `yaml:"rules" toml:"rules" env:"RATE_LIMITS"`
+	Store      string `yaml:"store" toml:"store" env:"RATE_LIMIT_STORE"`
+	TrustProxy bool   `yaml:"trust_proxy" toml:"trust_proxy" env:"RATE_LIMIT_TRUST_PROXY"`
+}
+
+// Idempotency configures how long idempotent responses are replayed.
+type Idempotency struct {
+	TTL time.Duration `yaml:"ttl" toml:"ttl" env:"IDEMPOTENCY_TTL"`
+}
+
+// Users configures user validation.
+type Users struct {
+	PhoneUniqueness string `yaml:"phone_uniqueness" toml:"phone_uniqueness" env:"PHONE_UNIQUENESS"`
+}
+
+// OpenAPI configures checking traffic against the service's OpenAPI
+// document. Requests that do not match are rejected; responses that do not
+// match are logged, which copies every JSON response and is meant for
+// development.
+type OpenAPI struct {
+	ValidateRequests  bool `yaml:"validate_requests" toml:"validate_requests" env:"OPENAPI_VALIDATE_REQUESTS"`
+	ValidateResponses bool `yaml:"validate_responses" toml:"validate_responses" env:"OPENAPI_VALIDATE_RESPONSES"`
+}
+
+// Default returns the settings used for anything not configured.
+func Default() Config {
+	return Config{
+		Server: Server{
+			ReadTimeout:     15 * time.Second,
+			WriteTimeout:    15 * time.Second,
+			IdleTimeout:     60 * time.Second,
+			PreStopDelay:    5 * time.Second,
+			ShutdownTimeout: 30 * time.Second,
+		},
+		Database: Database{
+			Driver:          DriverPostgres,
+			Host:            "localhost",
+			Port:            5432,
+			User:            "myuser",
+			Name:            "formsdb",
+			SSLMode:         "disable",
+			TimeZone:        "Asia/Tehran",
+			MaxIdleConns:    10,
+			MaxOpenConns:    100,
+			ConnMaxLifetime: time.Hour,
+			AutoMigrate:     true,
+		},
+		CORS: CORS{AllowedOrigins: []string{"http://localhost:3000"}},
+		Log:  Log{Level: LevelInfo},
+		Auth: Auth{
+			AccessTTL:  auth.DefaultAccessTTL,
+			RefreshTTL: auth.DefaultRefreshTTL,
+		},
+		RateLimit:   RateLimit{Store: "memory"},
+		Idempotency: Idempotency{TTL: 24 * time.Hour},
+		Users:       Users{PhoneUniqueness: "reject"},
+	}
+}
+
+// Validate reports every invalid setting at once.
+func (c Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(c.Server.Addr != "", "server.addr is required")
+	check(c.Server.ReadTimeout > 0, "server.read_timeout must be positive")
+	check(c.Server.WriteTimeout > 0, "server.write_timeout must be positive")
+	check(c.Server.IdleTimeout > 0, "server.idle_timeout must be positive")
+	check(c.Server.PreStopDelay >= 0, "server.pre_stop_delay must not be negative")
+	check(c.Server.ShutdownTimeout > 0, "server.shutdown_timeout must be positive")
+
+	check(c.Database.Driver == DriverPostgres || c.Database.Driver == DriverSQLite, "database.driver must be postgres or sqlite")
+	if c.Database.Driver == DriverSQLite {
+		check(c.Database.DSN != "" || c.Database.Path != "", "database.path is required with the sqlite driver")
+	} else if c.Database.DSN == "" {
+		check(c.Database.Host != "", "database.host is required")
+		check(c.Database.Port > 0 && c.Database.Port < 65536, "database.port must be between 1 and 65535")
+		check(c.Database.User != "", "database.user is required")
+		check(c.Database.Name != "", "database.name is required")
+		if c.Database.TimeZone != "" {
+			_, err := time.LoadLocation(c.Database.TimeZone)
+			check(err == nil, "database.timezone %q is not a known time zone", c.Database.TimeZone)
+		}
+	}
+	check(c.Database.MaxOpenConns > 0, "database.max_open_conns must be positive")
+	check(c.Database.MaxIdleConns >= 0 && c.Database.MaxIdleConns <= c.Database.MaxOpenConns,
+		"database.max_idle_conns must be between 0 and max_open_conns")
+	check(c.Database.ConnMaxLifetime >= 0, "database.conn_max_lifetime must not be negative")
+
+	check(len(c.CORS.AllowedOrigins) > 0, "cors.allowed_origins is required")
+	for _, origin := range c.CORS.AllowedOrigins {
+		check(validOrigin(origin), "cors.allowed_origins: %q is not an origin such as https://example.com", origin)
+	}
+
+	check(ValidLevel(c.Log.Level), "log.level must be debug, info, warn, error or silent")
+
+	check(len(c.Auth.Secret) >= auth.MinSecretLength, "auth.secret must be at least %d bytes", auth.MinSecretLength)
+	check(c.Auth.AccessTTL > 0, "auth.access_ttl must be positive")
+	check(c.Auth.RefreshTTL > c.Auth.AccessTTL, "auth.refresh_ttl must be longer than auth.access_ttl")
+	if c.Auth.OperatorUsername != "" {
+		check(len(c.Auth.OperatorPassword) >= auth.MinPasswordLength,
+			"auth.operator_password must be at least %d characters", auth.MinPasswordLength)
+	}
+
+	if _, err := ratelimit.ParseRules(c.RateLimit.Rules); err != nil {
+		errs = append(errs, fmt.Errorf("rate_limit.rules: %w", err))
+	}
+	check(c.RateLimit.Store == "memory" || c.RateLimit.Store == "postgres", "rate_limit.store must be memory or postgres")
+
+	check(c.Idempotency.TTL > 0, "idempotency.ttl must be positive")
+
+	return errors.Join(errs...)
+}
+
+// ValidLevel reports whether level is one of the log levels.
+func ValidLevel(level string) bool {
+	switch level {
+	case LevelDebug, LevelInfo, LevelWarn, LevelError, LevelSilent:
+		return true
+	}
+	return false
+}
+
+func validOrigin(origin string) bool {
+	if origin == "*" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" && (u.Path == "" || u.Path == "/")
+}
+
+// Redacted returns a copy of c with secrets replaced.
+func (c Config) Redacted() Config {
+	walk(&c, func(f field) {
+		if f.secret && f.value.String() != "" {
+			f.value.SetString(redacted)
+		}
+	})
+	return c
+}
+
+// String formats the config as YAML with secrets redacted, for logging the
+// effective settings at startup.
+func (c Config) String() string {
+	out, err := yaml.Marshal(c.Redacted())
+	if err != nil {
+		return err.Error()
+	}
+	return string(out)
+}
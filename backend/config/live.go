@@ -0,0 +1,79 @@
+package config
+
+import (
+	"sync/atomic"
+)
+
+// LevelVar is a log level that can be changed while the service runs.
+type LevelVar struct {
+	level atomic.Value
+}
+
+// NewLevelVar returns a LevelVar set to level.
+func NewLevelVar(level string) *LevelVar {
+	v := &LevelVar{}
+	v.Set(level)
+	return v
+}
+
+// Level returns the current level.
+func (v *LevelVar) Level() string {
+	level, _ := v.level.Load().(string)
+	return level
+}
+
+// Set changes the level.
+func (v *LevelVar) Set(level string) {
+	v.level.Store(level)
+}
+
+// Enabled reports whether messages at level are logged at the current
+// level.
+func (v *LevelVar) Enabled(level string) bool {
+	return rank(level) >= rank(v.Level())
+}
+
+func rank(level string) int {
+	switch level {
+	case LevelDebug:
+		return 0
+	case LevelInfo:
+		return 1
+	case LevelWarn:
+		return 2
+	case LevelError:
+		return 3
+	default:
+		return 4
+	}
+}
+
+// Origins is a list of allowed CORS origins that can be replaced while the
+// service runs.
+type Origins struct {
+	allowed atomic.Pointer[[]string]
+}
+
+// NewOrigins returns Origins allowing origins.
+func NewOrigins(origins []string) *Origins {
+	o := &Origins{}
+	o.Set(origins)
+	return o
+}
+
+// Set replaces the allowed origins.
+func (o *Origins) Set(origins []string) {
+	origins = append([]string(nil), origins...)
+	o.allowed.Store(&origins)
+}
+
+// Allowed reports whether requests from origin are allowed. It has the
+// signature of cors.Options.AllowOriginFunc.
+func (o *Origins) Allowed(origin string) bool {
+	for _, allowed := range *o.allowed.Load() {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,245 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigFileEnv names the config file when the -config flag is not given.
+const ConfigFileEnv = "CONFIG_FILE"
+
+// secretFilePrefix marks a secret value that names the file holding it,
+// as in "file:/run/secrets/db_password".
+const secretFilePrefix = "file:"
+
+// Loader loads a service's config. It keeps the command line so the config
+// can be loaded again on SIGHUP with the same flags.
+type Loader struct {
+	defaults Config
+	args     []string
+}
+
+// NewLoader returns a Loader for a service whose own defaults, such as its
+// listen address, are in defaults. args are the command line arguments
+// without the program name.
+func NewLoader(defaults Config, args []string) *Loader {
+	return &Loader{defaults: defaults, args: args}
+}
+
+// Load reads the config file, the environment and the flags over the
+// defaults, resolves secrets kept in files and validates the result.
+func (l *Loader) Load() (Config, error) {
+	cfg := l.defaults
+
+	// Flags are parsed first to find the config file, and applied last
+	var path string
+	var flags []func() error
+	fs := flag.NewFlagSet(filepath.Base(os.Args[0]), flag.ContinueOnError)
+	fs.StringVar(&path, "config", os.Getenv(ConfigFileEnv), "path to a YAML or TOML config file")
+	walk(&cfg, func(f field) {
+		if f.flag == "" {
+			return
+		}
+		fs.Func(f.flag, f.usage, func(s string) error {
+			flags = append(flags, func() error { return f.set(s) })
+			return nil
+		})
+	})
+	if err := fs.Parse(l.args); err != nil {
+		return Config{}, err
+	}
+
+	if path != "" {
+		if err := readFile(path, &cfg); err != nil {
+			return Config{}, err
+		}
+	}
+
+	var errs []error
+	walk(&cfg, func(f field) {
+		if err := f.fromEnv(); err != nil {
+			errs = append(errs, err)
+		}
+	})
+	for _, apply := range flags {
+		if err := apply(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	walk(&cfg, func(f field) {
+		if err := f.resolveSecret(); err != nil {
+			errs = append(errs, err)
+		}
+	})
+	if len(errs) > 0 {
+		return Config{}, errs[0]
+	}
+	return cfg, cfg.Validate()
+}
+
+// Watch loads the config again whenever the process receives SIGHUP and
+// passes it to apply. A config that fails to load is logged and ignored.
+func (l *Loader) Watch(apply func(Config)) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			cfg, err := l.Load()
+			if err != nil {
+				log.Printf("Ignoring reloaded configuration: %v", err)
+				continue
+			}
+			apply(cfg)
+		}
+	}()
+}
+
+// readFile decodes a YAML or TOML file, picked by its extension, over cfg.
+func readFile(path string, cfg *Config) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+	defer f.Close()
+
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(f)
+		decoder.KnownFields(true)
+		if err := decoder.Decode(cfg); err != nil && err != io.EOF {
+			return fmt.Errorf("config: %s: %w", path, err)
+		}
+	case ".toml":
+		meta, err := toml.NewDecoder(f).Decode(cfg)
+		if err != nil {
+			return fmt.Errorf("config: %s: %w", path, err)
+		}
+		if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+			return fmt.Errorf("config: %s: unknown key %s", path, undecoded[0])
+		}
+	default:
+		return fmt.Errorf("config: %s: unsupported extension %q, want .yaml, .yml or .toml", path, ext)
+	}
+	return nil
+}
+
+// field is a setting found by walk.
+type field struct {
+	value  reflect.Value
+	env    string
+	flag   string
+	usage  string
+	secret bool
+}
+
+// walk calls fn for every setting of cfg.
+func walk(cfg *Config, fn func(field)) {
+	var visit func(v reflect.Value)
+	visit = func(v reflect.Value) {
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			sf, fv := t.Field(i), v.Field(i)
+			if fv.Kind() == reflect.Struct {
+				visit(fv)
+				continue
+			}
+			fn(field{
+				value:  fv,
+				env:    sf.Tag.Get("env"),
+				flag:   sf.Tag.Get("flag"),
+				usage:  sf.Tag.Get("usage"),
+				secret: sf.Tag.Get("secret") == "true",
+			})
+		}
+	}
+	visit(reflect.ValueOf(cfg).Elem())
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// set parses s into the setting.
+func (f field) set(s string) error {
+	name := f.env
+	if name == "" {
+		name = f.flag
+	}
+	switch {
+	case f.value.Type() == durationType:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return fmt.Errorf("config: %s: %w", name, err)
+		}
+		f.value.SetInt(int64(d))
+	case f.value.Kind() == reflect.String:
+		f.value.SetString(s)
+	case f.value.Kind() == reflect.Int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return fmt.Errorf("config: %s: %q is not a number", name, s)
+		}
+		f.value.SetInt(int64(n))
+	case f.value.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("config: %s: %q is not a boolean", name, s)
+		}
+		f.value.SetBool(b)
+	case f.value.Kind() == reflect.Slice:
+		var items []string
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		f.value.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("config: %s: unsupported type %s", name, f.value.Type())
+	}
+	return nil
+}
+
+// fromEnv sets the setting from its environment variable. Secrets can also
+// be read from the file named by the variable with a _FILE suffix.
+func (f field) fromEnv() error {
+	if f.env == "" {
+		return nil
+	}
+	if s, ok := os.LookupEnv(f.env); ok {
+		return f.set(s)
+	}
+	if path, ok := os.LookupEnv(f.env + "_FILE"); ok && f.secret {
+		return f.set(secretFilePrefix + path)
+	}
+	return nil
+}
+
+// resolveSecret replaces a secret of the form file:path with the contents
+// of the file, without a trailing newline.
+func (f field) resolveSecret() error {
+	if !f.secret {
+		return nil
+	}
+	path, ok := strings.CutPrefix(f.value.String(), secretFilePrefix)
+	if !ok {
+		return nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("config: %s: %w", f.env, err)
+	}
+	f.value.SetString(strings.TrimRight(string(b), "\r\n"))
+	return nil
+}
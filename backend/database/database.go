@@ -0,0 +1,98 @@
+// Package database opens the Postgres or SQLite connection shared by the
+// services.
+package database
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+
+	"back-forms/config"
+)
+
+// Open connects to the configured database and sizes its pool. SQL is
+// logged according to level, which can change while the service runs.
+func Open(cfg config.Database, level *config.LevelVar) (*gorm.DB, error) {
+	dialector := postgres.Open(cfg.ConnectionString())
+	if cfg.Driver == config.DriverSQLite {
+		dialector = sqlite.Open(cfg.ConnectionString())
+	}
+	db, err := gorm.Open(dialector, &gorm.Config{
+		Logger: newLogger(level),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sqlDB, err := db.DB()
+	if err != nil {
+		return nil, err
+	}
+	sqlDB.SetMaxIdleConns(cfg.MaxIdleConns)
+	sqlDB.SetMaxOpenConns(cfg.MaxOpenConns)
+	sqlDB.SetConnMaxLifetime(cfg.ConnMaxLifetime)
+	return db, nil
+}
+
+// gormLogger logs through GORM's logger at the level currently set in a
+// config.LevelVar. At debug and info every statement is logged, at warn
+// only slow ones and errors.
+type gormLogger struct {
+	base  logger.Interface
+	level *config.LevelVar
+}
+
+func newLogger(level *config.LevelVar) logger.Interface {
+	return gormLogger{
+		base: logger.New(
+			log.New(log.Writer(), "\r\n", log.LstdFlags),
+			logger.Config{
+				SlowThreshold:             time.Second,
+				LogLevel:                  logger.Info,
+				IgnoreRecordNotFoundError: false,
+				Colorful:                  true,
+			},
+		),
+		level: level,
+	}
+}
+
+// current returns the base logger set to the current level.
+func (l gormLogger) current() logger.Interface {
+	switch l.level.Level() {
+	case config.LevelDebug, config.LevelInfo:
+		return l.base.LogMode(logger.Info)
+	case config.LevelWarn:
+		return l.base.LogMode(logger.Warn)
+	case config.LevelError:
+		return l.base.LogMode(logger.Error)
+	default:
+		return l.base.LogMode(logger.Silent)
+	}
+}
+
+// LogMode is ignored; the level follows the LevelVar.
+func (l gormLogger) LogMode(logger.LogLevel) logger.Interface {
+	return l
+}
+
+func (l gormLogger) Info(ctx context.Context, msg string, args ...interface{}) {
+	l.current().Info(ctx, msg, args...)
+}
+
+func (l gormLogger) Warn(ctx context.Context, msg string, args ...interface{}) {
+	l.current().Warn(ctx, msg, args...)
+}
+
+func (l gormLogger) Error(ctx context.Context, msg string, args ...interface{}) {
+	l.current().Error(ctx, msg, args...)
+}
+
+func (l gormLogger) Trace(ctx context.Context, begin time.Time, fc func() (string, int64), err error) {
+	l.current().Trace(ctx, begin, fc, err)
+}
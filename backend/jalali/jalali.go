@@ -0,0 +1,345 @@
+// Package jalali implements a date type for the Solar Hijri (Jalali) calendar
+// used by the forms services. Dates are stored as YYYYMMDD strings and
+// rendered as YYYY/MM/DD in JSON.
+package jalali
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrInvalidDate is returned (wrapped) when a value cannot be parsed into a
+// valid Jalali date.
+var ErrInvalidDate = errors.New("invalid jalali date")
+
+// Date represents a single day in the Jalali calendar. The zero value is an
+// empty date.
+type Date struct {
+	Year  int
+	Month int
+	Day   int
+}
+
+// breaks holds the years in which the 33-year leap cycle is interrupted.
+var breaks = []int{
+	-61, 9, 38, 199, 426, 686, 756, 818, 1111, 1181, 1210,
+	1635, 2060, 2097, 2192, 2262, 2324, 2394, 2456, 3178,
+}
+
+// MinYear and MaxYear bound the years supported by the conversion algorithm.
+const (
+	MinYear = -61
+	MaxYear = 3177
+)
+
+// New returns the date for the given year, month and day after validating it.
+func New(year, month, day int) (Date, error) {
+	d := Date{Year: year, Month: month, Day: day}
+	if err := d.Validate(); err != nil {
+		return Date{}, err
+	}
+	return d, nil
+}
+
+// Validate reports whether d is a real day in the Jalali calendar.
+func (d Date) Validate() error {
+	if d.Year < MinYear || d.Year > MaxYear {
+		return fmt.Errorf("%w: year %d out of range", ErrInvalidDate, d.Year)
+	}
+	if d.Month < 1 || d.Month > 12 {
+		return fmt.Errorf("%w: month %d out of range", ErrInvalidDate, d.Month)
+	}
+	if n := MonthLength(d.Year, d.Month); d.Day < 1 || d.Day > n {
+		return fmt.Errorf("%w: day %d out of range for %04d/%02d", ErrInvalidDate, d.Day, d.Year, d.Month)
+	}
+	return nil
+}
+
+// IsZero reports whether d is the empty date.
+func (d Date) IsZero() bool {
+	return d.Year == 0 && d.Month == 0 && d.Day == 0
+}
+
+// String returns the date formatted as YYYY/MM/DD, or "" for the zero date.
+func (d Date) String() string {
+	if d.IsZero() {
+		return ""
+	}
+	return fmt.Sprintf("%04d/%02d/%02d", d.Year, d.Month, d.Day)
+}
+
+// Compact returns the date formatted as YYYYMMDD, the layout used in the
+// database. It returns "" for the zero date.
+func (d Date) Compact() string {
+	if d.IsZero() {
+		return ""
+	}
+	return fmt.Sprintf("%04d%02d%02d", d.Year, d.Month, d.Day)
+}
+
+// Before reports whether d falls before other.
+func (d Date) Before(other Date) bool {
+	return d.Compact() < other.Compact()
+}
+
+// After reports whether d falls after other.
+func (d Date) After(other Date) bool {
+	return d.Compact() > other.Compact()
+}
+
+// IsLeap reports whether the given Jalali year is a leap year.
+func IsLeap(year int) bool {
+	leap, _, _ := jalCal(year)
+	return leap == 0
+}
+
+// MonthLength returns the number of days in the given Jalali month.
+func MonthLength(year, month int) int {
+	switch {
+	case month <= 6:
+		return 31
+	case month <= 11:
+		return 30
+	case IsLeap(year):
+		return 30
+	default:
+		return 29
+	}
+}
+
+// NormalizeDigits replaces Persian and Arabic-Indic digits in s with their
+// Latin equivalents.
+func NormalizeDigits(s string) string {
+	var b strings.Builder
+	b.Grow(len(s))
+	for _, r := range s {
+		switch {
+		case r >= '۰' && r <= '۹':
+			b.WriteRune('0' + (r - '۰'))
+		case r >= '٠' && r <= '٩':
+			b.WriteRune('0' + (r - '٠'))
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// Parse parses a Jalali date written with Persian, Arabic or Latin digits.
+// The year, month and day may be separated by any non-digit characters, or
+// written together as YYYYMMDD.
+func Parse(s string) (Date, error) {
+	s = strings.TrimSpace(NormalizeDigits(s))
+	if s == "" {
+		return Date{}, fmt.Errorf("%w: empty value", ErrInvalidDate)
+	}
+
+	parts := strings.FieldsFunc(s, func(r rune) bool {
+		return r < '0' || r > '9'
+	})
+
+	switch {
+	case len(parts) == 1 && len(parts[0]) == 8:
+		parts = []string{parts[0][:4], parts[0][4:6], parts[0][6:]}
+	case len(parts) != 3:
+		return Date{}, fmt.Errorf("%w: %q", ErrInvalidDate, s)
+	}
+
+	var nums [3]int
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return Date{}, fmt.Errorf("%w: %q", ErrInvalidDate, s)
+		}
+		nums[i] = n
+	}
+
+	return New(nums[0], nums[1], nums[2])
+}
+
+// MustParse is like Parse but panics if the value is invalid.
+func MustParse(s string) Date {
+	d, err := Parse(s)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+// FromTime returns the Jalali date of t in t's location.
+func FromTime(t time.Time) Date {
+	y, m, d := t.Date()
+	jy, jm, jd := d2j(g2d(y, int(m), d))
+	return Date{Year: jy, Month: jm, Day: jd}
+}
+
+// Time returns midnight of d in the given location.
+func (d Date) Time(loc *time.Location) time.Time {
+	if loc == nil {
+		loc = time.UTC
+	}
+	gy, gm, gd := d2g(j2d(d.Year, d.Month, d.Day))
+	return time.Date(gy, time.Month(gm), gd, 0, 0, 0, 0, loc)
+}
+
+// AddDays returns the date n days after d.
+func (d Date) AddDays(n int) Date {
+	jy, jm, jd := d2j(j2d(d.Year, d.Month, d.Day) + n)
+	return Date{Year: jy, Month: jm, Day: jd}
+}
+
+// MarshalJSON implements json.Marshaler.
+func (d Date) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// UnmarshalJSON implements json.Unmarshaler. Empty strings and null decode
+// to the zero date.
+func (d *Date) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		*d = Date{}
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidDate, data)
+	}
+	if strings.TrimSpace(s) == "" {
+		*d = Date{}
+		return nil
+	}
+	parsed, err := Parse(s)
+	if err != nil {
+		return err
+	}
+	*d = parsed
+	return nil
+}
+
+// Scan implements sql.Scanner.
+func (d *Date) Scan(value interface{}) error {
+	var s string
+	switch v := value.(type) {
+	case nil:
+		*d = Date{}
+		return nil
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	case time.Time:
+		*d = FromTime(v)
+		return nil
+	default:
+		return fmt.Errorf("%w: cannot scan %T", ErrInvalidDate, value)
+	}
+	if strings.TrimSpace(s) == "" {
+		*d = Date{}
+		return nil
+	}
+	parsed, err := Parse(s)
+	if err != nil {
+		return err
+	}
+	*d = parsed
+	return nil
+}
+
+// Value implements driver.Valuer. The zero date is stored as NULL.
+func (d Date) Value() (driver.Value, error) {
+	if d.IsZero() {
+		return nil, nil
+	}
+	if err := d.Validate(); err != nil {
+		return nil, err
+	}
+	return d.Compact(), nil
+}
+
+// GormDataType tells GORM to store Date in a string column.
+func (Date) GormDataType() string {
+	return "string"
+}
+
+// jalCal returns the leap status (0 for leap years), the Gregorian year at
+// the start of the Jalali year and the March day of Nowruz.
+func jalCal(jy int) (leap, gy, march int) {
+	gy = jy + 621
+	leapJ := -14
+	jp := breaks[0]
+	jump := 0
+	for i := 1; i < len(breaks); i++ {
+		jm := breaks[i]
+		jump = jm - jp
+		if jy < jm {
+			break
+		}
+		leapJ += jump/33*8 + jump%33/4
+		jp = jm
+	}
+	n := jy - jp
+	leapJ += n/33*8 + (n%33+3)/4
+	if jump%33 == 4 && jump-n == 4 {
+		leapJ++
+	}
+	leapG := gy/4 - (gy/100+1)*3/4 - 150
+	march = 20 + leapJ - leapG
+
+	if jump-n < 6 {
+		n = n - jump + (jump+4)/33*33
+	}
+	leap = ((n+1)%33 - 1) % 4
+	if leap == -1 {
+		leap = 4
+	}
+	return leap, gy, march
+}
+
+// j2d converts a Jalali date to a Julian day number.
+func j2d(jy, jm, jd int) int {
+	_, gy, march := jalCal(jy)
+	return g2d(gy, 3, march) + (jm-1)*31 - jm/7*(jm-7) + jd - 1
+}
+
+// d2j converts a Julian day number to a Jalali date.
+func d2j(jdn int) (jy, jm, jd int) {
+	gy, _, _ := d2g(jdn)
+	jy = gy - 621
+	leap, _, march := jalCal(jy)
+	k := jdn - g2d(gy, 3, march)
+	if k >= 0 {
+		if k <= 185 {
+			return jy, 1 + k/31, k%31 + 1
+		}
+		k -= 186
+	} else {
+		jy--
+		k += 179
+		if leap == 1 {
+			k++
+		}
+	}
+	return jy, 7 + k/30, k%30 + 1
+}
+
+// g2d converts a Gregorian date to a Julian day number.
+func g2d(gy, gm, gd int) int {
+	d := (gy+(gm-8)/6+100100)*1461/4 + (153*((gm+9)%12)+2)/5 + gd - 34840408
+	return d - (gy+100100+(gm-8)/6)/100*3/4 + 752
+}
+
+// d2g converts a Julian day number to a Gregorian date.
+func d2g(jdn int) (gy, gm, gd int) {
+	j := 4*jdn + 139361631
+	j += (4*jdn+183187720)/146097*3/4*4 - 3908
+	i := j%1461/4*5 + 308
+	gd = i%153/5 + 1
+	gm = (i/153)%12 + 1
+	gy = j/1461 - 100100 + (8-gm)/6
+	return gy, gm, gd
+}
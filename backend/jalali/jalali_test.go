@@ -0,0 +1,197 @@
+package jalali
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestIsLeap(t *testing.T) {
+	tests := []struct {
+		year int
+		want bool
+	}{
+		{1371, false},
+		{1375, true},
+		{1395, true},
+		{1399, true},
+		{1400, false},
+		{1402, false},
+		{1403, true},
+		{1404, false},
+		{1407, false},
+		{1408, true},
+	}
+	for _, tt := range tests {
+		if got := IsLeap(tt.year); got != tt.want {
+			t.Errorf("IsLeap(%d) = %v, want %v", tt.year, got, tt.want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		date Date
+		ok   bool
+	}{
+		{Date{1403, 12, 30}, true},
+		{Date{1399, 12, 30}, true},
+		{Date{1404, 12, 29}, true},
+		{Date{1404, 12, 30}, false},
+		{Date{1402, 12, 30}, false},
+		{Date{1404, 6, 31}, true},
+		{Date{1404, 7, 31}, false},
+		{Date{1404, 13, 1}, false},
+		{Date{1404, 1, 0}, false},
+		{Date{MaxYear + 1, 1, 1}, false},
+	}
+	for _, tt := range tests {
+		err := tt.date.Validate()
+		if (err == nil) != tt.ok {
+			t.Errorf("%v.Validate() = %v, want ok %v", tt.date, err, tt.ok)
+		}
+		if err != nil && !errors.Is(err, ErrInvalidDate) {
+			t.Errorf("%v.Validate() = %v, want ErrInvalidDate", tt.date, err)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Date
+	}{
+		{"1403/01/01", Date{1403, 1, 1}},
+		{"1403-1-1", Date{1403, 1, 1}},
+		{"14030101", Date{1403, 1, 1}},
+		{" 1370.05.12 ", Date{1370, 5, 12}},
+		{"۱۴۰۳/۰۱/۰۱", Date{1403, 1, 1}},
+		{"١٤٠٣/٠١/٠١", Date{1403, 1, 1}},
+		{"۱۴۰۳-01/٠١", Date{1403, 1, 1}},
+		{"۱۳۹۹ ۱۲ ۳۰", Date{1399, 12, 30}},
+	}
+	for _, tt := range tests {
+		got, err := Parse(tt.in)
+		if err != nil || got != tt.want {
+			t.Errorf("Parse(%q) = %v, %v, want %v", tt.in, got, err, tt.want)
+		}
+	}
+
+	for _, in := range []string{"", "1403/01", "1403/01/01/01", "1403011", "1404/12/30", "۱۴۰۴/۱۲/۳۰", "1403/00/10"} {
+		if _, err := Parse(in); !errors.Is(err, ErrInvalidDate) {
+			t.Errorf("Parse(%q) error = %v, want ErrInvalidDate", in, err)
+		}
+	}
+}
+
+func TestGregorian(t *testing.T) {
+	tests := []struct {
+		gregorian string
+		jalali    Date
+	}{
+		{"2024-03-20", Date{1403, 1, 1}},
+		{"2024-03-19", Date{1402, 12, 29}},
+		{"2025-03-20", Date{1403, 12, 30}},
+		{"2025-03-21", Date{1404, 1, 1}},
+		{"2021-03-20", Date{1399, 12, 30}},
+		{"1991-08-03", Date{1370, 5, 12}},
+		{"2029-03-20", Date{1408, 1, 1}},
+		{"2000-01-01", Date{1378, 10, 11}},
+	}
+	for _, tt := range tests {
+		g, err := time.Parse(time.DateOnly, tt.gregorian)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := FromTime(g); got != tt.jalali {
+			t.Errorf("FromTime(%s) = %v, want %v", tt.gregorian, got, tt.jalali)
+		}
+		if got := tt.jalali.Time(time.UTC); !got.Equal(g) {
+			t.Errorf("%v.Time() = %s, want %s", tt.jalali, got.Format(time.DateOnly), tt.gregorian)
+		}
+	}
+
+	// Every day of a few years, leap and common, survives the round trip
+	start := Date{1398, 1, 1}
+	for i := 0; i < 4*366; i++ {
+		d := start.AddDays(i)
+		if err := d.Validate(); err != nil {
+			t.Fatalf("%d days after %v: %v", i, start, err)
+		}
+		if got := FromTime(d.Time(time.UTC)); got != d {
+			t.Fatalf("FromTime(%v.Time()) = %v", d, got)
+		}
+	}
+}
+
+func TestJSON(t *testing.T) {
+	data, err := json.Marshal(struct{ D Date }{Date{1403, 1, 1}})
+	if err != nil || string(data) != `{"D":"1403/01/01"}` {
+		t.Fatalf("Marshal = %s, %v", data, err)
+	}
+	if data, _ := json.Marshal(Date{}); string(data) != `""` {
+		t.Errorf("Marshal(zero) = %s", data)
+	}
+
+	tests := []struct {
+		in   string
+		want Date
+	}{
+		{`"1403/01/01"`, Date{1403, 1, 1}},
+		{`"۱۴۰۳-۰۱-۰۱"`, Date{1403, 1, 1}},
+		{`""`, Date{}},
+		{`null`, Date{}},
+	}
+	for _, tt := range tests {
+		d := Date{1, 1, 1}
+		if err := json.Unmarshal([]byte(tt.in), &d); err != nil || d != tt.want {
+			t.Errorf("Unmarshal(%s) = %v, %v, want %v", tt.in, d, err, tt.want)
+		}
+	}
+
+	for _, in := range []string{`"1404/12/30"`, `14030101`, `"abc"`} {
+		var d Date
+		if err := json.Unmarshal([]byte(in), &d); !errors.Is(err, ErrInvalidDate) {
+			t.Errorf("Unmarshal(%s) error = %v, want ErrInvalidDate", in, err)
+		}
+	}
+}
+
+func TestScanValue(t *testing.T) {
+	tests := []struct {
+		in   interface{}
+		want Date
+	}{
+		{"14030101", Date{1403, 1, 1}},
+		{[]byte("14030101"), Date{1403, 1, 1}},
+		{"1403/01/01", Date{1403, 1, 1}},
+		{[]byte("۱۴۰۳/۰۱/۰۱"), Date{1403, 1, 1}},
+		{time.Date(2024, 3, 20, 0, 0, 0, 0, time.UTC), Date{1403, 1, 1}},
+		{"", Date{}},
+		{nil, Date{}},
+	}
+	for _, tt := range tests {
+		d := Date{1, 1, 1}
+		if err := d.Scan(tt.in); err != nil || d != tt.want {
+			t.Errorf("Scan(%#v) = %v, %v, want %v", tt.in, d, err, tt.want)
+		}
+	}
+
+	for _, in := range []interface{}{"14041230", []byte("x"), 14030101} {
+		var d Date
+		if err := d.Scan(in); !errors.Is(err, ErrInvalidDate) {
+			t.Errorf("Scan(%#v) error = %v, want ErrInvalidDate", in, err)
+		}
+	}
+
+	if v, err := (Date{1403, 1, 1}).Value(); err != nil || v != "14030101" {
+		t.Errorf("Value() = %v, %v, want 14030101", v, err)
+	}
+	if v, err := (Date{}).Value(); err != nil || v != nil {
+		t.Errorf("Value() of the zero date = %v, %v, want nil", v, err)
+	}
+	if _, err := (Date{1404, 12, 30}).Value(); !errors.Is(err, ErrInvalidDate) {
+		t.Errorf("Value() of 1404/12/30 error = %v, want ErrInvalidDate", err)
+	}
+}
@@ -0,0 +1,91 @@
+package migrations
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// ErrUsage is returned by Command for malformed arguments.
+var ErrUsage = errors.New("usage: migrate up | down [N] | status | to N")
+
+// Command runs a migrate subcommand and reports what it did to out:
+//
+//	up       apply every pending migration
+//	down [N] roll back the newest N migrations, 1 by default
+//	status   list migrations and when they were applied
+//	to N     migrate up or down to version N
+func Command(ctx context.Context, m *Migrator, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return ErrUsage
+	}
+
+	var done []Migration
+	var err error
+	switch args[0] {
+	case "up":
+		if len(args) != 1 {
+			return ErrUsage
+		}
+		done, err = m.Up(ctx)
+	case "down":
+		steps := 1
+		if len(args) == 2 {
+			if steps, err = strconv.Atoi(args[1]); err != nil || steps < 1 {
+				return ErrUsage
+			}
+		} else if len(args) > 2 {
+			return ErrUsage
+		}
+		done, err = m.Down(ctx, steps)
+	case "to":
+		if len(args) != 2 {
+			return ErrUsage
+		}
+		version, convErr := strconv.Atoi(args[1])
+		if convErr != nil || version < 0 {
+			return ErrUsage
+		}
+		done, err = m.To(ctx, version)
+	case "status":
+		if len(args) != 1 {
+			return ErrUsage
+		}
+		return printStatus(ctx, m, out)
+	default:
+		return ErrUsage
+	}
+
+	for _, migration := range done {
+		fmt.Fprintf(out, "%04d_%s\n", migration.Version, migration.Name)
+	}
+	if err != nil {
+		return err
+	}
+	if len(done) == 0 {
+		fmt.Fprintln(out, "Nothing to do")
+	}
+	version, err := m.Version(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Schema is at version %d\n", version)
+	return nil
+}
+
+func printStatus(ctx context.Context, m *Migrator, out io.Writer) error {
+	statuses, err := m.Status(ctx)
+	if err != nil {
+		return err
+	}
+	for _, status := range statuses {
+		applied := "pending"
+		if status.AppliedAt != nil {
+			applied = "applied " + status.AppliedAt.Format("2006-01-02 15:04:05")
+		}
+		fmt.Fprintf(out, "%04d_%-30s %s\n", status.Version, status.Name, applied)
+	}
+	return nil
+}
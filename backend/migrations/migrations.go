@@ -0,0 +1,363 @@
+// Package migrations versions the database schema. Migrations are plain SQL
+// files embedded in the binary, named NNNN_name.up.sql and
+// NNNN_name.down.sql, and applied in order. Each dialect has its own set
+// with the same versions. The applied versions are recorded in
+// schema_migrations. On Postgres an advisory lock keeps replicas from
+// migrating at the same time; SQLite databases have a single writer.
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+//go:embed postgres/*.sql sqlite/*.sql
+var files embed.FS
+
+// lockID is the Postgres advisory lock held while migrating.
+const lockID = 7_203_551_884_120_001
+
+// dialect holds the statements that differ between databases.
+type dialect struct {
+	lock        string
+	unlock      string
+	createTable string
+	tableExists string
+	insert      string
+	delete      string
+}
+
+var dialects = map[string]dialect{
+	"postgres": {
+		lock:   `SELECT pg_advisory_lock($1)`,
+		unlock: `SELECT pg_advisory_unlock($1)`,
+		createTable: `
+            CREATE TABLE IF NOT EXISTS schema_migrations (
+                version    bigint      PRIMARY KEY,
+                name       text        NOT NULL,
+                applied_at timestamptz NOT NULL
+            )`,
+		tableExists: `SELECT to_regclass('schema_migrations') IS NOT NULL`,
+		insert:      `INSERT INTO schema_migrations (version, name, applied_at) VALUES ($1, $2, $3)`,
+		delete:      `DELETE FROM schema_migrations WHERE version = $1`,
+	},
+	"sqlite": {
+		createTable: `
+            CREATE TABLE IF NOT EXISTS schema_migrations (
+                version    integer  PRIMARY KEY,
+                name       text     NOT NULL,
+                applied_at datetime NOT NULL
+            )`,
+		tableExists: `SELECT COUNT(*) > 0 FROM sqlite_master WHERE type = 'table' AND name = 'schema_migrations'`,
+		insert:      `INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)`,
+		delete:      `DELETE FROM schema_migrations WHERE version = ?`,
+	},
+}
+
+// fileName matches migration file names.
+var fileName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Migration is one step of the schema.
+type Migration struct {
+	Version int    `json:"version"`
+	Name    string `json:"name"`
+	Up      string `json:"-"`
+	Down    string `json:"-"`
+}
+
+// Status is a migration and when it was applied, if it was.
+type Status struct {
+	Migration
+	AppliedAt *time.Time `json:"applied_at"`
+}
+
+// Migrator applies migrations to a database.
+type Migrator struct {
+	db         *sql.DB
+	dialect    dialect
+	migrations []Migration
+}
+
+// New returns a Migrator for db with the embedded migrations of its
+// dialect, postgres or sqlite.
+func New(db *gorm.DB) (*Migrator, error) {
+	name := db.Dialector.Name()
+	d, ok := dialects[name]
+	if !ok {
+		return nil, fmt.Errorf("migrations: unsupported dialect %q", name)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		return nil, err
+	}
+	dir, err := fs.Sub(files, name)
+	if err != nil {
+		return nil, err
+	}
+	migrations, err := Load(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{db: sqlDB, dialect: d, migrations: migrations}, nil
+}
+
+// Load reads the migrations in the root of fsys, ordered by version. Every
+// version needs both an up and a down file.
+func Load(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+	byVersion := map[int]*Migration{}
+	for _, entry := range entries {
+		match := fileName.FindStringSubmatch(entry.Name())
+		if match == nil {
+			continue
+		}
+		version, _ := strconv.Atoi(match[1])
+		body, err := fs.ReadFile(fsys, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		} else if m.Name != match[2] {
+			return nil, fmt.Errorf("migrations: version %d has two names, %s and %s", version, m.Name, match[2])
+		}
+		if match[3] == "up" {
+			m.Up = string(body)
+		} else {
+			m.Down = string(body)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migrations: %04d_%s needs both an up and a down file", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// Latest returns the version of the newest migration.
+func (m *Migrator) Latest() int {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+	return m.migrations[len(m.migrations)-1].Version
+}
+
+// Version returns the newest applied version, or 0 on an empty database.
+func (m *Migrator) Version(ctx context.Context) (int, error) {
+	applied, err := m.applied(ctx, m.db)
+	if err != nil {
+		return 0, err
+	}
+	version := 0
+	for v := range applied {
+		version = max(version, v)
+	}
+	return version, nil
+}
+
+// Verify returns an error while migrations are pending. It is used as a
+// readiness check.
+func (m *Migrator) Verify(ctx context.Context) error {
+	version, err := m.Version(ctx)
+	if err != nil {
+		return err
+	}
+	if version < m.Latest() {
+		return fmt.Errorf("schema is at version %d, want %d", version, m.Latest())
+	}
+	return nil
+}
+
+// Status lists every migration and whether it has been applied.
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	applied, err := m.applied(ctx, m.db)
+	if err != nil {
+		return nil, err
+	}
+	statuses := make([]Status, len(m.migrations))
+	for i, migration := range m.migrations {
+		statuses[i].Migration = migration
+		if at, ok := applied[migration.Version]; ok {
+			statuses[i].AppliedAt = &at
+		}
+	}
+	return statuses, nil
+}
+
+// Up applies every pending migration.
+func (m *Migrator) Up(ctx context.Context) ([]Migration, error) {
+	return m.To(ctx, m.Latest())
+}
+
+// Down rolls back the newest steps applied migrations.
+func (m *Migrator) Down(ctx context.Context, steps int) ([]Migration, error) {
+	var done []Migration
+	err := m.locked(ctx, func(conn *sql.Conn) error {
+		applied, err := m.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for i := len(m.migrations) - 1; i >= 0 && len(done) < steps; i-- {
+			migration := m.migrations[i]
+			if _, ok := applied[migration.Version]; !ok {
+				continue
+			}
+			if err := m.run(ctx, conn, migration, false); err != nil {
+				return err
+			}
+			done = append(done, migration)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// To migrates up or down so that exactly the migrations up to version are
+// applied. Version 0 rolls back everything.
+func (m *Migrator) To(ctx context.Context, version int) ([]Migration, error) {
+	if version != 0 && !m.known(version) {
+		return nil, fmt.Errorf("migrations: unknown version %d", version)
+	}
+	var done []Migration
+	err := m.locked(ctx, func(conn *sql.Conn) error {
+		applied, err := m.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+		// Roll back newest first, then apply oldest first
+		for i := len(m.migrations) - 1; i >= 0; i-- {
+			migration := m.migrations[i]
+			if _, ok := applied[migration.Version]; ok && migration.Version > version {
+				if err := m.run(ctx, conn, migration, false); err != nil {
+					return err
+				}
+				done = append(done, migration)
+			}
+		}
+		for _, migration := range m.migrations {
+			if _, ok := applied[migration.Version]; !ok && migration.Version <= version {
+				if err := m.run(ctx, conn, migration, true); err != nil {
+					return err
+				}
+				done = append(done, migration)
+			}
+		}
+		return nil
+	})
+	return done, err
+}
+
+func (m *Migrator) known(version int) bool {
+	for _, migration := range m.migrations {
+		if migration.Version == version {
+			return true
+		}
+	}
+	return false
+}
+
+// locked runs fn on a single connection holding the migration lock, after
+// making sure schema_migrations exists.
+func (m *Migrator) locked(ctx context.Context, fn func(conn *sql.Conn) error) error {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// Advisory locks belong to the session, so lock and unlock on conn
+	if m.dialect.lock != "" {
+		if _, err := conn.ExecContext(ctx, m.dialect.lock, int64(lockID)); err != nil {
+			return fmt.Errorf("migrations: taking lock: %w", err)
+		}
+		defer conn.ExecContext(context.Background(), m.dialect.unlock, int64(lockID))
+	}
+
+	if _, err := conn.ExecContext(ctx, m.dialect.createTable); err != nil {
+		return err
+	}
+	return fn(conn)
+}
+
+// run applies or rolls back one migration in a transaction together with
+// its schema_migrations row.
+func (m *Migrator) run(ctx context.Context, conn *sql.Conn, migration Migration, up bool) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	body, record, args := migration.Down, m.dialect.delete, []interface{}{migration.Version}
+	if up {
+		body, record, args = migration.Up, m.dialect.insert, []interface{}{migration.Version, migration.Name, time.Now().UTC()}
+	}
+	// Without arguments the whole file is sent as one multi-statement query
+	if _, err := tx.ExecContext(ctx, body); err != nil {
+		return fmt.Errorf("migrations: %04d_%s: %w", migration.Version, migration.Name, err)
+	}
+	if _, err := tx.ExecContext(ctx, record, args...); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// queryer is satisfied by *sql.DB and *sql.Conn.
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// applied returns the applied versions and when they were applied. A
+// database without schema_migrations has none.
+func (m *Migrator) applied(ctx context.Context, q queryer) (map[int]time.Time, error) {
+	var exists bool
+	rows, err := q.QueryContext(ctx, m.dialect.tableExists)
+	if err != nil {
+		return nil, err
+	}
+	if rows.Next() {
+		err = rows.Scan(&exists)
+	}
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+	applied := map[int]time.Time{}
+	if !exists {
+		return applied, nil
+	}
+
+	rows, err = q.QueryContext(ctx, `SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var version int
+		var at time.Time
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, err
+		}
+		applied[version] = at
+	}
+	return applied, rows.Err()
+}
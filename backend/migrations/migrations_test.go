@@ -0,0 +1,146 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+
+	"back-forms/jalali"
+	"back-forms/user-service/models"
+)
+
+// baselineUser and baselineAddress are the models as they were before any
+// migration existed, when the schema came from AutoMigrate.
+type baselineUser struct {
+	ID          uint   `gorm:"primaryKey"`
+	Firstname   string `gorm:"not null"`
+	Lastname    string `gorm:"not null"`
+	PhoneNumber string `gorm:"not null"`
+	Gender      string `gorm:"not null"`
+	PersianDate string `gorm:"not null"`
+	CreatedAt   time.Time
+	DeletedAt   gorm.DeletedAt    `gorm:"index"`
+	Addresses   []baselineAddress `gorm:"foreignKey:UserID;references:ID"`
+}
+
+func (baselineUser) TableName() string { return "users" }
+
+type baselineAddress struct {
+	ID      uint   `gorm:"primaryKey"`
+	UserID  uint   `gorm:"not null"`
+	Subject string `gorm:"not null"`
+	Details string `gorm:"not null"`
+}
+
+func (baselineAddress) TableName() string { return "addresses" }
+
+// openPostgres connects to the database in TEST_POSTGRES_DSN, in a schema
+// of its own that is dropped after the test.
+func openPostgres(t *testing.T) *gorm.DB {
+	t.Helper()
+	dsn := os.Getenv("TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("TEST_POSTGRES_DSN is not set")
+	}
+	config := &gorm.Config{Logger: logger.Discard}
+	admin, err := gorm.Open(postgres.Open(dsn), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := fmt.Sprintf("migrations_test_%d", time.Now().UnixNano())
+	if err := admin.Exec("CREATE SCHEMA " + schema).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := gorm.Open(postgres.Open(dsn+" search_path="+schema), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+		admin.Exec("DROP SCHEMA " + schema + " CASCADE")
+		if sqlDB, err := admin.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	return db
+}
+
+func TestUpgradeFromAutoMigrateBaseline(t *testing.T) {
+	db := openPostgres(t)
+	ctx := context.Background()
+
+	if err := db.AutoMigrate(&baselineUser{}, &baselineAddress{}); err != nil {
+		t.Fatal(err)
+	}
+	old := baselineUser{
+		Firstname: "Sara", Lastname: "Ahmadi", PhoneNumber: "09121234567", Gender: "Female", PersianDate: "1370/05/12",
+		Addresses: []baselineAddress{{Subject: "Home", Details: "Tehran"}},
+	}
+	if err := db.Create(&old).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	var user models.User
+	if err := db.Preload("Addresses").First(&user, old.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if user.Version != 1 || len(user.Addresses) != 1 || user.Addresses[0].Kind != models.AddressKindOther || user.Addresses[0].Version != 1 {
+		t.Fatalf("upgraded user = %+v", user)
+	}
+
+	merged := models.User{
+		Firstname: "Sara", Lastname: "Ahmadi", PhoneNumber: "09121234567", Gender: "Female",
+		PersianDate: jalali.Date{Year: 1370, Month: 5, Day: 12}, MergedIntoID: &user.ID,
+		Addresses: []models.Address{{Subject: "Work", Details: "Tehran", Province: "Tehran", PostalCode: "1234567890"}},
+	}
+	if err := db.Create(&merged).Error; err != nil {
+		t.Fatalf("writing a user with the new columns: %v", err)
+	}
+}
+
+func TestUpDown(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")+"?_pragma=foreign_keys(1)"), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	m, err := New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := m.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Verify(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Down(ctx, m.Latest()); err != nil {
+		t.Fatal(err)
+	}
+	if version, err := m.Version(ctx); err != nil || version != 0 {
+		t.Fatalf("Version() = %d, %v after rolling back everything", version, err)
+	}
+	if _, err := m.Up(ctx); err != nil {
+		t.Fatalf("reapplying: %v", err)
+	}
+}
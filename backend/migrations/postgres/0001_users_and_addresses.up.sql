@@ -0,0 +1,67 @@
+-- Users and their addresses. Tables and indexes use IF NOT EXISTS and the
+-- names GORM's AutoMigrate gave them, so databases created before versioned
+-- migrations are adopted as they are.
+CREATE TABLE IF NOT EXISTS users (
+    id             bigserial PRIMARY KEY,
+    firstname      text        NOT NULL,
+    lastname       text        NOT NULL,
+    phone_number   text        NOT NULL,
+    phone_input    text        NOT NULL DEFAULT '',
+    gender         text        NOT NULL,
+    persian_date   text        NOT NULL,
+    created_at     timestamptz,
+    deleted_at     timestamptz,
+    version        bigint      NOT NULL DEFAULT 1,
+    search_text    text        NOT NULL DEFAULT '',
+    merged_into_id bigint
+);
+
+CREATE TABLE IF NOT EXISTS addresses (
+    id          bigserial PRIMARY KEY,
+    user_id     bigint      NOT NULL,
+    kind        text        NOT NULL DEFAULT 'other',
+    subject     text        NOT NULL,
+    details     text        NOT NULL,
+    province    text        NOT NULL DEFAULT '',
+    city        text        NOT NULL DEFAULT '',
+    postal_code text        NOT NULL DEFAULT '',
+    plate       text        NOT NULL DEFAULT '',
+    unit        text        NOT NULL DEFAULT '',
+    deleted_at  timestamptz,
+    version     bigint      NOT NULL DEFAULT 1,
+    search_text text        NOT NULL DEFAULT ''
+);
+
+-- Databases created by AutoMigrate may predate any of the later columns
+ALTER TABLE users
+    ADD COLUMN IF NOT EXISTS phone_input    text   NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS version        bigint NOT NULL DEFAULT 1,
+    ADD COLUMN IF NOT EXISTS search_text    text   NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS merged_into_id bigint;
+
+ALTER TABLE addresses
+    ADD COLUMN IF NOT EXISTS kind        text        NOT NULL DEFAULT 'other',
+    ADD COLUMN IF NOT EXISTS province    text        NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS city        text        NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS postal_code text        NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS plate       text        NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS unit        text        NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS deleted_at  timestamptz,
+    ADD COLUMN IF NOT EXISTS version     bigint      NOT NULL DEFAULT 1,
+    ADD COLUMN IF NOT EXISTS search_text text        NOT NULL DEFAULT '';
+
+-- Replace the foreign key AutoMigrate created with explicit ones
+ALTER TABLE addresses DROP CONSTRAINT IF EXISTS fk_users_addresses;
+ALTER TABLE addresses DROP CONSTRAINT IF EXISTS addresses_user_id_fkey;
+ALTER TABLE addresses ADD CONSTRAINT addresses_user_id_fkey
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE;
+ALTER TABLE users DROP CONSTRAINT IF EXISTS users_merged_into_id_fkey;
+ALTER TABLE users ADD CONSTRAINT users_merged_into_id_fkey
+    FOREIGN KEY (merged_into_id) REFERENCES users (id) ON DELETE SET NULL;
+
+CREATE INDEX IF NOT EXISTS idx_users_phone_number ON users (phone_number);
+CREATE INDEX IF NOT EXISTS idx_users_deleted_at ON users (deleted_at);
+CREATE INDEX IF NOT EXISTS idx_users_merged_into_id ON users (merged_into_id);
+CREATE INDEX IF NOT EXISTS idx_addresses_user_id ON addresses (user_id);
+CREATE INDEX IF NOT EXISTS idx_addresses_deleted_at ON addresses (deleted_at);
+CREATE INDEX IF NOT EXISTS idx_addresses_region ON addresses (province, city);
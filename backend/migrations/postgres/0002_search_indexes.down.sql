@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_addresses_search_text;
+DROP INDEX IF EXISTS idx_users_search_text;
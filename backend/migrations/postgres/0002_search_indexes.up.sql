@@ -0,0 +1,6 @@
+-- Trigram indexes for ranked search over normalized names, phone numbers
+-- and addresses.
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+CREATE INDEX IF NOT EXISTS idx_users_search_text ON users USING gin (search_text gin_trgm_ops);
+CREATE INDEX IF NOT EXISTS idx_addresses_search_text ON addresses USING gin (search_text gin_trgm_ops);
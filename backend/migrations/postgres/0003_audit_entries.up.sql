@@ -0,0 +1,27 @@
+-- Append-only audit trail. user_id has no foreign key so that the history
+-- of a purged user is kept.
+CREATE TABLE IF NOT EXISTS audit_entries (
+    id          bigserial PRIMARY KEY,
+    entity_type text        NOT NULL,
+    entity_id   bigint      NOT NULL,
+    user_id     bigint      NOT NULL,
+    action      text        NOT NULL,
+    actor       text        NOT NULL,
+    request_id  text        NOT NULL DEFAULT '',
+    changes     jsonb       NOT NULL,
+    created_at  timestamptz NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_audit_entity ON audit_entries (entity_type, entity_id);
+CREATE INDEX IF NOT EXISTS idx_audit_entries_user_id ON audit_entries (user_id);
+
+CREATE OR REPLACE FUNCTION audit_entries_append_only() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'audit_entries is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS audit_entries_append_only ON audit_entries;
+CREATE TRIGGER audit_entries_append_only
+    BEFORE UPDATE OR DELETE OR TRUNCATE ON audit_entries
+    FOR EACH STATEMENT EXECUTE FUNCTION audit_entries_append_only();
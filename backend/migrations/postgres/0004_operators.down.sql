@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS operator_sessions;
+DROP TABLE IF EXISTS operator_roles;
+DROP TABLE IF EXISTS operators;
+DROP TABLE IF EXISTS roles;
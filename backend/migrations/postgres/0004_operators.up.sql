@@ -0,0 +1,53 @@
+-- Operator accounts, their roles and refresh token sessions.
+CREATE TABLE IF NOT EXISTS roles (
+    id          bigserial PRIMARY KEY,
+    name        text NOT NULL,
+    description text NOT NULL DEFAULT '',
+    permissions text NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS operators (
+    id            bigserial PRIMARY KEY,
+    username      text        NOT NULL,
+    password_hash text        NOT NULL,
+    disabled      boolean     NOT NULL DEFAULT false,
+    created_at    timestamptz,
+    last_login_at timestamptz
+);
+
+CREATE TABLE IF NOT EXISTS operator_roles (
+    operator_id bigint NOT NULL,
+    role_id     bigint NOT NULL,
+    PRIMARY KEY (operator_id, role_id)
+);
+
+CREATE TABLE IF NOT EXISTS operator_sessions (
+    id             bigserial PRIMARY KEY,
+    operator_id    bigint      NOT NULL,
+    token_hash     text        NOT NULL,
+    expires_at     timestamptz NOT NULL,
+    revoked_at     timestamptz,
+    replaced_by_id bigint,
+    created_at     timestamptz
+);
+
+ALTER TABLE operator_roles DROP CONSTRAINT IF EXISTS fk_operator_roles_operator;
+ALTER TABLE operator_roles DROP CONSTRAINT IF EXISTS fk_operator_roles_role;
+ALTER TABLE operator_roles DROP CONSTRAINT IF EXISTS operator_roles_operator_id_fkey;
+ALTER TABLE operator_roles ADD CONSTRAINT operator_roles_operator_id_fkey
+    FOREIGN KEY (operator_id) REFERENCES operators (id) ON DELETE CASCADE;
+ALTER TABLE operator_roles DROP CONSTRAINT IF EXISTS operator_roles_role_id_fkey;
+ALTER TABLE operator_roles ADD CONSTRAINT operator_roles_role_id_fkey
+    FOREIGN KEY (role_id) REFERENCES roles (id) ON DELETE CASCADE;
+ALTER TABLE operator_sessions DROP CONSTRAINT IF EXISTS operator_sessions_operator_id_fkey;
+ALTER TABLE operator_sessions ADD CONSTRAINT operator_sessions_operator_id_fkey
+    FOREIGN KEY (operator_id) REFERENCES operators (id) ON DELETE CASCADE;
+ALTER TABLE operator_sessions DROP CONSTRAINT IF EXISTS operator_sessions_replaced_by_id_fkey;
+ALTER TABLE operator_sessions ADD CONSTRAINT operator_sessions_replaced_by_id_fkey
+    FOREIGN KEY (replaced_by_id) REFERENCES operator_sessions (id) ON DELETE SET NULL;
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_roles_name ON roles (name);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_operators_username ON operators (username);
+CREATE INDEX IF NOT EXISTS idx_operator_roles_role_id ON operator_roles (role_id);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_operator_sessions_token_hash ON operator_sessions (token_hash);
+CREATE INDEX IF NOT EXISTS idx_operator_sessions_operator_id ON operator_sessions (operator_id);
@@ -0,0 +1,16 @@
+-- Hashed API keys for machine clients.
+CREATE TABLE IF NOT EXISTS api_keys (
+    id           bigserial PRIMARY KEY,
+    name         text        NOT NULL,
+    hint         text        NOT NULL,
+    key_hash     text        NOT NULL,
+    scopes       text        NOT NULL,
+    expires_at   timestamptz,
+    last_used_at timestamptz,
+    revoked_at   timestamptz,
+    created_by   text        NOT NULL DEFAULT '',
+    created_at   timestamptz,
+    rotated_at   timestamptz
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_api_keys_key_hash ON api_keys (key_hash);
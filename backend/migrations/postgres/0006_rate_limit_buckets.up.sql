@@ -0,0 +1,12 @@
+-- Token buckets of the Postgres rate limit store.
+CREATE TABLE IF NOT EXISTS rate_limit_buckets (
+    key        text             PRIMARY KEY,
+    tokens     double precision NOT NULL,
+    updated_at timestamptz      NOT NULL,
+    full_at    timestamptz      NOT NULL
+);
+
+-- AutoMigrate created the column as numeric
+ALTER TABLE rate_limit_buckets ALTER COLUMN tokens TYPE double precision;
+
+CREATE INDEX IF NOT EXISTS idx_rate_limit_buckets_full_at ON rate_limit_buckets (full_at);
@@ -0,0 +1,15 @@
+-- Stored responses of requests sent with an Idempotency-Key.
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    id           bigserial PRIMARY KEY,
+    scope        text        NOT NULL,
+    key          text        NOT NULL,
+    request_hash text        NOT NULL,
+    status       bigint      NOT NULL DEFAULT 0,
+    header       text        NOT NULL DEFAULT '',
+    body         bytea,
+    created_at   timestamptz,
+    expires_at   timestamptz NOT NULL
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_idempotency_scope_key ON idempotency_keys (scope, key);
+CREATE INDEX IF NOT EXISTS idx_idempotency_keys_expires_at ON idempotency_keys (expires_at);
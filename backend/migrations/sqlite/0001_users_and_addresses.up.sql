@@ -0,0 +1,40 @@
+-- Users and their addresses.
+CREATE TABLE IF NOT EXISTS users (
+    id             integer  PRIMARY KEY AUTOINCREMENT,
+    firstname      text     NOT NULL,
+    lastname       text     NOT NULL,
+    phone_number   text     NOT NULL,
+    phone_input    text     NOT NULL DEFAULT '',
+    gender         text     NOT NULL,
+    persian_date   text     NOT NULL,
+    created_at     datetime,
+    deleted_at     datetime,
+    version        integer  NOT NULL DEFAULT 1,
+    search_text    text     NOT NULL DEFAULT '',
+    merged_into_id integer
+        CONSTRAINT users_merged_into_id_fkey REFERENCES users (id) ON DELETE SET NULL
+);
+
+CREATE TABLE IF NOT EXISTS addresses (
+    id          integer  PRIMARY KEY AUTOINCREMENT,
+    user_id     integer  NOT NULL
+        CONSTRAINT addresses_user_id_fkey REFERENCES users (id) ON DELETE CASCADE,
+    kind        text     NOT NULL DEFAULT 'other',
+    subject     text     NOT NULL,
+    details     text     NOT NULL,
+    province    text     NOT NULL DEFAULT '',
+    city        text     NOT NULL DEFAULT '',
+    postal_code text     NOT NULL DEFAULT '',
+    plate       text     NOT NULL DEFAULT '',
+    unit        text     NOT NULL DEFAULT '',
+    deleted_at  datetime,
+    version     integer  NOT NULL DEFAULT 1,
+    search_text text     NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS idx_users_phone_number ON users (phone_number);
+CREATE INDEX IF NOT EXISTS idx_users_deleted_at ON users (deleted_at);
+CREATE INDEX IF NOT EXISTS idx_users_merged_into_id ON users (merged_into_id);
+CREATE INDEX IF NOT EXISTS idx_addresses_user_id ON addresses (user_id);
+CREATE INDEX IF NOT EXISTS idx_addresses_deleted_at ON addresses (deleted_at);
+CREATE INDEX IF NOT EXISTS idx_addresses_region ON addresses (province, city);
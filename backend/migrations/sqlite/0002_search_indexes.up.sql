@@ -0,0 +1,4 @@
+-- SQLite has no trigram indexes; search falls back to substring matching
+-- over the search_text columns. The version is kept so that both dialects
+-- share one numbering.
+SELECT 1;
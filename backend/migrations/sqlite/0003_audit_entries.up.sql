@@ -0,0 +1,28 @@
+-- Append-only audit trail. user_id has no foreign key so that the history
+-- of a purged user is kept.
+CREATE TABLE IF NOT EXISTS audit_entries (
+    id          integer  PRIMARY KEY AUTOINCREMENT,
+    entity_type text     NOT NULL,
+    entity_id   integer  NOT NULL,
+    user_id     integer  NOT NULL,
+    action      text     NOT NULL,
+    actor       text     NOT NULL,
+    request_id  text     NOT NULL DEFAULT '',
+    changes     text     NOT NULL,
+    created_at  datetime NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_audit_entity ON audit_entries (entity_type, entity_id);
+CREATE INDEX IF NOT EXISTS idx_audit_entries_user_id ON audit_entries (user_id);
+
+CREATE TRIGGER IF NOT EXISTS audit_entries_no_update
+    BEFORE UPDATE ON audit_entries
+BEGIN
+    SELECT RAISE(ABORT, 'audit_entries is append-only');
+END;
+
+CREATE TRIGGER IF NOT EXISTS audit_entries_no_delete
+    BEFORE DELETE ON audit_entries
+BEGIN
+    SELECT RAISE(ABORT, 'audit_entries is append-only');
+END;
@@ -0,0 +1,42 @@
+-- Operator accounts, their roles and refresh token sessions.
+CREATE TABLE IF NOT EXISTS roles (
+    id          integer PRIMARY KEY AUTOINCREMENT,
+    name        text    NOT NULL,
+    description text    NOT NULL DEFAULT '',
+    permissions text    NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS operators (
+    id            integer  PRIMARY KEY AUTOINCREMENT,
+    username      text     NOT NULL,
+    password_hash text     NOT NULL,
+    disabled      boolean  NOT NULL DEFAULT false,
+    created_at    datetime,
+    last_login_at datetime
+);
+
+CREATE TABLE IF NOT EXISTS operator_roles (
+    operator_id integer NOT NULL
+        CONSTRAINT operator_roles_operator_id_fkey REFERENCES operators (id) ON DELETE CASCADE,
+    role_id     integer NOT NULL
+        CONSTRAINT operator_roles_role_id_fkey REFERENCES roles (id) ON DELETE CASCADE,
+    PRIMARY KEY (operator_id, role_id)
+);
+
+CREATE TABLE IF NOT EXISTS operator_sessions (
+    id             integer  PRIMARY KEY AUTOINCREMENT,
+    operator_id    integer  NOT NULL
+        CONSTRAINT operator_sessions_operator_id_fkey REFERENCES operators (id) ON DELETE CASCADE,
+    token_hash     text     NOT NULL,
+    expires_at     datetime NOT NULL,
+    revoked_at     datetime,
+    replaced_by_id integer
+        CONSTRAINT operator_sessions_replaced_by_id_fkey REFERENCES operator_sessions (id) ON DELETE SET NULL,
+    created_at     datetime
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_roles_name ON roles (name);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_operators_username ON operators (username);
+CREATE INDEX IF NOT EXISTS idx_operator_roles_role_id ON operator_roles (role_id);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_operator_sessions_token_hash ON operator_sessions (token_hash);
+CREATE INDEX IF NOT EXISTS idx_operator_sessions_operator_id ON operator_sessions (operator_id);
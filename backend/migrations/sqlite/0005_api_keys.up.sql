@@ -0,0 +1,16 @@
+-- Hashed API keys for machine clients.
+CREATE TABLE IF NOT EXISTS api_keys (
+    id           integer  PRIMARY KEY AUTOINCREMENT,
+    name         text     NOT NULL,
+    hint         text     NOT NULL,
+    key_hash     text     NOT NULL,
+    scopes       text     NOT NULL,
+    expires_at   datetime,
+    last_used_at datetime,
+    revoked_at   datetime,
+    created_by   text     NOT NULL DEFAULT '',
+    created_at   datetime,
+    rotated_at   datetime
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_api_keys_key_hash ON api_keys (key_hash);
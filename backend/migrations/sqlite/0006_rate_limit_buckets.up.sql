@@ -0,0 +1,9 @@
+-- Token buckets of the database rate limit store.
+CREATE TABLE IF NOT EXISTS rate_limit_buckets (
+    key        text     PRIMARY KEY,
+    tokens     real     NOT NULL,
+    updated_at datetime NOT NULL,
+    full_at    datetime NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_rate_limit_buckets_full_at ON rate_limit_buckets (full_at);
@@ -0,0 +1,290 @@
+package openapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// maxBodySize caps the JSON request bodies read for validation.
+const maxBodySize = 1 << 20
+
+// Options selects what Middleware checks.
+type Options struct {
+	// Requests rejects requests whose parameters or JSON body do not match
+	// the document with 422 and the field errors, or with 415 when the
+	// operation takes no body of that media type.
+	Requests bool
+	// Responses logs responses whose status, media type or JSON body do not
+	// match the document. JSON responses are copied to be checked, so this
+	// is meant for development.
+	Responses bool
+}
+
+// ErrorResponse is the body of a 422 response to a request that does not
+// match the document.
+type ErrorResponse struct {
+	Errors Errors `json:"errors"`
+}
+
+// Middleware checks the requests and responses of the routes the document
+// describes. Routes it does not describe pass through unchecked. It must
+// be added to the router with Use, so that the matched route is known.
+func (d *Document) Middleware(opts Options) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		if !opts.Requests && !opts.Responses {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			op, ok := d.operation(r)
+			if !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if opts.Requests && !d.checkRequest(w, r, op) {
+				return
+			}
+			if !opts.Responses {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			rec := &recorder{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(rec, r)
+			if errs := d.checkResponse(op, rec); len(errs) > 0 {
+				path, _ := mux.CurrentRoute(r).GetPathTemplate()
+				log.Printf("OpenAPI: %s %s responded %d outside the document: %s", r.Method, path, rec.status, errs)
+			}
+		})
+	}
+}
+
+// checkRequest validates the parameters and body of r. When they do not
+// match it writes the error response and returns false.
+func (d *Document) checkRequest(w http.ResponseWriter, r *http.Request, op *operation) bool {
+	var errs Errors
+	vars := mux.Vars(r)
+	query := r.URL.Query()
+	for _, p := range op.parameters {
+		var values []string
+		switch p.in {
+		case "path":
+			if v, ok := vars[p.name]; ok {
+				values = []string{v}
+			}
+		case "query":
+			values = query[p.name]
+		case "header":
+			if v := r.Header.Get(p.name); v != "" {
+				values = []string{v}
+			}
+		default:
+			continue
+		}
+		d.checkParameter(p, values, &errs)
+	}
+
+	if op.requestBody != nil {
+		if status, message := d.checkBody(r, op.requestBody, &errs); status != 0 {
+			http.Error(w, message, status)
+			return false
+		}
+	}
+
+	if len(errs) > 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(ErrorResponse{Errors: errs})
+		return false
+	}
+	return true
+}
+
+// checkParameter validates the values given for p.
+func (d *Document) checkParameter(p parameter, values []string, errs *Errors) {
+	if len(values) == 0 {
+		if p.required {
+			errs.Add(p.name, CodeRequired, "is required")
+		}
+		return
+	}
+
+	schema, _ := d.resolve(p.schema).(map[string]interface{})
+	if types := schemaTypes(schema["type"]); len(types) == 1 && types[0] == "array" {
+		// Repeated query parameters, as in ?id=1&id=2
+		items := make([]interface{}, len(values))
+		for i, raw := range values {
+			value, ok := d.coerce(schema["items"], raw)
+			if !ok {
+				errs.Add(p.name, CodeInvalidType, "has an item of the wrong type")
+				return
+			}
+			items[i] = value
+		}
+		d.validate(schema, items, p.name, errs)
+		return
+	}
+
+	value, ok := d.coerce(schema, values[0])
+	if !ok {
+		errs.Add(p.name, CodeInvalidType, "must be "+describeTypes(schemaTypes(schema["type"])))
+		return
+	}
+	d.validate(schema, value, p.name, errs)
+}
+
+// checkBody validates a JSON request body and puts it back for the handler.
+// Other media types, such as file uploads, are only matched against the
+// document. When the body cannot be checked at all it returns the status
+// and message to respond with.
+func (d *Document) checkBody(r *http.Request, requestBody map[string]interface{}, errs *Errors) (int, string) {
+	content, _ := requestBody["content"].(map[string]interface{})
+	required, _ := requestBody["required"].(bool)
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	media, ok := content[mediaType].(map[string]interface{})
+	if !ok {
+		// Handlers that only take JSON decode it whatever the header says;
+		// those that take several media types choose by the header
+		if mediaType != "" && len(content) > 1 {
+			return http.StatusUnsupportedMediaType, "Unsupported media type"
+		}
+		if media, ok = content["application/json"].(map[string]interface{}); !ok {
+			if r.ContentLength == 0 && !required {
+				return 0, ""
+			}
+			return http.StatusUnsupportedMediaType, "Unsupported media type"
+		}
+		mediaType = "application/json"
+	}
+	if !isJSON(mediaType) {
+		return 0, ""
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxBodySize+1))
+	if err != nil {
+		return http.StatusBadRequest, "Invalid request body"
+	}
+	if len(body) > maxBodySize {
+		return http.StatusRequestEntityTooLarge, "Request body too large"
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	if len(bytes.TrimSpace(body)) == 0 {
+		if required {
+			errs.Add("body", CodeRequired, "is required")
+		}
+		return 0, ""
+	}
+	value, err := decode(body)
+	if err != nil {
+		return http.StatusBadRequest, "Invalid request body"
+	}
+	d.validate(media["schema"], value, "body", errs)
+	return 0, ""
+}
+
+// checkResponse validates a recorded response.
+func (d *Document) checkResponse(op *operation, rec *recorder) Errors {
+	var errs Errors
+	code := strconv.Itoa(rec.status)
+	response, ok := op.responses[code]
+	if !ok {
+		response, ok = op.responses[code[:1]+"XX"]
+	}
+	if !ok {
+		response, ok = op.responses["default"]
+	}
+	if !ok {
+		errs.Add("status", CodeInvalidChoice, "is not documented")
+		return errs
+	}
+
+	responseObject, _ := d.resolve(response).(map[string]interface{})
+	content, _ := responseObject["content"].(map[string]interface{})
+	if len(content) == 0 {
+		if rec.size > 0 {
+			errs.Add("body", CodeNoMatch, "is not documented")
+		}
+		return errs
+	}
+	mediaType, _, _ := mime.ParseMediaType(rec.Header().Get("Content-Type"))
+	media, ok := content[mediaType].(map[string]interface{})
+	if !ok {
+		errs.Add("content_type", CodeInvalidChoice, mediaType+" is not documented")
+		return errs
+	}
+	if !isJSON(mediaType) {
+		return errs
+	}
+
+	value, err := decode(rec.body.Bytes())
+	if err != nil {
+		errs.Add("body", CodeInvalidType, "is not valid JSON")
+		return errs
+	}
+	d.validate(media["schema"], value, "body", &errs)
+	return errs
+}
+
+// recorder passes a response through while keeping a copy of JSON bodies.
+type recorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	size        int
+	body        bytes.Buffer
+}
+
+func (rec *recorder) WriteHeader(status int) {
+	if !rec.wroteHeader {
+		rec.status = status
+		rec.wroteHeader = true
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *recorder) Write(b []byte) (int, error) {
+	rec.wroteHeader = true
+	rec.size += len(b)
+	if mediaType, _, _ := mime.ParseMediaType(rec.Header().Get("Content-Type")); isJSON(mediaType) {
+		rec.body.Write(b)
+	}
+	return rec.ResponseWriter.Write(b)
+}
+
+// Flush lets streamed exports through.
+func (rec *recorder) Flush() {
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (rec *recorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// isJSON reports whether mediaType is JSON, including types such as
+// application/merge-patch+json.
+func isJSON(mediaType string) bool {
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+func decode(body []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
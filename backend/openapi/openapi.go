@@ -0,0 +1,262 @@
+// Package openapi serves the OpenAPI 3.1 document of a service and checks
+// traffic against it. Documents are written in YAML or JSON and served as
+// JSON. Schemas are checked with the subset of JSON Schema the documents
+// use: $ref, type, enum, const, the string, number, array and object
+// bounds, and allOf, anyOf and oneOf. Formats are annotations only.
+package openapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/yaml.v3"
+)
+
+// methods lists the operations a path item can hold, lower case as in the
+// document.
+var methods = []string{"get", "put", "post", "delete", "options", "head", "patch", "trace"}
+
+// Document is a loaded OpenAPI document.
+type Document struct {
+	root       map[string]interface{}
+	body       []byte
+	operations map[string]*operation
+}
+
+// operation is an operation of the document with its parameters and
+// request body resolved.
+type operation struct {
+	parameters  []parameter
+	requestBody map[string]interface{}
+	responses   map[string]interface{}
+}
+
+// parameter is a path, query or header parameter.
+type parameter struct {
+	name     string
+	in       string
+	required bool
+	schema   interface{}
+}
+
+// Load parses a YAML or JSON OpenAPI document. Every $ref must point into
+// the document itself.
+func Load(data []byte) (*Document, error) {
+	var raw interface{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("openapi: %w", err)
+	}
+	root, ok := normalize(raw).(map[string]interface{})
+	if !ok || root["openapi"] == nil {
+		return nil, errors.New("openapi: not an OpenAPI document")
+	}
+	body, err := json.Marshal(root)
+	if err != nil {
+		return nil, fmt.Errorf("openapi: %w", err)
+	}
+
+	d := &Document{root: root, body: body, operations: map[string]*operation{}}
+	if err := d.checkRefs(root); err != nil {
+		return nil, err
+	}
+	paths, _ := root["paths"].(map[string]interface{})
+	for path, value := range paths {
+		item, _ := d.resolve(value).(map[string]interface{})
+		shared := d.parameters(item["parameters"])
+		for _, method := range methods {
+			op, ok := item[method].(map[string]interface{})
+			if !ok {
+				continue
+			}
+			requestBody, _ := d.resolve(op["requestBody"]).(map[string]interface{})
+			responses, _ := op["responses"].(map[string]interface{})
+			d.operations[key(method, path)] = &operation{
+				parameters:  mergeParameters(shared, d.parameters(op["parameters"])),
+				requestBody: requestBody,
+				responses:   responses,
+			}
+		}
+	}
+	return d, nil
+}
+
+// ServeHTTP serves the document as JSON.
+func (d *Document) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(d.body)
+}
+
+// Undocumented returns the routes of router that have no operation in the
+// document, as "METHOD /path". OPTIONS and HEAD routes are left out since
+// they are answered for every path.
+func (d *Document) Undocumented(router *mux.Router) []string {
+	var missing []string
+	router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		routeMethods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+		for _, method := range routeMethods {
+			if method == http.MethodOptions || method == http.MethodHead {
+				continue
+			}
+			if _, ok := d.operations[key(method, path)]; !ok {
+				missing = append(missing, method+" "+path)
+			}
+		}
+		return nil
+	})
+	sort.Strings(missing)
+	return missing
+}
+
+// operation returns the operation for the route r matched.
+func (d *Document) operation(r *http.Request) (*operation, bool) {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return nil, false
+	}
+	path, err := route.GetPathTemplate()
+	if err != nil {
+		return nil, false
+	}
+	op, ok := d.operations[key(r.Method, path)]
+	return op, ok
+}
+
+// parameters resolves a list of parameter objects.
+func (d *Document) parameters(value interface{}) []parameter {
+	list, _ := value.([]interface{})
+	params := make([]parameter, 0, len(list))
+	for _, item := range list {
+		p, ok := d.resolve(item).(map[string]interface{})
+		if !ok {
+			continue
+		}
+		name, _ := p["name"].(string)
+		in, _ := p["in"].(string)
+		required, _ := p["required"].(bool)
+		params = append(params, parameter{name: name, in: in, required: required || in == "path", schema: p["schema"]})
+	}
+	return params
+}
+
+// mergeParameters returns the path item's parameters overridden by the
+// operation's, which replace those with the same name and location.
+func mergeParameters(shared, own []parameter) []parameter {
+	merged := append([]parameter{}, own...)
+	for _, p := range shared {
+		overridden := false
+		for _, o := range own {
+			if o.name == p.name && o.in == p.in {
+				overridden = true
+				break
+			}
+		}
+		if !overridden {
+			merged = append(merged, p)
+		}
+	}
+	return merged
+}
+
+// resolve follows value's $ref, if any, to the value it points at.
+func (d *Document) resolve(value interface{}) interface{} {
+	for i := 0; i < 32; i++ {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return value
+		}
+		ref, ok := m["$ref"].(string)
+		if !ok {
+			return value
+		}
+		target, err := d.pointer(ref)
+		if err != nil {
+			return nil
+		}
+		value = target
+	}
+	return nil
+}
+
+// pointer returns the value at a reference such as
+// "#/components/schemas/User".
+func (d *Document) pointer(ref string) (interface{}, error) {
+	if !strings.HasPrefix(ref, "#/") {
+		return nil, fmt.Errorf("openapi: only local references are supported, not %q", ref)
+	}
+	var value interface{} = d.root
+	for _, token := range strings.Split(ref[2:], "/") {
+		token = strings.NewReplacer("~1", "/", "~0", "~").Replace(token)
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("openapi: unresolved reference %q", ref)
+		}
+		if value, ok = m[token]; !ok {
+			return nil, fmt.Errorf("openapi: unresolved reference %q", ref)
+		}
+	}
+	return value, nil
+}
+
+// checkRefs reports the first $ref under value that does not resolve.
+func (d *Document) checkRefs(value interface{}) error {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if ref, ok := v["$ref"].(string); ok {
+			if _, err := d.pointer(ref); err != nil {
+				return err
+			}
+		}
+		for _, child := range v {
+			if err := d.checkRefs(child); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for _, child := range v {
+			if err := d.checkRefs(child); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// normalize converts the maps YAML decodes into string-keyed maps, so that
+// response codes such as 200 become "200".
+func normalize(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			v[k] = normalize(child)
+		}
+		return v
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, child := range v {
+			m[fmt.Sprint(k)] = normalize(child)
+		}
+		return m
+	case []interface{}:
+		for i, child := range v {
+			v[i] = normalize(child)
+		}
+		return v
+	}
+	return value
+}
+
+func key(method, path string) string {
+	return strings.ToUpper(method) + " " + path
+}
@@ -0,0 +1,383 @@
+package openapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// Error codes returned in FieldError.Code. They match the codes of the
+// services' own validation where the meaning is the same.
+const (
+	CodeRequired      = "required"
+	CodeInvalidType   = "invalid_type"
+	CodeInvalidChoice = "invalid_choice"
+	CodeTooShort      = "too_short"
+	CodeTooLong       = "too_long"
+	CodeOutOfRange    = "out_of_range"
+	CodeInvalidFormat = "invalid_format"
+	CodeUnknownField  = "unknown_field"
+	CodeNoMatch       = "no_match"
+)
+
+// FieldError describes a parameter or body field that does not match the
+// document. It has the same shape as the services' validation errors.
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Errors is a list of field errors.
+type Errors []FieldError
+
+// Add appends a field error to the list.
+func (e *Errors) Add(field, code, message string) {
+	*e = append(*e, FieldError{Field: field, Code: code, Message: message})
+}
+
+// Error implements the error interface.
+func (e Errors) Error() string {
+	msgs := make([]string, len(e))
+	for i, fe := range e {
+		msgs[i] = fmt.Sprintf("%s: %s", fe.Field, fe.Message)
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// patterns caches compiled pattern keywords.
+var patterns sync.Map
+
+// validate checks value, as decoded by a json.Decoder using numbers,
+// against schema and adds an error for each mismatch. field names the value
+// in the errors, such as addresses[0].city.
+func (d *Document) validate(schema, value interface{}, field string, errs *Errors) {
+	switch s := schema.(type) {
+	case bool:
+		if !s {
+			errs.Add(field, CodeNoMatch, "is not allowed")
+		}
+		return
+	case map[string]interface{}:
+		d.validateObjectSchema(s, value, field, errs)
+	}
+}
+
+func (d *Document) validateObjectSchema(s map[string]interface{}, value interface{}, field string, errs *Errors) {
+	if ref, ok := s["$ref"].(string); ok {
+		target, err := d.pointer(ref)
+		if err != nil {
+			errs.Add(field, CodeNoMatch, err.Error())
+			return
+		}
+		before := len(*errs)
+		d.validate(target, value, field, errs)
+		if len(*errs) > before {
+			return
+		}
+	}
+
+	if types := schemaTypes(s["type"]); len(types) > 0 {
+		if !matchesType(types, value) {
+			errs.Add(field, CodeInvalidType, "must be "+describeTypes(types))
+			return
+		}
+	}
+	if c, ok := s["const"]; ok && !equal(c, value) {
+		errs.Add(field, CodeInvalidChoice, fmt.Sprintf("must be %v", c))
+	}
+	if enum, ok := s["enum"].([]interface{}); ok {
+		found := false
+		for _, e := range enum {
+			if equal(e, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			choices := make([]string, len(enum))
+			for i, e := range enum {
+				choices[i] = fmt.Sprint(e)
+			}
+			errs.Add(field, CodeInvalidChoice, "must be one of "+strings.Join(choices, ", "))
+		}
+	}
+
+	switch v := value.(type) {
+	case string:
+		validateString(s, v, field, errs)
+	case json.Number:
+		validateNumber(s, v, field, errs)
+	case []interface{}:
+		d.validateArray(s, v, field, errs)
+	case map[string]interface{}:
+		d.validateObject(s, v, field, errs)
+	}
+
+	if allOf, ok := s["allOf"].([]interface{}); ok {
+		for _, sub := range allOf {
+			d.validate(sub, value, field, errs)
+		}
+	}
+	if anyOf, ok := s["anyOf"].([]interface{}); ok && d.countMatches(anyOf, value, field) == 0 {
+		errs.Add(field, CodeNoMatch, "does not match any of the allowed schemas")
+	}
+	if oneOf, ok := s["oneOf"].([]interface{}); ok && d.countMatches(oneOf, value, field) != 1 {
+		errs.Add(field, CodeNoMatch, "must match exactly one of the allowed schemas")
+	}
+}
+
+// countMatches returns how many of schemas value matches.
+func (d *Document) countMatches(schemas []interface{}, value interface{}, field string) int {
+	matches := 0
+	for _, sub := range schemas {
+		var subErrs Errors
+		d.validate(sub, value, field, &subErrs)
+		if len(subErrs) == 0 {
+			matches++
+		}
+	}
+	return matches
+}
+
+func validateString(s map[string]interface{}, v, field string, errs *Errors) {
+	length := utf8.RuneCountInString(v)
+	if min, ok := number(s["minLength"]); ok && float64(length) < min {
+		// An empty string is reported like a missing one
+		if min == 1 {
+			errs.Add(field, CodeRequired, "is required")
+		} else {
+			errs.Add(field, CodeTooShort, fmt.Sprintf("must be at least %v characters", min))
+		}
+	}
+	if max, ok := number(s["maxLength"]); ok && float64(length) > max {
+		errs.Add(field, CodeTooLong, fmt.Sprintf("must be at most %v characters", max))
+	}
+	if pattern, ok := s["pattern"].(string); ok {
+		re, err := compile(pattern)
+		if err != nil || !re.MatchString(v) {
+			errs.Add(field, CodeInvalidFormat, "must match "+pattern)
+		}
+	}
+}
+
+func validateNumber(s map[string]interface{}, v json.Number, field string, errs *Errors) {
+	f, err := v.Float64()
+	if err != nil {
+		return
+	}
+	if min, ok := number(s["minimum"]); ok && f < min {
+		errs.Add(field, CodeOutOfRange, fmt.Sprintf("must be at least %v", min))
+	}
+	if max, ok := number(s["maximum"]); ok && f > max {
+		errs.Add(field, CodeOutOfRange, fmt.Sprintf("must be at most %v", max))
+	}
+	if min, ok := number(s["exclusiveMinimum"]); ok && f <= min {
+		errs.Add(field, CodeOutOfRange, fmt.Sprintf("must be greater than %v", min))
+	}
+	if max, ok := number(s["exclusiveMaximum"]); ok && f >= max {
+		errs.Add(field, CodeOutOfRange, fmt.Sprintf("must be less than %v", max))
+	}
+}
+
+func (d *Document) validateArray(s map[string]interface{}, v []interface{}, field string, errs *Errors) {
+	if min, ok := number(s["minItems"]); ok && float64(len(v)) < min {
+		errs.Add(field, CodeTooShort, fmt.Sprintf("must have at least %v items", min))
+	}
+	if max, ok := number(s["maxItems"]); ok && float64(len(v)) > max {
+		errs.Add(field, CodeTooLong, fmt.Sprintf("must have at most %v items", max))
+	}
+	if items, ok := s["items"]; ok {
+		for i, item := range v {
+			d.validate(items, item, fmt.Sprintf("%s[%d]", field, i), errs)
+		}
+	}
+}
+
+func (d *Document) validateObject(s map[string]interface{}, v map[string]interface{}, field string, errs *Errors) {
+	required, _ := s["required"].([]interface{})
+	for _, name := range required {
+		name, _ := name.(string)
+		if _, ok := v[name]; !ok {
+			errs.Add(child(field, name), CodeRequired, "is required")
+		}
+	}
+
+	properties, _ := s["properties"].(map[string]interface{})
+	additional, hasAdditional := s["additionalProperties"]
+	names := make([]string, 0, len(v))
+	for name := range v {
+		names = append(names, name)
+	}
+	// Sorted so the errors come out in a stable order
+	sort.Strings(names)
+	for _, name := range names {
+		if sub, ok := properties[name]; ok {
+			d.validate(sub, v[name], child(field, name), errs)
+			continue
+		}
+		if !hasAdditional {
+			continue
+		}
+		if allowed, ok := additional.(bool); ok && !allowed {
+			errs.Add(child(field, name), CodeUnknownField, "is not a known field")
+			continue
+		}
+		d.validate(additional, v[name], child(field, name), errs)
+	}
+}
+
+// schemaTypes returns the type keyword as a list; OpenAPI 3.1 writes
+// nullable types as ["string", "null"].
+func schemaTypes(value interface{}) []string {
+	switch t := value.(type) {
+	case string:
+		return []string{t}
+	case []interface{}:
+		types := make([]string, 0, len(t))
+		for _, item := range t {
+			if s, ok := item.(string); ok {
+				types = append(types, s)
+			}
+		}
+		return types
+	}
+	return nil
+}
+
+func matchesType(types []string, value interface{}) bool {
+	for _, t := range types {
+		switch v := value.(type) {
+		case nil:
+			if t == "null" {
+				return true
+			}
+		case bool:
+			if t == "boolean" {
+				return true
+			}
+		case string:
+			if t == "string" {
+				return true
+			}
+		case json.Number:
+			if t == "number" {
+				return true
+			}
+			if t == "integer" {
+				if f, err := v.Float64(); err == nil && f == math.Trunc(f) {
+					return true
+				}
+			}
+		case []interface{}:
+			if t == "array" {
+				return true
+			}
+		case map[string]interface{}:
+			if t == "object" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func describeTypes(types []string) string {
+	described := make([]string, len(types))
+	for i, t := range types {
+		switch t {
+		case "integer", "object", "array":
+			described[i] = "an " + t
+		case "null":
+			described[i] = "null"
+		default:
+			described[i] = "a " + t
+		}
+	}
+	return strings.Join(described, " or ")
+}
+
+// equal compares a value from the document with one decoded from JSON.
+func equal(a, b interface{}) bool {
+	if x, ok := number(a); ok {
+		y, ok := number(b)
+		return ok && x == y
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// number converts the numbers of either source to a float64.
+func number(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case float64:
+		return v, true
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func compile(pattern string) (*regexp.Regexp, error) {
+	if re, ok := patterns.Load(pattern); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	patterns.Store(pattern, re)
+	return re, nil
+}
+
+// coerce converts a parameter value to the JSON value its schema expects,
+// such as the number 5 for "5" when the schema is an integer. It returns
+// false when the value cannot be converted.
+func (d *Document) coerce(schema interface{}, raw string) (interface{}, bool) {
+	s, _ := d.resolve(schema).(map[string]interface{})
+	types := schemaTypes(s["type"])
+	if len(types) == 0 {
+		return raw, true
+	}
+	for _, t := range types {
+		switch t {
+		case "integer":
+			if _, err := strconv.ParseInt(raw, 10, 64); err == nil {
+				return json.Number(raw), true
+			}
+		case "number":
+			if _, err := strconv.ParseFloat(raw, 64); err == nil {
+				return json.Number(raw), true
+			}
+		case "boolean":
+			if b, err := strconv.ParseBool(raw); err == nil {
+				return b, true
+			}
+		case "string":
+			return raw, true
+		}
+	}
+	return nil, false
+}
+
+// child names a field of an object. Fields of the body are named without
+// a prefix, as in the services' validation errors.
+func child(field, name string) string {
+	if field == "" || field == "body" {
+		return name
+	}
+	return field + "." + name
+}
@@ -0,0 +1,57 @@
+// Package persian provides text normalization for Persian input so that
+// values typed on Arabic and Persian keyboards compare equal.
+package persian
+
+import (
+	"strings"
+	"unicode"
+
+	"back-forms/jalali"
+)
+
+const (
+	zwnj    = '\u200c'
+	tatweel = '\u0640'
+)
+
+var letterReplacer = strings.NewReplacer(
+	"ي", "ی", // Arabic yeh
+	"ى", "ی", // Arabic alef maksura
+	"ك", "ک", // Arabic kaf
+	"ة", "ه", // teh marbuta
+	"ۀ", "ه", // heh with yeh above
+	"أ", "ا",
+	"إ", "ا",
+	"ٱ", "ا",
+)
+
+// Normalize prepares s for comparison and indexing. It maps Arabic letter
+// variants to their Persian forms, removes ZWNJ, diacritics and tatweel,
+// converts digits to Latin, lower-cases Latin letters and collapses
+// whitespace.
+func Normalize(s string) string {
+	s = letterReplacer.Replace(jalali.NormalizeDigits(s))
+
+	var b strings.Builder
+	b.Grow(len(s))
+	for _, r := range s {
+		switch {
+		case r == zwnj, r == tatweel, unicode.Is(unicode.Mn, r):
+			continue
+		default:
+			b.WriteRune(unicode.ToLower(r))
+		}
+	}
+	return strings.Join(strings.Fields(b.String()), " ")
+}
+
+// Digits returns only the digits of s, converted to Latin.
+func Digits(s string) string {
+	var b strings.Builder
+	for _, r := range jalali.NormalizeDigits(s) {
+		if r >= '0' && r <= '9' {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,140 @@
+// Package phone parses phone numbers typed in any of the usual Iranian
+// forms (0912..., +98912..., 0098912..., Persian digits) into E.164.
+package phone
+
+import (
+	"errors"
+	"strings"
+
+	"back-forms/jalali"
+)
+
+// ErrInvalid is returned for input that is not a valid phone number.
+var ErrInvalid = errors.New("phone: invalid number")
+
+// Number types.
+const (
+	TypeMobile        = "mobile"
+	TypeLandline      = "landline"
+	TypeInternational = "international"
+)
+
+// CountryCode is the Iranian calling code.
+const CountryCode = "98"
+
+// areaCodes are the Iranian landline area codes without the trunk prefix.
+var areaCodes = map[string]bool{
+	"11": true, "13": true, "17": true, "21": true, "23": true, "24": true,
+	"25": true, "26": true, "28": true, "31": true, "34": true, "35": true,
+	"38": true, "41": true, "44": true, "45": true, "51": true, "54": true,
+	"56": true, "58": true, "61": true, "66": true, "71": true, "74": true,
+	"76": true, "77": true, "81": true, "83": true, "84": true, "86": true,
+	"87": true,
+}
+
+var separators = strings.NewReplacer(" ", "", "-", "", "(", "", ")", "", ".", "", "\u200c", "")
+
+// Number is a parsed phone number.
+type Number struct {
+	// E164 is the canonical form, such as +989121234567.
+	E164 string
+	Type string
+}
+
+// Parse converts s to E.164. Iranian numbers may be written with a 0 trunk
+// prefix, with +98 or 0098, or as a bare mobile number such as 9121234567,
+// and must use a known mobile or landline prefix. Other countries are
+// accepted when written with + or 00 and 8 to 15 digits.
+func Parse(s string) (Number, error) {
+	s = separators.Replace(jalali.NormalizeDigits(strings.TrimSpace(s)))
+	if s == "" {
+		return Number{}, ErrInvalid
+	}
+
+	international := false
+	switch {
+	case strings.HasPrefix(s, "+"):
+		s, international = s[1:], true
+	case strings.HasPrefix(s, "00"):
+		s, international = s[2:], true
+	}
+	if !digitsOnly(s) {
+		return Number{}, ErrInvalid
+	}
+
+	var national string
+	switch {
+	case international && !strings.HasPrefix(s, CountryCode):
+		if len(s) < 8 || len(s) > 15 || s[0] == '0' {
+			return Number{}, ErrInvalid
+		}
+		return Number{E164: "+" + s, Type: TypeInternational}, nil
+	case international:
+		national = s[len(CountryCode):]
+	case len(s) == 11 && s[0] == '0':
+		national = s[1:]
+	case len(s) == 12 && strings.HasPrefix(s, CountryCode):
+		national = s[len(CountryCode):]
+	default:
+		national = s
+	}
+
+	// Some people keep the trunk prefix after the country code
+	if len(national) == 11 && national[0] == '0' {
+		national = national[1:]
+	}
+	if len(national) != 10 {
+		return Number{}, ErrInvalid
+	}
+
+	switch {
+	case national[0] == '9':
+		if !strings.ContainsRune("01239", rune(national[1])) {
+			return Number{}, ErrInvalid
+		}
+		return Number{E164: "+" + CountryCode + national, Type: TypeMobile}, nil
+	case areaCodes[national[:2]] && national[2] != '0' && national[2] != '1':
+		return Number{E164: "+" + CountryCode + national, Type: TypeLandline}, nil
+	default:
+		return Number{}, ErrInvalid
+	}
+}
+
+// Normalize returns the E.164 form of s, or s unchanged when it cannot be
+// parsed.
+func Normalize(s string) string {
+	if n, err := Parse(s); err == nil {
+		return n.E164
+	}
+	return s
+}
+
+// NormalizePrefix rewrites a partial number typed in a search box so that it
+// can be matched against stored E.164 numbers with a prefix search.
+func NormalizePrefix(s string) string {
+	s = separators.Replace(jalali.NormalizeDigits(strings.TrimSpace(s)))
+	switch {
+	case s == "" || strings.HasPrefix(s, "+"):
+		return s
+	case strings.HasPrefix(s, "00"):
+		return "+" + s[2:]
+	case strings.HasPrefix(s, "0"):
+		return "+" + CountryCode + s[1:]
+	case strings.HasPrefix(s, CountryCode):
+		return "+" + s
+	default:
+		return "+" + CountryCode + s
+	}
+}
+
+func digitsOnly(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
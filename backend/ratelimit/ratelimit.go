@@ -0,0 +1,259 @@
+// Package ratelimit throttles clients with token buckets. Each client gets
+// a bucket per rule holding up to Burst tokens that refill at a steady
+// rate; a request takes one token and is rejected with 429 when the bucket
+// is empty. Buckets live in a Store, in memory by default or in Postgres so
+// that limits hold across replicas.
+package ratelimit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"back-forms/auth"
+)
+
+// Limit is the rate a rule allows: Requests per Per on average, with bursts
+// of up to Burst requests.
+type Limit struct {
+	Requests int
+	Per      time.Duration
+	Burst    int
+}
+
+// rate returns how many tokens are added per second.
+func (l Limit) rate() float64 {
+	return float64(l.Requests) / l.Per.Seconds()
+}
+
+// String formats the limit the way ParseLimit reads it.
+func (l Limit) String() string {
+	unit := map[time.Duration]string{time.Second: "s", time.Minute: "m", time.Hour: "h"}[l.Per]
+	s := fmt.Sprintf("%d/%s", l.Requests, unit)
+	if l.Burst != l.Requests {
+		s += ":" + strconv.Itoa(l.Burst)
+	}
+	return s
+}
+
+// ParseLimit reads a limit written as requests/unit with an optional burst,
+// for example "30/m" or "5/s:20". Units are s, m and h; the burst defaults
+// to the number of requests.
+func ParseLimit(s string) (Limit, error) {
+	s = strings.TrimSpace(s)
+	spec, burst, hasBurst := strings.Cut(s, ":")
+	count, unit, ok := strings.Cut(spec, "/")
+	if !ok {
+		return Limit{}, fmt.Errorf("ratelimit: invalid limit %q, want requests/unit", s)
+	}
+
+	var limit Limit
+	var err error
+	if limit.Requests, err = strconv.Atoi(count); err != nil || limit.Requests <= 0 {
+		return Limit{}, fmt.Errorf("ratelimit: invalid request count in %q", s)
+	}
+	switch unit {
+	case "s":
+		limit.Per = time.Second
+	case "m":
+		limit.Per = time.Minute
+	case "h":
+		limit.Per = time.Hour
+	default:
+		return Limit{}, fmt.Errorf("ratelimit: invalid unit in %q, want s, m or h", s)
+	}
+	limit.Burst = limit.Requests
+	if hasBurst {
+		if limit.Burst, err = strconv.Atoi(burst); err != nil || limit.Burst <= 0 {
+			return Limit{}, fmt.Errorf("ratelimit: invalid burst in %q", s)
+		}
+	}
+	return limit, nil
+}
+
+// ParseRules reads comma separated name=limit pairs, such as
+// "users.create=30/m,auth.login=10/m:5". A limit of "off" disables the rule.
+func ParseRules(s string) (map[string]Limit, error) {
+	rules := map[string]Limit{}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, spec, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("ratelimit: invalid rule %q, want name=limit", part)
+		}
+		name = strings.TrimSpace(name)
+		if strings.TrimSpace(spec) == "off" {
+			rules[name] = Limit{}
+			continue
+		}
+		limit, err := ParseLimit(spec)
+		if err != nil {
+			return nil, err
+		}
+		rules[name] = limit
+	}
+	return rules, nil
+}
+
+// Result is the outcome of taking a token.
+type Result struct {
+	Allowed   bool
+	Remaining int
+	// RetryAfter is how long until a token is available when the request
+	// was rejected.
+	RetryAfter time.Duration
+	// Reset is how long until the bucket is full again.
+	Reset time.Duration
+}
+
+// Store keeps the buckets of every client.
+type Store interface {
+	// Take takes a token from the bucket stored under key.
+	Take(ctx context.Context, key string, limit Limit, now time.Time) (Result, error)
+}
+
+// bucket is the state of one client's bucket.
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// take refills b for the time elapsed since it was last updated and takes a
+// token if one is available. A zero bucket starts full.
+func (b *bucket) take(limit Limit, now time.Time) Result {
+	rate := limit.rate()
+	burst := float64(limit.Burst)
+	if b.updated.IsZero() {
+		b.tokens = burst
+	} else if elapsed := now.Sub(b.updated).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(burst, b.tokens+elapsed*rate)
+	}
+	b.updated = now
+
+	result := Result{}
+	if b.tokens >= 1 {
+		b.tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = seconds((1 - b.tokens) / rate)
+	}
+	result.Remaining = int(b.tokens)
+	result.Reset = seconds((burst - b.tokens) / rate)
+	return result
+}
+
+// fullAt returns when b will be full again, after which it can be dropped
+// since a new bucket starts full.
+func (b *bucket) fullAt(limit Limit) time.Time {
+	return b.updated.Add(seconds((float64(limit.Burst) - b.tokens) / limit.rate()))
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(math.Ceil(s * float64(time.Second)))
+}
+
+// Limiter applies the configured rules to routes.
+type Limiter struct {
+	store Store
+	rules map[string]Limit
+	// TrustProxy makes ClientKey use the first address of X-Forwarded-For,
+	// which is only safe behind a proxy that sets it.
+	TrustProxy bool
+}
+
+// New returns a Limiter applying rules with buckets kept in store.
+func New(store Store, rules map[string]Limit) *Limiter {
+	return &Limiter{store: store, rules: rules}
+}
+
+// Rules returns the configured rules as name=limit pairs, sorted by name.
+func (l *Limiter) Rules() []string {
+	var rules []string
+	for name, limit := range l.rules {
+		if limit.Requests > 0 {
+			rules = append(rules, name+"="+limit.String())
+		}
+	}
+	sort.Strings(rules)
+	return rules
+}
+
+// Wrap limits h with the rule called name. Routes without a rule, or with
+// a disabled one, are not limited.
+func (l *Limiter) Wrap(name string, h http.Handler) http.Handler {
+	limit, ok := l.rules[name]
+	if !ok || limit.Requests <= 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		result, err := l.store.Take(r.Context(), name+"|"+l.ClientKey(r), limit, time.Now())
+		if err != nil {
+			// A broken store must not take the service down with it
+			log.Printf("ratelimit: %s: %v", name, err)
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		header := w.Header()
+		header.Set("RateLimit-Limit", strconv.Itoa(limit.Burst))
+		header.Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		header.Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil(result.Reset.Seconds()))))
+		header.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d;burst=%d", limit.Requests, int(limit.Per.Seconds()), limit.Burst))
+		if !result.Allowed {
+			writeTooManyRequests(w, result.RetryAfter)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// ClientKey identifies the caller a bucket belongs to: the API key or
+// operator behind the request when it is authenticated, otherwise the
+// client's IP address.
+func (l *Limiter) ClientKey(r *http.Request) string {
+	if claims, ok := auth.ClaimsFrom(r.Context()); ok {
+		if claims.APIKeyID != 0 {
+			return "key:" + strconv.FormatUint(uint64(claims.APIKeyID), 10)
+		}
+		if id := claims.OperatorID(); id != 0 {
+			return "operator:" + strconv.FormatUint(uint64(id), 10)
+		}
+	}
+	return "ip:" + l.ClientIP(r)
+}
+
+// ClientIP returns the address of the client that sent r.
+func (l *Limiter) ClientIP(r *http.Request) string {
+	if l.TrustProxy {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			first, _, _ := strings.Cut(forwarded, ",")
+			return strings.TrimSpace(first)
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func writeTooManyRequests(w http.ResponseWriter, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(auth.ErrorResponse{
+		Error:   "rate_limited",
+		Message: "Too many requests, please retry later",
+	})
+}
@@ -0,0 +1,129 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// sweepInterval is how often stores drop buckets that have refilled.
+const sweepInterval = time.Minute
+
+// MemoryStore keeps buckets in process memory. Limits are per replica.
+type MemoryStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*memoryBucket
+	lastSweep time.Time
+}
+
+type memoryBucket struct {
+	bucket
+	full time.Time
+}
+
+// NewMemoryStore returns an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{buckets: map[string]*memoryBucket{}}
+}
+
+// Take implements Store.
+func (s *MemoryStore) Take(_ context.Context, key string, limit Limit, now time.Time) (Result, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now.Sub(s.lastSweep) >= sweepInterval {
+		for k, b := range s.buckets {
+			if !now.Before(b.full) {
+				delete(s.buckets, k)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &memoryBucket{}
+		s.buckets[key] = b
+	}
+	result := b.take(limit, now)
+	b.full = b.fullAt(limit)
+	return result, nil
+}
+
+// bucketRow is a bucket stored by PostgresStore.
+type bucketRow struct {
+	Key       string    `gorm:"primaryKey"`
+	Tokens    float64   `gorm:"not null"`
+	UpdatedAt time.Time `gorm:"not null"`
+	FullAt    time.Time `gorm:"not null;index"`
+}
+
+// TableName keeps the bucket table name descriptive.
+func (bucketRow) TableName() string {
+	return "rate_limit_buckets"
+}
+
+// PostgresStore keeps buckets in a table shared by every replica. Each take
+// locks the client's row for the length of a short transaction.
+// On SQLite, which has no row locks, the transaction holds the database
+// write lock instead.
+type PostgresStore struct {
+	db        *gorm.DB
+	mu        sync.Mutex
+	lastSweep time.Time
+}
+
+// NewPostgresStore returns a store using the rate_limit_buckets table,
+// which the migrations create.
+func NewPostgresStore(db *gorm.DB) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+// Take implements Store.
+func (s *PostgresStore) Take(ctx context.Context, key string, limit Limit, now time.Time) (Result, error) {
+	db := s.db.WithContext(ctx)
+	if err := s.sweep(db, now); err != nil {
+		return Result{}, err
+	}
+
+	var result Result
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// Create the row first so that concurrent first requests lock the
+		// same row instead of racing to insert it
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).
+			Create(&bucketRow{Key: key, Tokens: float64(limit.Burst), UpdatedAt: now, FullAt: now}).Error; err != nil {
+			return err
+		}
+		var row bucketRow
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("key = ?", key).First(&row).Error; err != nil {
+			return err
+		}
+
+		b := bucket{tokens: row.Tokens, updated: row.UpdatedAt}
+		result = b.take(limit, now)
+		return tx.Model(&row).Updates(map[string]interface{}{
+			"tokens":     b.tokens,
+			"updated_at": b.updated,
+			"full_at":    b.fullAt(limit),
+		}).Error
+	})
+	return result, err
+}
+
+// sweep deletes the rows of buckets that have refilled, at most once per
+// sweepInterval per replica.
+func (s *PostgresStore) sweep(db *gorm.DB, now time.Time) error {
+	s.mu.Lock()
+	due := now.Sub(s.lastSweep) >= sweepInterval
+	if due {
+		s.lastSweep = now
+	}
+	s.mu.Unlock()
+	if !due {
+		return nil
+	}
+	return db.Where("full_at <= ?", now).Delete(&bucketRow{}).Error
+}
@@ -5,16 +5,15 @@ import (
 	"fmt"
 	"net/http"
 
-	"gorm.io/gorm"
-
 	"back-forms/report-service/models"
+	"back-forms/report-service/repository"
 )
 
-func GenerateReport(db *gorm.DB) http.HandlerFunc {
+func GenerateReport(repo repository.StatsRepository) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		fmt.Println("Generating report...")
 
-		stats, err := models.GetAllStats(db)
+		stats, err := models.GetAllStats(r.Context(), repo)
 		fmt.Printf("Generated stats: %+v\n", stats)
 
 		if err != nil {
@@ -24,7 +23,6 @@ func GenerateReport(db *gorm.DB) http.HandlerFunc {
 		}
 
 		w.Header().Set("Content-Type", "application/json")
-		w.Header().Set("Access-Control-Allow-Origin", "*")
 
 		err = json.NewEncoder(w).Encode(stats)
 		if err != nil {
@@ -1,35 +1,118 @@
 package main
 
 import (
+	"context"
+	_ "embed"
+	"errors"
 	"log"
 	"net/http"
+	"os"
+	"strings"
 
 	"github.com/gorilla/mux"
 	"github.com/rs/cors"
-	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 
+	"back-forms/auth"
+	"back-forms/config"
+	"back-forms/database"
+	"back-forms/migrations"
+	"back-forms/openapi"
 	"back-forms/report-service/controllers"
+	"back-forms/report-service/repository"
+	"back-forms/server"
 )
 
+// openAPIDocument describes every route of the service. It is served at
+// /openapi.json and, when enabled, checked against the traffic.
+//
+//go:embed openapi.yaml
+var openAPIDocument []byte
+
 func main() {
-	dsn := "user=myuser password=mypassword dbname=formsdb port=5432 sslmode=disable TimeZone=Asia/Tehran"
-	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	defaults := config.Default()
+	defaults.Server.Addr = ":8082"
+	loader := config.NewLoader(defaults, os.Args[1:])
+	cfg, err := loader.Load()
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	log.Printf("Configuration:\n%s", cfg)
+
+	authn, err := auth.New(cfg.Auth.Secret)
+	if err != nil {
+		log.Fatalf("Invalid auth.secret: %v", err)
+	}
+
+	level := config.NewLevelVar(cfg.Log.Level)
+	origins := config.NewOrigins(cfg.CORS.AllowedOrigins)
+
+	db, err := database.Open(cfg.Database, level)
 	if err != nil {
 		log.Fatalf("failed to connect database: %v", err)
 	}
 
+	// Ready once the database answers and the user service has applied
+	// every migration
+	migrator, err := migrations.New(db)
+	if err != nil {
+		log.Fatalf("Failed to load migrations: %v", err)
+	}
+	probes := server.NewProbes(db, server.Check{
+		Name: "migrations",
+		Run: func(ctx context.Context, _ *gorm.DB) error {
+			return migrator.Verify(ctx)
+		},
+	})
+
+	doc, err := openapi.Load(openAPIDocument)
+	if err != nil {
+		log.Fatalf("Invalid OpenAPI document: %v", err)
+	}
+
 	router := mux.NewRouter()
-	router.HandleFunc("/api/report", controllers.GenerateReport(db)).Methods("GET")
+	router.Use(doc.Middleware(openapi.Options{
+		Requests:  cfg.OpenAPI.ValidateRequests,
+		Responses: cfg.OpenAPI.ValidateResponses,
+	}))
+	router.Handle("/openapi.json", doc).Methods("GET")
+	probes.Register(router)
+
+	// Access tokens are issued by the user service and verified here with
+	// the shared secret; API keys are looked up in the shared database
+	api := router.PathPrefix("/api").Subrouter()
+	api.Use(auth.Middleware(authn, db))
+	api.Handle("/report", auth.Require(auth.PermReportsRead)(controllers.GenerateReport(repository.NewSQL(db)))).Methods("GET")
+
+	if missing := doc.Undocumented(router); len(missing) > 0 {
+		log.Printf("Routes missing from the OpenAPI document: %s", strings.Join(missing, ", "))
+	}
 
 	// Enable CORS
 	corsHandler := cors.New(cors.Options{
-		AllowedOrigins:   []string{"http://localhost:3000"},
+		AllowOriginFunc:  origins.Allowed,
 		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE"},
-		AllowedHeaders:   []string{"Content-Type", "Authorization"},
+		AllowedHeaders:   []string{"Content-Type", "Authorization", "X-API-Key"},
 		AllowCredentials: true,
 	}).Handler(router)
 
-	log.Println("Report Service started at :8082")
-	log.Fatal(http.ListenAndServe(":8082", corsHandler))
+	// Other settings need a restart to change
+	loader.Watch(func(next config.Config) {
+		origins.Set(next.CORS.AllowedOrigins)
+		level.Set(next.Log.Level)
+		log.Printf("Reloaded configuration: cors.allowed_origins=%v log.level=%s", next.CORS.AllowedOrigins, next.Log.Level)
+	})
+
+	srv := &http.Server{
+		Addr:         cfg.Server.Addr,
+		Handler:      corsHandler,
+		ReadTimeout:  cfg.Server.ReadTimeout,
+		WriteTimeout: cfg.Server.WriteTimeout,
+		IdleTimeout:  cfg.Server.IdleTimeout,
+	}
+
+	log.Printf("Report Service started at %s", srv.Addr)
+	if err := server.Run(srv, probes, db, cfg.Server.PreStopDelay, cfg.Server.ShutdownTimeout); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Fatalf("Server failed: %v", err)
+	}
 }
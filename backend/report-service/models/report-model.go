@@ -1,11 +1,12 @@
 package models
 
 import (
+	"context"
 	"fmt"
 	"sort"
-	"strings"
 
-	"gorm.io/gorm"
+	"back-forms/jalali"
+	"back-forms/report-service/repository"
 )
 
 type GenderStats struct {
@@ -23,19 +24,8 @@ func calculatePercentage(count, total int) float64 {
 	return float64(count) / float64(total) * 100
 }
 
-func GetTotalGenderStats(db *gorm.DB) (GenderStats, error) {
-	var result struct {
-		MaleCount   int
-		FemaleCount int
-	}
-
-	query := `
-        SELECT 
-            COUNT(CASE WHEN gender = 'Male' THEN 1 END) AS male_count,
-            COUNT(CASE WHEN gender = 'Female' THEN 1 END) AS female_count
-        FROM users
-    `
-	err := db.Raw(query).Scan(&result).Error
+func GetTotalGenderStats(ctx context.Context, repo repository.StatsRepository) (GenderStats, error) {
+	result, err := repo.GenderTotals(ctx)
 	if err != nil {
 		return GenderStats{}, err
 	}
@@ -49,17 +39,8 @@ func GetTotalGenderStats(db *gorm.DB) (GenderStats, error) {
 	}, nil
 }
 
-type UserForStats struct {
-	PersianDate string
-	Gender      string
-}
-
-func GetDailyStats(db *gorm.DB) ([]GenderStats, error) {
-	var users []UserForStats
-
-	err := db.Table("users").
-		Select("persian_date, gender").
-		Find(&users).Error
+func GetDailyStats(ctx context.Context, repo repository.StatsRepository) ([]GenderStats, error) {
+	users, err := repo.UserDates(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -67,7 +48,7 @@ func GetDailyStats(db *gorm.DB) ([]GenderStats, error) {
 	dailyStats := make(map[string]GenderStats)
 
 	for _, user := range users {
-		englishDate := convertPersianToEnglish(user.PersianDate)
+		englishDate := user.PersianDate.Compact()
 
 		stats := dailyStats[englishDate]
 		if user.Gender == "Male" {
@@ -94,29 +75,8 @@ func GetDailyStats(db *gorm.DB) ([]GenderStats, error) {
 	return result, nil
 }
 
-func convertPersianToEnglish(persianStr string) string {
-	persianNums := map[rune]rune{
-		'۰': '0', '۱': '1', '۲': '2', '۳': '3', '۴': '4',
-		'۵': '5', '۶': '6', '۷': '7', '۸': '8', '۹': '9',
-	}
-
-	var result strings.Builder
-	for _, r := range persianStr {
-		if en, ok := persianNums[r]; ok {
-			result.WriteRune(en)
-		} else {
-			result.WriteRune(r)
-		}
-	}
-	return result.String()
-}
-
-func GetWeeklyStats(db *gorm.DB) ([]GenderStats, error) {
-	var users []UserForStats
-
-	err := db.Table("users").
-		Select("persian_date, gender").
-		Find(&users).Error
+func GetWeeklyStats(ctx context.Context, repo repository.StatsRepository) ([]GenderStats, error) {
+	users, err := repo.UserDates(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -124,11 +84,8 @@ func GetWeeklyStats(db *gorm.DB) ([]GenderStats, error) {
 	weeklyStats := make(map[string]GenderStats)
 
 	for _, user := range users {
-		englishDate := convertPersianToEnglish(user.PersianDate)
-		// Extract day from YYYYMMDD format
-		day := englishDate[6:8]
 		// Calculate week number (1-based)
-		weekNum := (atoi(day)-1)/7 + 1
+		weekNum := (user.PersianDate.Day-1)/7 + 1
 		weekKey := fmt.Sprintf("Week %d", weekNum)
 
 		stats := weeklyStats[weekKey]
@@ -166,42 +123,16 @@ func persianStringToInt(s string) (int, error) {
 	return n, nil
 }
 
-func GetMonthlyStats(db *gorm.DB) ([]GenderStats, error) {
+func GetMonthlyStats(ctx context.Context, repo repository.StatsRepository) ([]GenderStats, error) {
 	// First, get the current Persian year
-	var currentYear string
-	yearQuery := `
-        SELECT DISTINCT SUBSTRING(persian_date, 1, 4) as year 
-        FROM users 
-        ORDER BY year DESC 
-        LIMIT 1
-    `
-	err := db.Raw(yearQuery).Scan(&currentYear).Error
+	currentYear, err := repo.LatestYear(ctx)
 	if err != nil {
 		return nil, err
 	}
 
 	fmt.Printf("Current Persian Year: %s\n", currentYear)
 
-	// Modified query to handle Persian numbers
-	var monthlyResults []struct {
-		Month       string
-		MaleCount   int
-		FemaleCount int
-	}
-
-	statsQuery := `
-        SELECT 
-            SUBSTRING(persian_date, 5, 2) as month,
-            COUNT(CASE WHEN gender = 'Male' THEN 1 END) as male_count,
-            COUNT(CASE WHEN gender = 'Female' THEN 1 END) as female_count
-        FROM users
-        WHERE persian_date LIKE ?
-        GROUP BY SUBSTRING(persian_date, 5, 2)
-        ORDER BY month
-    `
-
-	// Use LIKE with wildcard to match the year
-	err = db.Raw(statsQuery, currentYear+"%").Scan(&monthlyResults).Error
+	monthlyResults, err := repo.MonthlyTotals(ctx, currentYear)
 	if err != nil {
 		return nil, err
 	}
@@ -216,7 +147,7 @@ func GetMonthlyStats(db *gorm.DB) ([]GenderStats, error) {
 
 	for _, result := range monthlyResults {
 		// Convert Persian month numbers to English if needed
-		month := convertPersianToEnglish(result.Month)
+		month := jalali.NormalizeDigits(result.Month)
 		monthStats[month] = struct {
 			Male   int
 			Female int
@@ -256,31 +187,23 @@ func GetMonthlyStats(db *gorm.DB) ([]GenderStats, error) {
 	return result, nil
 }
 
-func atoi(s string) int {
-	n := 0
-	for _, c := range s {
-		n = n*10 + int(c-'0')
-	}
-	return n
-}
-
-func GetAllStats(db *gorm.DB) (map[string]interface{}, error) {
-	totalStats, err := GetTotalGenderStats(db)
+func GetAllStats(ctx context.Context, repo repository.StatsRepository) (map[string]interface{}, error) {
+	totalStats, err := GetTotalGenderStats(ctx, repo)
 	if err != nil {
 		return nil, err
 	}
 
-	dailyStats, err := GetDailyStats(db)
+	dailyStats, err := GetDailyStats(ctx, repo)
 	if err != nil {
 		return nil, err
 	}
 
-	weeklyStats, err := GetWeeklyStats(db)
+	weeklyStats, err := GetWeeklyStats(ctx, repo)
 	if err != nil {
 		return nil, err
 	}
 
-	monthlyStats, err := GetMonthlyStats(db)
+	monthlyStats, err := GetMonthlyStats(ctx, repo)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,79 @@
+package models
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"back-forms/jalali"
+	"back-forms/report-service/repository"
+)
+
+func TestGetAllStats(t *testing.T) {
+	repo := repository.NewMemory([]repository.UserDate{
+		{PersianDate: jalali.Date{Year: 1370, Month: 5, Day: 12}, Gender: "Female"},
+		{PersianDate: jalali.Date{Year: 1370, Month: 5, Day: 12}, Gender: "Male"},
+		{PersianDate: jalali.Date{Year: 1370, Month: 11, Day: 3}, Gender: "Male"},
+		{PersianDate: jalali.Date{Year: 1365, Month: 1, Day: 20}, Gender: "Female"},
+	})
+
+	stats, err := GetAllStats(context.Background(), repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantTotal := GenderStats{MaleCount: 2, FemaleCount: 2, MalePercentage: 50, FemalePercentage: 50}
+	if got := stats["total"]; !reflect.DeepEqual(got, wantTotal) {
+		t.Errorf("total = %+v, want %+v", got, wantTotal)
+	}
+
+	wantDaily := []GenderStats{
+		{Date: "13650120", FemaleCount: 1, FemalePercentage: 100},
+		{Date: "13700512", MaleCount: 1, FemaleCount: 1, MalePercentage: 50, FemalePercentage: 50},
+		{Date: "13701103", MaleCount: 1, MalePercentage: 100},
+	}
+	if got := stats["daily"]; !reflect.DeepEqual(got, wantDaily) {
+		t.Errorf("daily = %+v, want %+v", got, wantDaily)
+	}
+
+	wantWeekly := []GenderStats{
+		{Date: "Week 1", MaleCount: 1, MalePercentage: 100},
+		{Date: "Week 2", MaleCount: 1, FemaleCount: 1, MalePercentage: 50, FemalePercentage: 50},
+		{Date: "Week 3", FemaleCount: 1, FemalePercentage: 100},
+	}
+	if got := stats["weekly"]; !reflect.DeepEqual(got, wantWeekly) {
+		t.Errorf("weekly = %+v, want %+v", got, wantWeekly)
+	}
+
+	// Only the latest year is broken down by month, and every month is
+	// listed
+	monthly, _ := stats["monthly"].([]GenderStats)
+	if len(monthly) != 12 {
+		t.Fatalf("monthly has %d entries, want 12", len(monthly))
+	}
+	for _, month := range monthly {
+		want := GenderStats{Date: month.Date}
+		switch month.Date {
+		case "05":
+			want = GenderStats{Date: "05", MaleCount: 1, FemaleCount: 1, MalePercentage: 50, FemalePercentage: 50}
+		case "11":
+			want = GenderStats{Date: "11", MaleCount: 1, MalePercentage: 100}
+		}
+		if month != want {
+			t.Errorf("month %s = %+v, want %+v", month.Date, month, want)
+		}
+	}
+}
+
+func TestGetAllStatsWithoutUsers(t *testing.T) {
+	stats, err := GetAllStats(context.Background(), repository.NewMemory(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := stats["total"]; got != (GenderStats{}) {
+		t.Errorf("total = %+v, want zeros", got)
+	}
+	if monthly, _ := stats["monthly"].([]GenderStats); len(monthly) != 12 {
+		t.Errorf("monthly has %d entries, want 12", len(monthly))
+	}
+}
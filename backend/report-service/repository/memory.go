@@ -0,0 +1,73 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"sort"
+)
+
+// Memory is a StatsRepository over a fixed set of live users.
+type Memory struct {
+	users []UserDate
+}
+
+// NewMemory returns a StatsRepository reporting on users.
+func NewMemory(users []UserDate) *Memory {
+	return &Memory{users: users}
+}
+
+// GenderTotals implements StatsRepository.
+func (m *Memory) GenderTotals(ctx context.Context) (GenderCounts, error) {
+	var counts GenderCounts
+	for _, user := range m.users {
+		counts.add(user.Gender)
+	}
+	return counts, nil
+}
+
+// UserDates implements StatsRepository.
+func (m *Memory) UserDates(ctx context.Context) ([]UserDate, error) {
+	return append([]UserDate{}, m.users...), nil
+}
+
+// LatestYear implements StatsRepository.
+func (m *Memory) LatestYear(ctx context.Context) (string, error) {
+	latest := 0
+	for _, user := range m.users {
+		latest = max(latest, user.PersianDate.Year)
+	}
+	if latest == 0 {
+		return "", nil
+	}
+	return fmt.Sprintf("%04d", latest), nil
+}
+
+// MonthlyTotals implements StatsRepository.
+func (m *Memory) MonthlyTotals(ctx context.Context, year string) ([]MonthCounts, error) {
+	byMonth := map[string]GenderCounts{}
+	for _, user := range m.users {
+		if fmt.Sprintf("%04d", user.PersianDate.Year) != year {
+			continue
+		}
+		month := fmt.Sprintf("%02d", user.PersianDate.Month)
+		counts := byMonth[month]
+		counts.add(user.Gender)
+		byMonth[month] = counts
+	}
+
+	result := make([]MonthCounts, 0, len(byMonth))
+	for month, counts := range byMonth {
+		result = append(result, MonthCounts{Month: month, GenderCounts: counts})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Month < result[j].Month })
+	return result, nil
+}
+
+func (c *GenderCounts) add(gender string) {
+	switch gender {
+	case "Male":
+		c.MaleCount++
+	case "Female":
+		c.FemaleCount++
+	}
+}
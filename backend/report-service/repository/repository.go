@@ -0,0 +1,45 @@
+// Package repository reads the user data that reports are built from. The
+// report models depend on StatsRepository instead of on a database: SQL
+// reads the shared database and Memory serves a fixed set of users, so
+// reports can be produced without a database.
+package repository
+
+import (
+	"context"
+
+	"back-forms/jalali"
+)
+
+// GenderCounts is a number of users by gender.
+type GenderCounts struct {
+	MaleCount   int
+	FemaleCount int
+}
+
+// UserDate is the birth date and gender of a user.
+type UserDate struct {
+	PersianDate jalali.Date
+	Gender      string
+}
+
+// MonthCounts is a number of users born in a month, which is given as
+// stored and may use Persian digits.
+type MonthCounts struct {
+	Month string
+	GenderCounts
+}
+
+// StatsRepository reads aggregates over the live users.
+type StatsRepository interface {
+	// GenderTotals counts the users by gender.
+	GenderTotals(ctx context.Context) (GenderCounts, error)
+	// UserDates returns the birth date and gender of every user. Users
+	// whose stored date is not a valid Jalali date are left out.
+	UserDates(ctx context.Context) ([]UserDate, error)
+	// LatestYear returns the newest birth year, or "" when there are no
+	// users.
+	LatestYear(ctx context.Context) (string, error)
+	// MonthlyTotals counts the users born in year by month, ordered by
+	// month. Months without users are left out.
+	MonthlyTotals(ctx context.Context, year string) ([]MonthCounts, error)
+}
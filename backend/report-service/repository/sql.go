@@ -0,0 +1,105 @@
+package repository
+
+import (
+	"context"
+	"log"
+
+	"gorm.io/gorm"
+
+	"back-forms/jalali"
+)
+
+// SQL is a StatsRepository reading the users table of the shared database.
+// The queries run on both Postgres and SQLite.
+type SQL struct {
+	db *gorm.DB
+}
+
+// NewSQL returns a StatsRepository using db.
+func NewSQL(db *gorm.DB) *SQL {
+	return &SQL{db: db}
+}
+
+// GenderTotals implements StatsRepository.
+func (p *SQL) GenderTotals(ctx context.Context) (GenderCounts, error) {
+	var result GenderCounts
+	query := `
+        SELECT 
+            COUNT(CASE WHEN gender = 'Male' THEN 1 END) AS male_count,
+            COUNT(CASE WHEN gender = 'Female' THEN 1 END) AS female_count
+        FROM users
+        WHERE deleted_at IS NULL
+    `
+	err := p.db.WithContext(ctx).Raw(query).Scan(&result).Error
+	return result, err
+}
+
+// UserDates implements StatsRepository. Dates are parsed here rather than
+// scanned, so that one bad row is skipped instead of failing the report.
+func (p *SQL) UserDates(ctx context.Context) ([]UserDate, error) {
+	var rows []struct {
+		PersianDate string
+		Gender      string
+	}
+	err := p.db.WithContext(ctx).Table("users").
+		Select("persian_date, gender").
+		Where("deleted_at IS NULL").
+		Find(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	users := make([]UserDate, 0, len(rows))
+	for _, row := range rows {
+		date, err := jalali.Parse(row.PersianDate)
+		if err != nil {
+			log.Printf("Skipping user with invalid persian_date %q: %v", row.PersianDate, err)
+			continue
+		}
+		users = append(users, UserDate{PersianDate: date, Gender: row.Gender})
+	}
+	return users, nil
+}
+
+// LatestYear implements StatsRepository.
+func (p *SQL) LatestYear(ctx context.Context) (string, error) {
+	var year string
+	query := `
+        SELECT DISTINCT SUBSTR(persian_date, 1, 4) as year 
+        FROM users 
+        WHERE deleted_at IS NULL
+        ORDER BY year DESC 
+        LIMIT 1
+    `
+	err := p.db.WithContext(ctx).Raw(query).Scan(&year).Error
+	return year, err
+}
+
+// MonthlyTotals implements StatsRepository.
+func (p *SQL) MonthlyTotals(ctx context.Context, year string) ([]MonthCounts, error) {
+	var months []struct {
+		Month       string
+		MaleCount   int
+		FemaleCount int
+	}
+	query := `
+        SELECT 
+            SUBSTR(persian_date, 5, 2) as month,
+            COUNT(CASE WHEN gender = 'Male' THEN 1 END) as male_count,
+            COUNT(CASE WHEN gender = 'Female' THEN 1 END) as female_count
+        FROM users
+        WHERE persian_date LIKE ? AND deleted_at IS NULL
+        GROUP BY SUBSTR(persian_date, 5, 2)
+        ORDER BY month
+    `
+	// Use LIKE with wildcard to match the year
+	if err := p.db.WithContext(ctx).Raw(query, year+"%").Scan(&months).Error; err != nil {
+		return nil, err
+	}
+
+	result := make([]MonthCounts, len(months))
+	for i, month := range months {
+		result[i] = MonthCounts{Month: month.Month, GenderCounts: GenderCounts{MaleCount: month.MaleCount, FemaleCount: month.FemaleCount}}
+	}
+	return result, nil
+}
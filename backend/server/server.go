@@ -0,0 +1,189 @@
+// Package server runs the HTTP servers of the services: it serves the
+// liveness and readiness probes and shuts down gracefully on SIGINT or
+// SIGTERM.
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+// checkTimeout bounds each readiness check.
+const checkTimeout = 2 * time.Second
+
+// Check is a readiness check. It returns an error while the service cannot
+// serve traffic.
+type Check struct {
+	Name string
+	Run  func(ctx context.Context, db *gorm.DB) error
+}
+
+// ReadyResponse is the body of the readiness probe.
+type ReadyResponse struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// Probes serves /healthz and /readyz.
+type Probes struct {
+	db       *gorm.DB
+	checks   []Check
+	draining atomic.Bool
+}
+
+// NewProbes returns probes for a service using db. The database is always
+// pinged; checks are run after it.
+func NewProbes(db *gorm.DB, checks ...Check) *Probes {
+	return &Probes{db: db, checks: checks}
+}
+
+// Register adds the probe routes to router. They need no authentication.
+func (p *Probes) Register(router *mux.Router) {
+	router.HandleFunc("/healthz", p.Healthz).Methods("GET", "HEAD")
+	router.HandleFunc("/readyz", p.Readyz).Methods("GET", "HEAD")
+}
+
+// Healthz reports that the process is alive. It does not depend on the
+// database so that an outage does not get the service restarted.
+func (p *Probes) Healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// Readyz reports whether the service can take traffic: it is not shutting
+// down, the database answers and the checks pass.
+func (p *Probes) Readyz(w http.ResponseWriter, r *http.Request) {
+	response := ReadyResponse{Status: "ready", Checks: map[string]string{}}
+	fail := func(name string, err error) {
+		response.Status = "unavailable"
+		response.Checks[name] = err.Error()
+	}
+
+	if p.draining.Load() {
+		fail("shutdown", errors.New("shutting down"))
+	}
+	if err := p.ping(r.Context()); err != nil {
+		fail("database", err)
+	} else {
+		response.Checks["database"] = "ok"
+		for _, check := range p.checks {
+			ctx, cancel := context.WithTimeout(r.Context(), checkTimeout)
+			err := check.Run(ctx, p.db)
+			cancel()
+			if err != nil {
+				fail(check.Name, err)
+			} else {
+				response.Checks[check.Name] = "ok"
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if response.Status != "ready" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+func (p *Probes) ping(ctx context.Context) error {
+	sqlDB, err := p.db.DB()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+	return sqlDB.PingContext(ctx)
+}
+
+// closeWait bounds how long Run waits for handlers still running after
+// the remaining connections were closed.
+const closeWait = 5 * time.Second
+
+// Run serves srv until the process receives SIGINT or SIGTERM. It then
+// reports not ready, keeps serving for preStop so that load balancers can
+// notice, stops accepting connections, waits up to drain for in-flight
+// requests to finish and closes the database pool.
+func Run(srv *http.Server, probes *Probes, db *gorm.DB, preStop, drain time.Duration) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Handlers are counted so that the pool is not closed under one that
+	// outlives its connection
+	var handlers sync.WaitGroup
+	next := srv.Handler
+	srv.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handlers.Add(1)
+		defer handlers.Done()
+		next.ServeHTTP(w, r)
+	})
+
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-served:
+		// The server never got going, for example because the port is taken
+		closeDB(db)
+		return err
+	case <-ctx.Done():
+	}
+	stop()
+
+	probes.draining.Store(true)
+	if preStop > 0 {
+		log.Printf("Shutting down, reporting not ready for %s...", preStop)
+		time.Sleep(preStop)
+	}
+
+	log.Printf("Draining requests for up to %s...", drain)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), drain)
+	defer cancel()
+	err := srv.Shutdown(shutdownCtx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		log.Printf("Drain period over, closing remaining connections")
+		err = srv.Close()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		handlers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		closeDB(db)
+	case <-time.After(closeWait):
+		// Exiting releases the connections anyway
+		log.Printf("Requests still running, leaving the database open")
+	}
+	if err == nil {
+		log.Println("Shutdown complete")
+	}
+	return err
+}
+
+func closeDB(db *gorm.DB) {
+	sqlDB, err := db.DB()
+	if err != nil {
+		return
+	}
+	if err := sqlDB.Close(); err != nil {
+		log.Printf("Closing database: %v", err)
+	}
+}
@@ -0,0 +1,178 @@
+// Package audit records an append-only history of every create, update and
+// delete on users and addresses. Entries are written by GORM callbacks in
+// the same transaction as the change, so no write path can skip them.
+package audit
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql/driver"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Actions recorded in Entry.Action.
+const (
+	ActionCreate  = "create"
+	ActionUpdate  = "update"
+	ActionDelete  = "delete"
+	ActionRestore = "restore"
+	ActionMerge   = "merge"
+)
+
+// Entity types recorded in Entry.EntityType.
+const (
+	EntityUser    = "user"
+	EntityAddress = "address"
+)
+
+// SystemActor is recorded for writes made outside of an HTTP request.
+const SystemActor = "system"
+
+// Change holds the value of a single column before and after a write.
+type Change struct {
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// Changes maps column names to their before/after values.
+type Changes map[string]Change
+
+// Value implements driver.Valuer.
+func (c Changes) Value() (driver.Value, error) {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+// Scan implements sql.Scanner.
+func (c *Changes) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		*c = nil
+		return nil
+	case string:
+		return json.Unmarshal([]byte(v), c)
+	case []byte:
+		return json.Unmarshal(v, c)
+	default:
+		return fmt.Errorf("audit: cannot scan %T into Changes", value)
+	}
+}
+
+// Entry is a single audited write.
+type Entry struct {
+	ID         uint      `json:"id" gorm:"primaryKey"`
+	EntityType string    `json:"entity_type" gorm:"not null;index:idx_audit_entity"`
+	EntityID   uint      `json:"entity_id" gorm:"not null;index:idx_audit_entity"`
+	UserID     uint      `json:"user_id" gorm:"not null;index"`
+	Action     string    `json:"action" gorm:"not null"`
+	Actor      string    `json:"actor" gorm:"not null"`
+	RequestID  string    `json:"request_id" gorm:"not null;default:''"`
+	Changes    Changes   `json:"changes" gorm:"type:jsonb;not null"`
+	CreatedAt  time.Time `json:"created_at" gorm:"not null"`
+}
+
+// TableName keeps the audit table name stable.
+func (Entry) TableName() string {
+	return "audit_entries"
+}
+
+type contextKey int
+
+const (
+	actorKey contextKey = iota
+	requestIDKey
+)
+
+// WithActor returns a context that attributes writes to actor.
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey, actor)
+}
+
+// WithRequestID returns a context that tags writes with requestID.
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDKey, requestID)
+}
+
+// ActorFrom returns the actor stored in ctx, or SystemActor.
+func ActorFrom(ctx context.Context) string {
+	if actor, ok := ctx.Value(actorKey).(string); ok && actor != "" {
+		return actor
+	}
+	return SystemActor
+}
+
+// RequestIDFrom returns the request ID stored in ctx, if any.
+func RequestIDFrom(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDKey).(string)
+	return requestID
+}
+
+// Middleware assigns every request an ID, taken from X-Request-ID when the
+// client sends one, and stores it in the request context. The actor is set
+// once the caller has been authenticated.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get("X-Request-ID")
+		if requestID == "" {
+			requestID = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", requestID)
+
+		next.ServeHTTP(w, r.WithContext(WithRequestID(r.Context(), requestID)))
+	})
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Setup registers the callbacks that record writes on db. The audit table
+// and the trigger keeping it append-only are created by the migrations.
+func Setup(db *gorm.DB) error {
+	return registerCallbacks(db)
+}
+
+// Record appends entries that describe an operation rather than a single
+// row change, such as a merge. Actor, request ID and time are taken from the
+// context of db.
+func Record(db *gorm.DB, entries ...Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	ctx := db.Statement.Context
+	now := time.Now()
+	for i := range entries {
+		entries[i].Actor = ActorFrom(ctx)
+		entries[i].RequestID = RequestIDFrom(ctx)
+		entries[i].CreatedAt = now
+	}
+	return db.Session(&gorm.Session{SkipHooks: true}).Create(&entries).Error
+}
+
+// History returns the audit entries for a user and its addresses, oldest
+// first.
+func History(db *gorm.DB, userID uint, offset, limit int) ([]Entry, int64, error) {
+	var total int64
+	if err := db.Model(&Entry{}).Where("user_id = ?", userID).Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	entries := []Entry{}
+	err := db.Where("user_id = ?", userID).
+		Order("id ASC").
+		Offset(offset).
+		Limit(limit).
+		Find(&entries).Error
+	return entries, total, err
+}
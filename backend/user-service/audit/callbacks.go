@@ -0,0 +1,260 @@
+package audit
+
+import (
+	"reflect"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// auditedTables maps the audited tables to their entity type.
+var auditedTables = map[string]string{
+	"users":     EntityUser,
+	"addresses": EntityAddress,
+}
+
+// ignoredColumns are derived columns left out of diffs.
+var ignoredColumns = map[string]bool{
+	"search_text": true,
+}
+
+const beforeKey = "audit:before"
+
+type row = map[string]interface{}
+
+func registerCallbacks(db *gorm.DB) error {
+	create := db.Callback().Create()
+	if err := create.Before("gorm:create").Register("audit:before_create", captureBefore); err != nil {
+		return err
+	}
+	if err := create.After("gorm:create").Before("gorm:commit_or_rollback_transaction").Register("audit:after_create", recordWrite); err != nil {
+		return err
+	}
+
+	update := db.Callback().Update()
+	if err := update.Before("gorm:update").Register("audit:before_update", captureBefore); err != nil {
+		return err
+	}
+	if err := update.After("gorm:update").Before("gorm:commit_or_rollback_transaction").Register("audit:after_update", recordWrite); err != nil {
+		return err
+	}
+
+	del := db.Callback().Delete()
+	if err := del.Before("gorm:delete").Register("audit:before_delete", captureBefore); err != nil {
+		return err
+	}
+	return del.After("gorm:delete").Before("gorm:commit_or_rollback_transaction").Register("audit:after_delete", recordWrite)
+}
+
+// captureBefore loads the rows a write is about to touch so recordWrite can
+// diff against them.
+func captureBefore(db *gorm.DB) {
+	if db.Error != nil || db.Statement.Schema == nil {
+		return
+	}
+	if _, ok := auditedTables[db.Statement.Table]; !ok {
+		return
+	}
+
+	ids := primaryKeys(db)
+	query := db.Session(&gorm.Session{NewDB: true}).Unscoped().Table(db.Statement.Table)
+	if len(ids) > 0 {
+		query = query.Where("id IN ?", ids)
+	} else {
+		// Without IDs the write is scoped by its WHERE clause. Inserts of new
+		// rows have neither and cannot match an existing row.
+		where, ok := db.Statement.Clauses["WHERE"]
+		if !ok {
+			db.InstanceSet(beforeKey, map[uint]row{})
+			return
+		}
+		query = query.Clauses(where.Expression)
+	}
+
+	var rows []row
+	if err := query.Find(&rows).Error; err != nil {
+		db.AddError(err)
+		return
+	}
+	db.InstanceSet(beforeKey, indexRows(rows))
+}
+
+// recordWrite compares the touched rows with their captured state and
+// appends an audit entry for every row that changed.
+func recordWrite(db *gorm.DB) {
+	if db.Error != nil || db.Statement.Schema == nil {
+		return
+	}
+	entityType, ok := auditedTables[db.Statement.Table]
+	if !ok {
+		return
+	}
+
+	before := map[uint]row{}
+	if v, ok := db.InstanceGet(beforeKey); ok {
+		before = v.(map[uint]row)
+	}
+
+	ids := primaryKeys(db)
+	for id := range before {
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		return
+	}
+
+	var rows []row
+	if err := db.Session(&gorm.Session{NewDB: true}).Unscoped().Table(db.Statement.Table).Where("id IN ?", ids).Find(&rows).Error; err != nil {
+		db.AddError(err)
+		return
+	}
+	after := indexRows(rows)
+
+	ctx := db.Statement.Context
+	actor := ActorFrom(ctx)
+	requestID := RequestIDFrom(ctx)
+	now := time.Now()
+
+	var entries []Entry
+	seen := make(map[uint]bool, len(ids))
+	for _, id := range ids {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+
+		old, existed := before[id]
+		current, exists := after[id]
+		if !existed && !exists {
+			continue
+		}
+
+		changes := diff(old, current)
+		if len(changes) == 0 {
+			continue
+		}
+
+		source := current
+		if !exists {
+			source = old
+		}
+		entry := Entry{
+			EntityType: entityType,
+			EntityID:   id,
+			UserID:     id,
+			Action:     action(old, current, existed, exists),
+			Actor:      actor,
+			RequestID:  requestID,
+			Changes:    changes,
+			CreatedAt:  now,
+		}
+		if entityType == EntityAddress {
+			entry.UserID = toUint(source["user_id"])
+		}
+		entries = append(entries, entry)
+	}
+
+	if len(entries) == 0 {
+		return
+	}
+	if err := db.Session(&gorm.Session{NewDB: true, SkipHooks: true}).Create(&entries).Error; err != nil {
+		db.AddError(err)
+	}
+}
+
+// action classifies a row change. Soft deletes and restores show up as
+// updates of deleted_at.
+func action(old, current row, existed, exists bool) string {
+	switch {
+	case !existed:
+		return ActionCreate
+	case !exists:
+		return ActionDelete
+	case old["deleted_at"] == nil && current["deleted_at"] != nil:
+		return ActionDelete
+	case old["deleted_at"] != nil && current["deleted_at"] == nil:
+		return ActionRestore
+	default:
+		return ActionUpdate
+	}
+}
+
+// diff returns the columns whose values differ between old and current.
+// Either side may be nil for inserts and hard deletes.
+func diff(old, current row) Changes {
+	changes := Changes{}
+	for column, value := range current {
+		if ignoredColumns[column] {
+			continue
+		}
+		if before, ok := old[column]; !ok || !reflect.DeepEqual(before, value) {
+			changes[column] = Change{Before: old[column], After: value}
+		}
+	}
+	for column, value := range old {
+		if ignoredColumns[column] {
+			continue
+		}
+		if _, ok := current[column]; !ok {
+			changes[column] = Change{Before: value, After: nil}
+		}
+	}
+	return changes
+}
+
+// primaryKeys returns the non-zero primary keys of the statement's model.
+func primaryKeys(db *gorm.DB) []uint {
+	stmt := db.Statement
+	field := stmt.Schema.PrioritizedPrimaryField
+	if field == nil {
+		return nil
+	}
+
+	var ids []uint
+	collect := func(v reflect.Value) {
+		if value, zero := field.ValueOf(stmt.Context, v); !zero {
+			ids = append(ids, toUint(value))
+		}
+	}
+
+	rv := reflect.Indirect(stmt.ReflectValue)
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < rv.Len(); i++ {
+			elem := reflect.Indirect(rv.Index(i))
+			if elem.Kind() == reflect.Struct {
+				collect(elem)
+			}
+		}
+	case reflect.Struct:
+		collect(rv)
+	}
+	return ids
+}
+
+func indexRows(rows []row) map[uint]row {
+	indexed := make(map[uint]row, len(rows))
+	for _, r := range rows {
+		indexed[toUint(r["id"])] = r
+	}
+	return indexed
+}
+
+func toUint(v interface{}) uint {
+	switch n := v.(type) {
+	case uint:
+		return n
+	case uint32:
+		return uint(n)
+	case uint64:
+		return uint(n)
+	case int:
+		return uint(n)
+	case int32:
+		return uint(n)
+	case int64:
+		return uint(n)
+	default:
+		return 0
+	}
+}
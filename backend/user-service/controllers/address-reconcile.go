@@ -0,0 +1,112 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	"back-forms/user-service/models"
+	"back-forms/user-service/repository"
+	"back-forms/user-service/validation"
+)
+
+// AddressChanges reports what reconcileAddresses did to a user's addresses.
+type AddressChanges struct {
+	Created []uint `json:"created"`
+	Updated []uint `json:"updated"`
+	Removed []uint `json:"removed"`
+}
+
+// reconcileAddresses brings the stored addresses of a user in line with
+// desired. Addresses with an ID are updated in place, addresses without one
+// are inserted and, when removeMissing is set, stored addresses that are not
+// in desired are deleted. IDs that do not belong to the user are reported as
+// validation errors, and an address whose non-zero version is stale aborts
+// with errVersionConflict.
+func reconcileAddresses(ctx context.Context, addresses repository.AddressRepository, userID uint, existing, desired []models.Address, removeMissing bool) (AddressChanges, validation.Errors, error) {
+	changes := AddressChanges{Created: []uint{}, Updated: []uint{}, Removed: []uint{}}
+
+	current := make(map[uint]models.Address, len(existing))
+	for _, address := range existing {
+		current[address.ID] = address
+	}
+
+	var errs validation.Errors
+	seen := make(map[uint]bool, len(desired))
+	for i, address := range desired {
+		if address.ID == 0 {
+			continue
+		}
+		if _, ok := current[address.ID]; !ok {
+			errs.Add(fmt.Sprintf("addresses[%d].id", i), validation.CodeInvalidChoice, "does not belong to this user")
+		} else if seen[address.ID] {
+			errs.Add(fmt.Sprintf("addresses[%d].id", i), validation.CodeInvalidChoice, "is listed more than once")
+		}
+		seen[address.ID] = true
+	}
+	if len(errs) > 0 {
+		return changes, errs, nil
+	}
+
+	for i := range desired {
+		address := desired[i]
+		address.UserID = userID
+
+		if address.ID == 0 {
+			if err := addresses.Create(ctx, &address); err != nil {
+				return changes, nil, err
+			}
+			changes.Created = append(changes.Created, address.ID)
+			continue
+		}
+
+		stored := current[address.ID]
+		if address.Version != 0 && address.Version != stored.Version {
+			return changes, nil, errVersionConflict
+		}
+		if address.Kind == "" {
+			address.Kind = models.AddressKindOther
+		}
+		if sameAddressFields(stored, address) {
+			continue
+		}
+		copyAddressFields(&stored, address)
+		stored.Version++
+		if err := addresses.Update(ctx, &stored); err != nil {
+			return changes, nil, err
+		}
+		changes.Updated = append(changes.Updated, stored.ID)
+	}
+
+	if removeMissing {
+		for _, address := range existing {
+			if seen[address.ID] {
+				continue
+			}
+			if err := addresses.Delete(ctx, address); err != nil {
+				return changes, nil, err
+			}
+			changes.Removed = append(changes.Removed, address.ID)
+		}
+	}
+
+	return changes, nil, nil
+}
+
+// sameAddressFields reports whether a and b hold the same editable fields.
+func sameAddressFields(a, b models.Address) bool {
+	return a.Kind == b.Kind && a.Subject == b.Subject && a.Details == b.Details &&
+		a.Province == b.Province && a.City == b.City && a.PostalCode == b.PostalCode &&
+		a.Plate == b.Plate && a.Unit == b.Unit
+}
+
+// copyAddressFields copies the editable fields of src onto dst.
+func copyAddressFields(dst *models.Address, src models.Address) {
+	dst.Kind = src.Kind
+	dst.Subject = src.Subject
+	dst.Details = src.Details
+	dst.Province = src.Province
+	dst.City = src.City
+	dst.PostalCode = src.PostalCode
+	dst.Plate = src.Plate
+	dst.Unit = src.Unit
+}
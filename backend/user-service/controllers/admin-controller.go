@@ -0,0 +1,332 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+
+	"back-forms/auth"
+	"back-forms/user-service/validation"
+)
+
+// RoleRequest is the request body of CreateRole and UpdateRole.
+type RoleRequest struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Permissions []string `json:"permissions"`
+}
+
+// OperatorRequest is the request body of CreateOperator.
+type OperatorRequest struct {
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+	Roles    []string `json:"roles"`
+}
+
+// OperatorUpdateRequest is the request body of UpdateOperator. Fields left
+// out are not changed.
+type OperatorUpdateRequest struct {
+	Roles    *[]string `json:"roles"`
+	Disabled *bool     `json:"disabled"`
+}
+
+// ListPermissions handles listing every permission a role can grant
+func ListPermissions() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(auth.Permissions)
+	}
+}
+
+// ListRoles handles listing all roles
+func ListRoles(db *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		db := db.WithContext(r.Context())
+		roles := []auth.Role{}
+		if err := db.Order("name").Find(&roles).Error; err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(roles)
+	}
+}
+
+// CreateRole handles adding a role
+func CreateRole(db *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		db := db.WithContext(r.Context())
+		var req RoleRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		role := auth.Role{}
+		errs, err := applyRoleRequest(db, &role, req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(errs) > 0 {
+			validation.WriteErrors(w, errs)
+			return
+		}
+		if err := db.Create(&role).Error; err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(role)
+	}
+}
+
+// UpdateRole handles replacing the name, description and permissions of a
+// role. Operators holding it get the new permissions on their next refresh.
+func UpdateRole(db *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		db := db.WithContext(r.Context())
+		var role auth.Role
+		if err := db.First(&role, mux.Vars(r)["id"]).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				http.Error(w, "Role not found", http.StatusNotFound)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		var req RoleRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		errs, err := applyRoleRequest(db, &role, req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(errs) > 0 {
+			validation.WriteErrors(w, errs)
+			return
+		}
+		if err := db.Save(&role).Error; err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(role)
+	}
+}
+
+// DeleteRole handles removing a role from every operator and deleting it
+func DeleteRole(db *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		db := db.WithContext(r.Context())
+		err := db.Transaction(func(tx *gorm.DB) error {
+			var role auth.Role
+			if err := tx.First(&role, mux.Vars(r)["id"]).Error; err != nil {
+				return err
+			}
+			if err := tx.Exec("DELETE FROM operator_roles WHERE role_id = ?", role.ID).Error; err != nil {
+				return err
+			}
+			return tx.Delete(&role).Error
+		})
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				http.Error(w, "Role not found", http.StatusNotFound)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// applyRoleRequest validates req and copies it onto role.
+func applyRoleRequest(db *gorm.DB, role *auth.Role, req RoleRequest) (validation.Errors, error) {
+	var errs validation.Errors
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		errs.Add("name", validation.CodeRequired, "is required")
+	} else {
+		var count int64
+		if err := db.Model(&auth.Role{}).Where("name = ? AND id <> ?", name, role.ID).Count(&count).Error; err != nil {
+			return nil, err
+		}
+		if count > 0 {
+			errs.Add("name", validation.CodeTaken, "is already taken")
+		}
+	}
+	for _, perm := range req.Permissions {
+		if !auth.KnownPermission(perm) {
+			errs.Add("permissions", validation.CodeInvalidChoice, "unknown permission "+perm)
+		}
+	}
+
+	role.Name = name
+	role.Description = strings.TrimSpace(req.Description)
+	role.Permissions = auth.PermissionList(req.Permissions)
+	return errs, nil
+}
+
+// ListOperators handles listing operator accounts with their roles
+func ListOperators(db *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		db := db.WithContext(r.Context())
+		operators := []auth.Operator{}
+		if err := db.Preload("Roles").Order("username").Find(&operators).Error; err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(operators)
+	}
+}
+
+// CreateOperator handles adding an operator account
+func CreateOperator(db *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		db := db.WithContext(r.Context())
+		var req OperatorRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		var errs validation.Errors
+		if req.Username == "" {
+			errs.Add("username", validation.CodeRequired, "is required")
+		}
+		if len(req.Password) < auth.MinPasswordLength {
+			errs.Add("password", validation.CodeTooShort, "must be at least 8 characters")
+		}
+		if len(errs) == 0 {
+			var count int64
+			if err := db.Model(&auth.Operator{}).Where("username = ?", req.Username).Count(&count).Error; err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if count > 0 {
+				errs.Add("username", validation.CodeTaken, "is already taken")
+			}
+		}
+		if err := checkRoleNames(db, &errs, req.Roles); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(errs) > 0 {
+			validation.WriteErrors(w, errs)
+			return
+		}
+
+		operator, err := auth.CreateOperator(db, req.Username, req.Password, req.Roles...)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(operator)
+	}
+}
+
+// UpdateOperator handles replacing an operator's roles and enabling or
+// disabling the account. Disabling also ends every session of the operator.
+func UpdateOperator(db *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		db := db.WithContext(r.Context())
+		var req OperatorUpdateRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		var operator auth.Operator
+		if err := db.First(&operator, mux.Vars(r)["id"]).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				http.Error(w, "Operator not found", http.StatusNotFound)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		var errs validation.Errors
+		if req.Roles != nil {
+			if err := checkRoleNames(db, &errs, *req.Roles); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		if len(errs) > 0 {
+			validation.WriteErrors(w, errs)
+			return
+		}
+
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if req.Roles != nil {
+				roles := []auth.Role{}
+				if len(*req.Roles) > 0 {
+					if err := tx.Where("name IN ?", *req.Roles).Find(&roles).Error; err != nil {
+						return err
+					}
+				}
+				if err := tx.Model(&operator).Association("Roles").Replace(roles); err != nil {
+					return err
+				}
+			}
+			if req.Disabled != nil {
+				if err := tx.Model(&operator).Update("disabled", *req.Disabled).Error; err != nil {
+					return err
+				}
+				if *req.Disabled {
+					return auth.RevokeSessions(tx, operator.ID)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if err := db.Preload("Roles").First(&operator, operator.ID).Error; err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(operator)
+	}
+}
+
+// checkRoleNames adds an error for each name that is not an existing role.
+func checkRoleNames(db *gorm.DB, errs *validation.Errors, names []string) error {
+	if len(names) == 0 {
+		return nil
+	}
+	var existing []string
+	if err := db.Model(&auth.Role{}).Where("name IN ?", names).Pluck("name", &existing).Error; err != nil {
+		return err
+	}
+	known := make(map[string]bool, len(existing))
+	for _, name := range existing {
+		known[name] = true
+	}
+	for _, name := range names {
+		if !known[name] {
+			errs.Add("roles", validation.CodeInvalidChoice, "unknown role "+name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+
+	"back-forms/auth"
+	"back-forms/user-service/validation"
+)
+
+// APIKeyRequest is the request body of CreateAPIKey. A missing expires_at
+// creates a key that does not expire.
+type APIKeyRequest struct {
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// APIKeyResponse is an API key together with its secret, returned only when
+// the key is created or rotated.
+type APIKeyResponse struct {
+	auth.APIKey
+	Key string `json:"key"`
+}
+
+// ListAPIKeys handles listing API keys, newest first. Secrets are never
+// returned.
+func ListAPIKeys(db *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		db := db.WithContext(r.Context())
+		keys := []auth.APIKey{}
+		if err := db.Order("id DESC").Find(&keys).Error; err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(keys)
+	}
+}
+
+// CreateAPIKey handles issuing an API key for a machine client
+func CreateAPIKey(db *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		db := db.WithContext(r.Context())
+		var req APIKeyRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			if errs, ok := validation.FromDecodeError(err, ""); ok {
+				validation.WriteErrors(w, errs)
+				return
+			}
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		var errs validation.Errors
+		if strings.TrimSpace(req.Name) == "" {
+			errs.Add("name", validation.CodeRequired, "is required")
+		}
+		if len(req.Scopes) == 0 {
+			errs.Add("scopes", validation.CodeRequired, "is required")
+		}
+		for _, scope := range req.Scopes {
+			if !auth.KnownPermission(scope) {
+				errs.Add("scopes", validation.CodeInvalidChoice, "unknown permission "+scope)
+			}
+		}
+		if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+			errs.Add("expires_at", validation.CodeInvalidDate, "must be in the future")
+		}
+		if len(errs) > 0 {
+			validation.WriteErrors(w, errs)
+			return
+		}
+
+		var createdBy string
+		if claims, ok := auth.ClaimsFrom(r.Context()); ok {
+			createdBy = claims.Username
+		}
+		key, secret, err := auth.CreateAPIKey(db, req.Name, req.Scopes, req.ExpiresAt, createdBy)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeAPIKey(w, http.StatusCreated, key, secret)
+	}
+}
+
+// RotateAPIKey handles replacing the secret of an API key. The old secret
+// stops working at once.
+func RotateAPIKey(db *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		db := db.WithContext(r.Context())
+		id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+		if err != nil {
+			http.Error(w, "API key not found", http.StatusNotFound)
+			return
+		}
+
+		key, secret, err := auth.RotateAPIKey(db, uint(id))
+		switch {
+		case err == nil:
+			writeAPIKey(w, http.StatusOK, key, secret)
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			http.Error(w, "API key not found", http.StatusNotFound)
+		case errors.Is(err, auth.ErrInvalidToken):
+			http.Error(w, "API key is revoked or expired", http.StatusConflict)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// RevokeAPIKey handles permanently disabling an API key
+func RevokeAPIKey(db *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		db := db.WithContext(r.Context())
+		id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+		if err != nil {
+			http.Error(w, "API key not found", http.StatusNotFound)
+			return
+		}
+
+		if _, err := auth.RevokeAPIKey(db, uint(id)); err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				http.Error(w, "API key not found", http.StatusNotFound)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func writeAPIKey(w http.ResponseWriter, status int, key auth.APIKey, secret string) {
+	// The secret is shown once and must not be cached
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(APIKeyResponse{APIKey: key, Key: secret})
+}
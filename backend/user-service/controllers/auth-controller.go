@@ -0,0 +1,120 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"gorm.io/gorm"
+
+	"back-forms/auth"
+)
+
+// LoginRequest is the request body of Login.
+type LoginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// RefreshRequest is the request body of Refresh and Logout.
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// Login handles exchanging operator credentials for a token pair
+func Login(db *gorm.DB, authn *auth.Authenticator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		db := db.WithContext(r.Context())
+		var req LoginRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		pair, err := authn.Login(db, req.Username, req.Password)
+		if errors.Is(err, auth.ErrInvalidCredentials) {
+			http.Error(w, "Invalid username or password", http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		writeTokenPair(w, pair)
+	}
+}
+
+// Refresh handles exchanging a refresh token for a new token pair
+func Refresh(db *gorm.DB, authn *auth.Authenticator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		db := db.WithContext(r.Context())
+		var req RefreshRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+			http.Error(w, "refresh_token is required", http.StatusBadRequest)
+			return
+		}
+
+		pair, err := authn.Refresh(db, req.RefreshToken)
+		if errors.Is(err, auth.ErrInvalidToken) {
+			http.Error(w, "Invalid or expired refresh token", http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		writeTokenPair(w, pair)
+	}
+}
+
+// Logout handles revoking the session of a refresh token
+func Logout(db *gorm.DB, authn *auth.Authenticator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		db := db.WithContext(r.Context())
+		var req RefreshRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+			http.Error(w, "refresh_token is required", http.StatusBadRequest)
+			return
+		}
+
+		if err := authn.Logout(db, req.RefreshToken); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// CurrentOperator handles returning the operator behind the access token
+func CurrentOperator(db *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		db := db.WithContext(r.Context())
+		claims, ok := auth.ClaimsFrom(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var operator auth.Operator
+		if err := db.First(&operator, claims.OperatorID()).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				http.Error(w, "Operator not found", http.StatusNotFound)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(operator)
+	}
+}
+
+func writeTokenPair(w http.ResponseWriter, pair auth.TokenPair) {
+	// Tokens must never be cached by the browser or a proxy
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pair)
+}
@@ -0,0 +1,302 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/schema"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"back-forms/user-service/audit"
+	"back-forms/user-service/duplicates"
+	"back-forms/user-service/models"
+	"back-forms/user-service/validation"
+)
+
+// DuplicateParams holds the query parameters accepted by FindDuplicates.
+type DuplicateParams struct {
+	MinScore float64 `schema:"min_score"`
+	UserID   uint    `schema:"user_id"`
+	Page     int     `schema:"page"`
+	PageSize int     `schema:"page_size"`
+}
+
+// DuplicateListResponse is the response body of FindDuplicates.
+type DuplicateListResponse struct {
+	Data []duplicates.Candidate `json:"data"`
+	Meta ListMeta               `json:"meta"`
+}
+
+// FindDuplicates handles listing pairs of users that look like the same
+// person, best match first
+func FindDuplicates(db *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		db := db.WithContext(r.Context())
+
+		var params DuplicateParams
+		decoder := schema.NewDecoder()
+		decoder.IgnoreUnknownKeys(true)
+		if err := decoder.Decode(&params, r.URL.Query()); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if params.MinScore < 0 || params.MinScore > 1 {
+			http.Error(w, "min_score must be between 0 and 1", http.StatusBadRequest)
+			return
+		}
+		page := max(params.Page, 1)
+		size := params.PageSize
+		if size <= 0 {
+			size = defaultPageSize
+		}
+		size = min(size, maxPageSize)
+
+		candidates, err := duplicates.Find(db, duplicates.Options{MinScore: params.MinScore, UserID: params.UserID})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		total := len(candidates)
+		start := min((page-1)*size, total)
+		end := min(start+size, total)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(DuplicateListResponse{
+			Data: candidates[start:end],
+			Meta: ListMeta{Total: int64(total), Page: page, PageSize: size},
+		})
+	}
+}
+
+// Sources for a merged field.
+const (
+	mergeFromSurvivor = "survivor"
+	mergeFromLoser    = "loser"
+)
+
+// MergeRequest is the request body of MergeUsers. Fields picks, per user
+// field, which user the merged value comes from; fields left out keep the
+// survivor's value unless it is empty. Versions are checked when given.
+type MergeRequest struct {
+	SurvivorID      uint              `json:"survivor_id"`
+	LoserID         uint              `json:"loser_id"`
+	Fields          map[string]string `json:"fields"`
+	SurvivorVersion uint              `json:"survivor_version"`
+	LoserVersion    uint              `json:"loser_version"`
+}
+
+// MergeResponse is the response body of MergeUsers.
+type MergeResponse struct {
+	User           models.User `json:"user"`
+	MergedUserID   uint        `json:"merged_user_id"`
+	MovedAddresses []uint      `json:"moved_addresses"`
+}
+
+// mergeFields lists the user fields that can be picked in a merge.
+var mergeFields = map[string]bool{
+	"firstname":    true,
+	"lastname":     true,
+	"phone_number": true,
+	"gender":       true,
+	"persian_date": true,
+}
+
+// errMergeInvalid aborts a merge transaction when the request or the merged
+// user fails validation.
+var errMergeInvalid = errors.New("invalid merge")
+
+// MergeUsers handles combining two users into the survivor. The loser's
+// addresses move to the survivor, the loser is soft-deleted with
+// merged_into_id set and the merge is recorded in the audit trail of both.
+func MergeUsers(db *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		db := db.WithContext(r.Context())
+
+		var req MergeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			if errs, ok := validation.FromDecodeError(err, ""); ok {
+				validation.WriteErrors(w, errs)
+				return
+			}
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		errs := validateMergeRequest(req)
+		if len(errs) > 0 {
+			validation.WriteErrors(w, errs)
+			return
+		}
+
+		var survivor, loser models.User
+		var moved []uint
+		var stale *models.User
+		err := db.Transaction(func(tx *gorm.DB) error {
+			// Lock both users in ID order so concurrent merges cannot deadlock
+			var locked []models.User
+			if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+				Where("id IN ?", []uint{req.SurvivorID, req.LoserID}).
+				Order("id").
+				Find(&locked).Error; err != nil {
+				return err
+			}
+			for _, u := range locked {
+				if u.ID == req.SurvivorID {
+					survivor = u
+				} else {
+					loser = u
+				}
+			}
+			if survivor.ID == 0 || loser.ID == 0 {
+				return gorm.ErrRecordNotFound
+			}
+			if !versionMatches(req.SurvivorVersion, survivor.Version) {
+				stale = &survivor
+				return errVersionConflict
+			}
+			if !versionMatches(req.LoserVersion, loser.Version) {
+				stale = &loser
+				return errVersionConflict
+			}
+
+			mergeUserFields(&survivor, loser, req.Fields)
+			if errs = validation.ValidateUser(survivor); len(errs) > 0 {
+				return errMergeInvalid
+			}
+			survivor.Version++
+			if err := tx.Omit("Addresses").Save(&survivor).Error; err != nil {
+				return err
+			}
+
+			var addresses []models.Address
+			if err := tx.Where("user_id = ?", loser.ID).Order("id").Find(&addresses).Error; err != nil {
+				return err
+			}
+			moved = make([]uint, len(addresses))
+			for i, address := range addresses {
+				moved[i] = address.ID
+			}
+			if len(moved) > 0 {
+				if err := tx.Model(&models.Address{}).
+					Where("id IN ?", moved).
+					Updates(map[string]interface{}{"user_id": survivor.ID, "version": gorm.Expr("version + 1")}).Error; err != nil {
+					return err
+				}
+			}
+
+			if err := tx.Model(&loser).Updates(map[string]interface{}{
+				"deleted_at":     time.Now(),
+				"merged_into_id": survivor.ID,
+				"version":        loser.Version + 1,
+			}).Error; err != nil {
+				return err
+			}
+
+			// Field and address changes are audited as regular updates; these
+			// entries tie them together as one merge
+			return audit.Record(tx,
+				audit.Entry{EntityType: audit.EntityUser, EntityID: survivor.ID, UserID: survivor.ID, Action: audit.ActionMerge, Changes: audit.Changes{
+					"merged_user_id":  {Before: nil, After: loser.ID},
+					"moved_addresses": {Before: nil, After: moved},
+				}},
+				audit.Entry{EntityType: audit.EntityUser, EntityID: loser.ID, UserID: loser.ID, Action: audit.ActionMerge, Changes: audit.Changes{
+					"merged_into_id":  {Before: nil, After: survivor.ID},
+					"moved_addresses": {Before: nil, After: moved},
+				}},
+			)
+		})
+
+		switch {
+		case err == nil:
+		case errors.Is(err, errMergeInvalid):
+			validation.WriteErrors(w, errs)
+			return
+		case errors.Is(err, errVersionConflict):
+			writeVersionConflict(w, stale.Version, stale)
+			return
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		var merged models.User
+		if err := db.Preload("Addresses").First(&merged, survivor.ID).Error; err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("ETag", etag(merged.Version))
+		json.NewEncoder(w).Encode(MergeResponse{User: merged, MergedUserID: loser.ID, MovedAddresses: moved})
+	}
+}
+
+func validateMergeRequest(req MergeRequest) validation.Errors {
+	var errs validation.Errors
+	if req.SurvivorID == 0 {
+		errs.Add("survivor_id", validation.CodeRequired, "is required")
+	}
+	if req.LoserID == 0 {
+		errs.Add("loser_id", validation.CodeRequired, "is required")
+	}
+	if req.SurvivorID != 0 && req.SurvivorID == req.LoserID {
+		errs.Add("loser_id", validation.CodeInvalidChoice, "must differ from survivor_id")
+	}
+
+	names := make([]string, 0, len(req.Fields))
+	for field := range req.Fields {
+		names = append(names, field)
+	}
+	sort.Strings(names)
+	for _, field := range names {
+		source := req.Fields[field]
+		if !mergeFields[field] {
+			errs.Add("fields."+field, validation.CodeInvalidChoice, "is not a mergeable field")
+		} else if source != mergeFromSurvivor && source != mergeFromLoser {
+			errs.Add("fields."+field, validation.CodeInvalidChoice, fmt.Sprintf("must be %s or %s", mergeFromSurvivor, mergeFromLoser))
+		}
+	}
+	return errs
+}
+
+// mergeUserFields copies fields from loser onto survivor: those picked with
+// "loser" in sources, and those the survivor has left empty unless they are
+// explicitly picked with "survivor".
+func mergeUserFields(survivor *models.User, loser models.User, sources map[string]string) {
+	fromLoser := func(field string, survivorEmpty bool) bool {
+		switch sources[field] {
+		case mergeFromLoser:
+			return true
+		case mergeFromSurvivor:
+			return false
+		default:
+			return survivorEmpty
+		}
+	}
+
+	if fromLoser("firstname", survivor.Firstname == "") {
+		survivor.Firstname = loser.Firstname
+	}
+	if fromLoser("lastname", survivor.Lastname == "") {
+		survivor.Lastname = loser.Lastname
+	}
+	if fromLoser("phone_number", survivor.PhoneNumber == "") {
+		survivor.PhoneNumber = loser.PhoneNumber
+		survivor.PhoneInput = loser.PhoneInput
+	}
+	if fromLoser("gender", survivor.Gender == "") {
+		survivor.Gender = loser.Gender
+	}
+	if fromLoser("persian_date", survivor.PersianDate.IsZero()) {
+		survivor.PersianDate = loser.PersianDate
+	}
+}
@@ -0,0 +1,61 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"back-forms/user-service/regions"
+)
+
+// ProvinceSummary is a province without its cities, for dropdowns.
+type ProvinceSummary struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	NameEn string `json:"name_en"`
+}
+
+// CitiesResponse is the response body of GetProvinceCities.
+type CitiesResponse struct {
+	Province ProvinceSummary `json:"province"`
+	Cities   []string        `json:"cities"`
+}
+
+// regionCacheControl lets clients cache the lookups; the dataset only
+// changes with a new build.
+const regionCacheControl = "public, max-age=86400"
+
+// GetProvinces handles listing the provinces accepted in addresses
+func GetProvinces() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		provinces := regions.Provinces()
+		summaries := make([]ProvinceSummary, len(provinces))
+		for i, p := range provinces {
+			summaries[i] = ProvinceSummary{ID: p.ID, Name: p.Name, NameEn: p.NameEn}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", regionCacheControl)
+		json.NewEncoder(w).Encode(summaries)
+	}
+}
+
+// GetProvinceCities handles listing the cities of a province. The province
+// may be given by ID or by name.
+func GetProvinceCities() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		province, ok := regions.FindProvince(mux.Vars(r)["id"])
+		if !ok {
+			http.Error(w, "Province not found", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", regionCacheControl)
+		json.NewEncoder(w).Encode(CitiesResponse{
+			Province: ProvinceSummary{ID: province.ID, Name: province.Name, NameEn: province.NameEn},
+			Cities:   province.Cities,
+		})
+	}
+}
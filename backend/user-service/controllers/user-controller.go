@@ -1,18 +1,32 @@
 package controllers
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
+	"mime"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
+	jsonpatch "github.com/evanphx/json-patch/v5"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/schema"
-	"gorm.io/gorm"
 
+	"back-forms/auth"
+	"back-forms/jalali"
+	"back-forms/phone"
+	"back-forms/user-service/audit"
+	"back-forms/user-service/exporter"
+	"back-forms/user-service/importer"
 	"back-forms/user-service/models"
+	"back-forms/user-service/repository"
+	"back-forms/user-service/search"
+	"back-forms/user-service/validation"
 )
 
 type UserStatsParams struct {
@@ -20,199 +34,743 @@ type UserStatsParams struct {
 	Year  string `schema:"year"`
 }
 
-func SubmitUser(db *gorm.DB) http.HandlerFunc {
+// UserResponse is a user together with any non-fatal warnings, such as a
+// phone number shared with another user under the warn policy.
+type UserResponse struct {
+	models.User
+	Warnings validation.Errors `json:"warnings,omitempty"`
+}
+
+func SubmitUser(store repository.Store, phonePolicy validation.PhonePolicy) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
 		var user models.User
 		if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
+			if errs, ok := validation.FromDecodeError(err, "persian_date"); ok {
+				validation.WriteErrors(w, errs)
+				return
+			}
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
-		if result := db.Create(&user); result.Error != nil {
-			http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+		// Only MergeUsers marks a user as merged
+		user.MergedIntoID = nil
+
+		if errs := validation.ValidateUser(user); len(errs) > 0 {
+			validation.WriteErrors(w, errs)
+			return
+		}
+
+		// The number is checked and written in one transaction, so that two
+		// submissions of the same number cannot both pass the check
+		var errs, warnings validation.Errors
+		err := store.Transaction(ctx, func(tx repository.Store) error {
+			var err error
+			errs, warnings, err = checkPhone(ctx, tx.Users(), phonePolicy, user, "")
+			if err != nil {
+				return err
+			}
+			errs, warnings = hidePhoneOwners(r, errs), hidePhoneOwners(r, warnings)
+			if len(errs) > 0 {
+				return errInvalid
+			}
+			return tx.Users().Create(ctx, &user)
+		})
+		if errors.Is(err, errInvalid) {
+			validation.WriteErrors(w, errs)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
+		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusCreated)
-		json.NewEncoder(w).Encode(user)
+		json.NewEncoder(w).Encode(UserResponse{User: user, Warnings: warnings})
 	}
 }
 
 // EditAddress handles updating an existing address
-func EditAddress(db *gorm.DB) http.HandlerFunc {
+func EditAddress(store repository.Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		vars := mux.Vars(r)
-		userId := vars["userId"]
-		addressId := vars["addressId"]
+		ctx := r.Context()
+		userID, err := pathID(r, "userId")
+		if err != nil {
+			http.Error(w, "Invalid user ID", http.StatusBadRequest)
+			return
+		}
+		addressID, err := pathID(r, "addressId")
+		if err != nil {
+			http.Error(w, "Invalid address ID", http.StatusBadRequest)
+			return
+		}
 
 		// Parse the updated address from request body
 		var updatedAddress models.Address
 		if err := json.NewDecoder(r.Body).Decode(&updatedAddress); err != nil {
-			http.Error(w, "Invalid request body", http.StatusBadRequest)
-			return
-		}
-
-		// Find existing address
-		var existingAddress models.Address
-		if err := db.Where("id = ? AND user_id = ?", addressId, userId).First(&existingAddress).Error; err != nil {
-			if errors.Is(err, gorm.ErrRecordNotFound) {
-				http.Error(w, "Address not found", http.StatusNotFound)
+			if errs, ok := validation.FromDecodeError(err, ""); ok {
+				validation.WriteErrors(w, errs)
 				return
 			}
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
 			return
 		}
 
-		// Update address fields
-		if updatedAddress.Subject != "" {
-			existingAddress.Subject = updatedAddress.Subject
+		expected, ok, err := expectedVersion(r, updatedAddress.Version)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
-		if updatedAddress.Details != "" {
-			existingAddress.Details = updatedAddress.Details
+		if !ok {
+			writePreconditionRequired(w)
+			return
 		}
 
-		// Save the updated address
-		if err := db.Save(&existingAddress).Error; err != nil {
+		var existingAddress models.Address
+		var errs validation.Errors
+		err = store.Transaction(ctx, func(tx repository.Store) error {
+			// Find and lock existing address
+			var err error
+			existingAddress, err = tx.Addresses().GetForUpdate(ctx, userID, addressID)
+			if err != nil {
+				return err
+			}
+
+			if !versionMatches(expected, existingAddress.Version) {
+				return errVersionConflict
+			}
+
+			// Update address fields
+			if updatedAddress.Subject != "" {
+				existingAddress.Subject = updatedAddress.Subject
+			}
+			if updatedAddress.Details != "" {
+				existingAddress.Details = updatedAddress.Details
+			}
+			if updatedAddress.Kind != "" {
+				existingAddress.Kind = updatedAddress.Kind
+			}
+			if updatedAddress.Province != "" {
+				existingAddress.Province = updatedAddress.Province
+			}
+			if updatedAddress.City != "" {
+				existingAddress.City = updatedAddress.City
+			}
+			if updatedAddress.PostalCode != "" {
+				existingAddress.PostalCode = updatedAddress.PostalCode
+			}
+			if updatedAddress.Plate != "" {
+				existingAddress.Plate = updatedAddress.Plate
+			}
+			if updatedAddress.Unit != "" {
+				existingAddress.Unit = updatedAddress.Unit
+			}
+
+			if errs = validation.ValidateAddress(existingAddress); len(errs) > 0 {
+				return errInvalid
+			}
+
+			// Save the updated address
+			existingAddress.Version++
+			return tx.Addresses().Update(ctx, &existingAddress)
+		})
+
+		switch {
+		case err == nil:
+		case errors.Is(err, repository.ErrNotFound):
+			http.Error(w, "Address not found", http.StatusNotFound)
+			return
+		case errors.Is(err, errVersionConflict):
+			writeVersionConflict(w, existingAddress.Version, existingAddress)
+			return
+		case errors.Is(err, errInvalid):
+			validation.WriteErrors(w, errs)
+			return
+		default:
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
 		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("ETag", etag(existingAddress.Version))
 		json.NewEncoder(w).Encode(existingAddress)
 	}
 }
 
 // DeleteAddress handles deleting an address
-func DeleteAddress(db *gorm.DB) http.HandlerFunc {
+func DeleteAddress(addresses repository.AddressRepository) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		vars := mux.Vars(r)
-		userId := vars["userId"]
-		addressId := vars["addressId"]
-
-		// Check if address exists and belongs to the user
-		var address models.Address
-		if err := db.Where("id = ? AND user_id = ?", addressId, userId).First(&address).Error; err != nil {
-			if errors.Is(err, gorm.ErrRecordNotFound) {
-				http.Error(w, "Address not found", http.StatusNotFound)
-				return
-			}
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		ctx := r.Context()
+		userID, err := pathID(r, "userId")
+		if err != nil {
+			http.Error(w, "Invalid user ID", http.StatusBadRequest)
+			return
+		}
+		addressID, err := pathID(r, "addressId")
+		if err != nil {
+			http.Error(w, "Invalid address ID", http.StatusBadRequest)
 			return
 		}
 
-		// Delete the address
-		if err := db.Delete(&address).Error; err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		expected, ok, err := expectedVersion(r, 0)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
+		if !ok {
+			writePreconditionRequired(w)
+			return
+		}
+
+		// A wildcard If-Match deletes whatever version is stored, so a
+		// concurrent update is retried; a specific version is reported
+		for attempt := 0; ; attempt++ {
+			address, err := addresses.Get(ctx, userID, addressID)
+			if err != nil {
+				if errors.Is(err, repository.ErrNotFound) {
+					http.Error(w, "Address not found", http.StatusNotFound)
+					return
+				}
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if !versionMatches(expected, address.Version) {
+				writeVersionConflict(w, address.Version, address)
+				return
+			}
+
+			// The repository guards against a concurrent update
+			err = addresses.Delete(ctx, address)
+			if errors.Is(err, repository.ErrVersionConflict) && expected == 0 && attempt < maxDeleteAttempts {
+				continue
+			}
+			if errors.Is(err, repository.ErrVersionConflict) {
+				current, err := addresses.Get(ctx, userID, addressID)
+				if err != nil {
+					if errors.Is(err, repository.ErrNotFound) {
+						http.Error(w, "Address not found", http.StatusNotFound)
+						return
+					}
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				writeVersionConflict(w, current.Version, current)
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			break
+		}
 
 		w.WriteHeader(http.StatusNoContent)
 	}
 }
 
-func EditUser(db *gorm.DB) http.HandlerFunc {
+// EditUserResponse is the body returned by EditUser: the updated user plus
+// a report of which addresses were created, updated and removed.
+type EditUserResponse struct {
+	models.User
+	AddressChanges AddressChanges    `json:"address_changes"`
+	Warnings       validation.Errors `json:"warnings,omitempty"`
+}
+
+func EditUser(store repository.Store, phonePolicy validation.PhonePolicy) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
 		// Get user ID from URL parameters
-		vars := mux.Vars(r)
-		userId := vars["id"]
+		userID, err := pathID(r, "id")
+		if err != nil {
+			http.Error(w, "Invalid user ID", http.StatusBadRequest)
+			return
+		}
 
-		// Create a struct to receive the update data
+		// Create a struct to receive the update data. Addresses are left
+		// untouched when omitted; missing addresses are only removed when
+		// replace_addresses is set in the body or the query string.
 		type UpdateData struct {
-			User      models.User      `json:"user"`
-			Addresses []models.Address `json:"addresses"`
+			User             models.User      `json:"user"`
+			Addresses        []models.Address `json:"addresses"`
+			ReplaceAddresses bool             `json:"replace_addresses"`
 		}
 
 		// Parse the updated data from request body
 		var updateData UpdateData
 		if err := json.NewDecoder(r.Body).Decode(&updateData); err != nil {
+			if errs, ok := validation.FromDecodeError(err, "user.persian_date"); ok {
+				validation.WriteErrors(w, errs)
+				return
+			}
 			http.Error(w, "Invalid request body", http.StatusBadRequest)
 			return
 		}
 
-		// Start a transaction
-		tx := db.Begin()
-		if tx.Error != nil {
-			http.Error(w, tx.Error.Error(), http.StatusInternalServerError)
+		expected, ok, err := expectedVersion(r, updateData.User.Version)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !ok {
+			writePreconditionRequired(w)
 			return
 		}
 
-		// Find existing user
-		var existingUser models.User
-		if err := tx.Preload("Addresses").First(&existingUser, userId).Error; err != nil {
-			tx.Rollback()
-			if errors.Is(err, gorm.ErrRecordNotFound) {
-				http.Error(w, "User not found", http.StatusNotFound)
-				return
+		changes := AddressChanges{Created: []uint{}, Updated: []uint{}, Removed: []uint{}}
+		var errs, warnings validation.Errors
+		err = store.Transaction(ctx, func(tx repository.Store) error {
+			// Find and lock existing user
+			existingUser, err := tx.Users().GetForUpdate(ctx, userID)
+			if err != nil {
+				return err
 			}
+
+			if !versionMatches(expected, existingUser.Version) {
+				return errVersionConflict
+			}
+
+			// Update user fields. Identity and bookkeeping fields, including
+			// the merge, are kept from the stored user
+			if updateData.User.Firstname != "" {
+				existingUser.Firstname = updateData.User.Firstname
+			}
+			if updateData.User.Lastname != "" {
+				existingUser.Lastname = updateData.User.Lastname
+			}
+			previousPhone := existingUser.PhoneNumber
+			if updateData.User.PhoneNumber != "" {
+				existingUser.PhoneNumber = updateData.User.PhoneNumber
+			}
+			if updateData.User.Gender != "" {
+				existingUser.Gender = updateData.User.Gender
+			}
+			if !updateData.User.PersianDate.IsZero() {
+				existingUser.PersianDate = updateData.User.PersianDate
+			}
+
+			// Validate the merged user together with any replacement addresses
+			candidate := existingUser
+			candidate.Addresses = updateData.Addresses
+			if errs = validation.ValidateUser(candidate); len(errs) > 0 {
+				return errInvalid
+			}
+
+			errs, warnings, err = checkPhone(ctx, tx.Users(), phonePolicy, existingUser, previousPhone)
+			if err != nil {
+				return err
+			}
+			if len(errs) > 0 {
+				return errInvalid
+			}
+
+			// Save the updated user
+			existingUser.Version++
+			if err := tx.Users().Update(ctx, &existingUser); err != nil {
+				return err
+			}
+
+			// Reconcile addresses by ID so existing addresses keep their IDs
+			if updateData.Addresses != nil {
+				removeMissing := updateData.ReplaceAddresses || r.URL.Query().Get("replace_addresses") == "true"
+				changes, errs, err = reconcileAddresses(ctx, tx.Addresses(), existingUser.ID, existingUser.Addresses, updateData.Addresses, removeMissing)
+				if err != nil {
+					return err
+				}
+				if len(errs) > 0 {
+					return errInvalid
+				}
+			}
+			return nil
+		})
+
+		if !writeUserTxError(w, r, store.Users(), userID, err, errs) {
+			return
+		}
+
+		// Fetch the updated user with addresses
+		updatedUser, err := store.Users().Get(ctx, userID)
+		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		// Update user fields
-		if updateData.User.Firstname != "" {
-			existingUser.Firstname = updateData.User.Firstname
+		// Return the updated user along with the address changes
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("ETag", etag(updatedUser.Version))
+		json.NewEncoder(w).Encode(EditUserResponse{User: updatedUser, AddressChanges: changes, Warnings: warnings})
+	}
+}
+
+// Media types accepted by PatchUser.
+const (
+	mergePatchMediaType = "application/merge-patch+json"
+	jsonPatchMediaType  = "application/json-patch+json"
+)
+
+// PatchUser handles partial updates of a user and its nested addresses.
+// The body is either an RFC 7396 JSON Merge Patch or an RFC 6902 JSON Patch
+// applied to the JSON representation of the user, selected by Content-Type.
+// The patched user is validated like a new submission and all changes are
+// written in a single transaction.
+func PatchUser(store repository.Store, phonePolicy validation.PhonePolicy) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		userID, err := pathID(r, "id")
+		if err != nil {
+			http.Error(w, "Invalid user ID", http.StatusBadRequest)
+			return
 		}
-		if updateData.User.Lastname != "" {
-			existingUser.Lastname = updateData.User.Lastname
+
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if mediaType != mergePatchMediaType && mediaType != jsonPatchMediaType && mediaType != "application/json" {
+			w.Header().Set("Accept-Patch", mergePatchMediaType+", "+jsonPatchMediaType)
+			http.Error(w, "Unsupported patch format", http.StatusUnsupportedMediaType)
+			return
 		}
-		if updateData.User.PhoneNumber != "" {
-			existingUser.PhoneNumber = updateData.User.PhoneNumber
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		bodyVersion, err := patchVersion(body, mediaType == jsonPatchMediaType)
+		if err != nil {
+			http.Error(w, "Invalid patch: "+err.Error(), http.StatusBadRequest)
+			return
 		}
-		if updateData.User.Gender != "" {
-			existingUser.Gender = updateData.User.Gender
+		expected, ok, err := expectedVersion(r, bodyVersion)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
-		if updateData.User.PersianDate != "" {
-			existingUser.PersianDate = updateData.User.PersianDate
+		if !ok {
+			writePreconditionRequired(w)
+			return
+		}
+
+		var errs, warnings validation.Errors
+		err = store.Transaction(ctx, func(tx repository.Store) error {
+			existingUser, err := tx.Users().GetForUpdate(ctx, userID)
+			if err != nil {
+				return err
+			}
+
+			if !versionMatches(expected, existingUser.Version) {
+				return errVersionConflict
+			}
+
+			original, err := json.Marshal(existingUser)
+			if err != nil {
+				return err
+			}
+
+			var patched []byte
+			if mediaType == jsonPatchMediaType {
+				patch, err := jsonpatch.DecodePatch(body)
+				if err != nil {
+					return &patchError{err}
+				}
+				patched, err = patch.Apply(original)
+				if err != nil {
+					return &patchError{err}
+				}
+			} else {
+				patched, err = jsonpatch.MergePatch(original, body)
+				if err != nil {
+					return &patchError{err}
+				}
+			}
+
+			// The patched document is the user itself, so its fields are
+			// named without a prefix
+			var updatedUser models.User
+			if err := json.Unmarshal(patched, &updatedUser); err != nil {
+				if decodeErrs, ok := validation.FromDecodeError(err, "persian_date"); ok {
+					errs = decodeErrs
+					return errInvalid
+				}
+				return &patchError{err}
+			}
+
+			// Identity and bookkeeping fields cannot be patched
+			updatedUser.ID = existingUser.ID
+			updatedUser.CreatedAt = existingUser.CreatedAt
+			updatedUser.DeletedAt = existingUser.DeletedAt
+			updatedUser.MergedIntoID = existingUser.MergedIntoID
+			updatedUser.Version = existingUser.Version + 1
+
+			if errs = validation.ValidateUser(updatedUser); len(errs) > 0 {
+				return errInvalid
+			}
+			errs, warnings, err = checkPhone(ctx, tx.Users(), phonePolicy, updatedUser, existingUser.PhoneNumber)
+			if err != nil {
+				return err
+			}
+			if len(errs) > 0 {
+				return errInvalid
+			}
+
+			if err := tx.Users().Update(ctx, &updatedUser); err != nil {
+				return err
+			}
+
+			_, errs, err = reconcileAddresses(ctx, tx.Addresses(), existingUser.ID, existingUser.Addresses, updatedUser.Addresses, true)
+			if err != nil {
+				return err
+			}
+			if len(errs) > 0 {
+				return errInvalid
+			}
+			return nil
+		})
+
+		if !writeUserTxError(w, r, store.Users(), userID, err, errs) {
+			return
 		}
 
-		// Save the updated user
-		if err := tx.Save(&existingUser).Error; err != nil {
-			tx.Rollback()
+		updatedUser, err := store.Users().Get(ctx, userID)
+		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		// Handle address updates
-		if len(updateData.Addresses) > 0 {
-			// Delete existing addresses
-			if err := tx.Where("user_id = ?", existingUser.ID).Delete(&models.Address{}).Error; err != nil {
-				tx.Rollback()
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("ETag", etag(updatedUser.Version))
+		json.NewEncoder(w).Encode(UserResponse{User: updatedUser, Warnings: warnings})
+	}
+}
+
+// writeUserTxError responds to the error of a user update transaction and
+// returns false, or returns true when there was none. A version conflict is
+// answered with the current user.
+func writeUserTxError(w http.ResponseWriter, r *http.Request, users repository.UserRepository, id uint, err error, errs validation.Errors) bool {
+	var pe *patchError
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, errVersionConflict):
+		current, err := users.Get(r.Context(), id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return false
+		}
+		writeVersionConflict(w, current.Version, current)
+	case errors.Is(err, errInvalid):
+		validation.WriteErrors(w, errs)
+	case errors.As(err, &pe):
+		http.Error(w, pe.Error(), http.StatusBadRequest)
+	case errors.Is(err, repository.ErrNotFound):
+		http.Error(w, "User not found", http.StatusNotFound)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+	return false
+}
+
+// checkPhone applies the phone uniqueness policy to user unless its number
+// is the same as previous once normalized, so that editing other fields of a
+// user who already shares a number is not blocked. The number stays locked
+// until the transaction of users ends, which must also write the user for
+// a rejection to hold.
+func checkPhone(ctx context.Context, users repository.UserRepository, policy validation.PhonePolicy, user models.User, previous string) (errs, warnings validation.Errors, err error) {
+	if previous != "" && phone.Normalize(user.PhoneNumber) == phone.Normalize(previous) {
+		return nil, nil, nil
+	}
+	if policy == validation.PhoneReject {
+		if err := users.LockPhones(ctx, []string{phone.Normalize(user.PhoneNumber)}); err != nil {
+			return nil, nil, err
+		}
+	}
+	return policy.Check(ctx, users, user)
+}
+
+// hidePhoneOwners leaves the user IDs out of duplicate phone errors unless
+// the caller may read users, so that the public form cannot be used to find
+// out who a number belongs to.
+func hidePhoneOwners(r *http.Request, errs validation.Errors) validation.Errors {
+	if claims, ok := auth.ClaimsFrom(r.Context()); ok && claims.HasPermission(auth.PermUsersRead) {
+		return errs
+	}
+	for i, fe := range errs {
+		if fe.Code == validation.CodeDuplicatePhone {
+			errs[i] = validation.DuplicatePhoneError(fe.Field, nil)
+		}
+	}
+	return errs
+}
+
+// patchVersion extracts the version a patch was based on: the top-level
+// "version" member of a merge patch, or a "test" operation on /version in a
+// JSON Patch. It returns 0 when the patch does not state one.
+func patchVersion(body []byte, isJSONPatch bool) (uint, error) {
+	if isJSONPatch {
+		var ops []struct {
+			Op    string          `json:"op"`
+			Path  string          `json:"path"`
+			Value json.RawMessage `json:"value"`
+		}
+		if err := json.Unmarshal(body, &ops); err != nil {
+			return 0, err
+		}
+		for _, op := range ops {
+			if op.Op == "test" && op.Path == "/version" {
+				var version uint
+				if err := json.Unmarshal(op.Value, &version); err != nil {
+					return 0, errors.New("version must be a positive integer")
+				}
+				return version, nil
+			}
+		}
+		return 0, nil
+	}
+
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return 0, err
+	}
+	raw, ok := doc["version"]
+	if !ok {
+		return 0, nil
+	}
+	var version uint
+	if err := json.Unmarshal(raw, &version); err != nil {
+		return 0, errors.New("version must be a positive integer")
+	}
+	return version, nil
+}
+
+// errInvalid aborts a write transaction when the result fails validation.
+// The validation errors are reported separately.
+var errInvalid = errors.New("invalid")
+
+// patchError wraps errors caused by a malformed or inapplicable patch.
+type patchError struct {
+	err error
+}
+
+func (e *patchError) Error() string {
+	return "Invalid patch: " + e.err.Error()
+}
+
+func (e *patchError) Unwrap() error {
+	return e.err
+}
+
+// DeleteUser handles soft-deleting a user together with its addresses
+func DeleteUser(store repository.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		userID, err := pathID(r, "id")
+		if err != nil {
+			http.Error(w, "Invalid user ID", http.StatusBadRequest)
+			return
+		}
+
+		expected, ok, err := expectedVersion(r, 0)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !ok {
+			writePreconditionRequired(w)
+			return
+		}
+
+		var user models.User
+		err = store.Transaction(ctx, func(tx repository.Store) error {
+			var err error
+			if user, err = tx.Users().GetForUpdate(ctx, userID); err != nil {
+				return err
+			}
+			if !versionMatches(expected, user.Version) {
+				return errVersionConflict
+			}
+			return tx.Users().Delete(ctx, &user)
+		})
+		if err != nil {
+			if errors.Is(err, errVersionConflict) {
+				writeVersionConflict(w, user.Version, user)
+				return
+			}
+			if errors.Is(err, repository.ErrNotFound) {
+				http.Error(w, "User not found", http.StatusNotFound)
 				return
 			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
 
-			// Add new addresses
-			for i := range updateData.Addresses {
-				updateData.Addresses[i].UserID = existingUser.ID
-				if err := tx.Create(&updateData.Addresses[i]).Error; err != nil {
-					tx.Rollback()
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return
-				}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// RestoreUser handles undoing a soft delete of a user and its addresses
+func RestoreUser(users repository.UserRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		userID, err := pathID(r, "id")
+		if err != nil {
+			http.Error(w, "Invalid user ID", http.StatusBadRequest)
+			return
+		}
+
+		user, err := users.GetIncludingDeleted(ctx, userID)
+		if err != nil {
+			if errors.Is(err, repository.ErrNotFound) {
+				http.Error(w, "User not found", http.StatusNotFound)
+				return
 			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !user.DeletedAt.Valid {
+			http.Error(w, "User is not deleted", http.StatusConflict)
+			return
 		}
 
-		// Commit the transaction
-		if err := tx.Commit().Error; err != nil {
-			tx.Rollback()
+		if err := users.Restore(ctx, user); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		// Fetch the updated user with addresses
-		var updatedUser models.User
-		if err := db.Preload("Addresses").First(&updatedUser, userId).Error; err != nil {
+		restoredUser, err := users.Get(ctx, user.ID)
+		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		// Return the updated user
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(updatedUser)
+		json.NewEncoder(w).Encode(restoredUser)
 	}
 }
 
-func GetUserStats(db *gorm.DB) http.HandlerFunc {
+// PurgeUser handles permanently removing a user and all of its addresses,
+// including soft-deleted rows
+func PurgeUser(users repository.UserRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := pathID(r, "id")
+		if err != nil {
+			http.Error(w, "Invalid user ID", http.StatusBadRequest)
+			return
+		}
+
+		if err := users.Purge(r.Context(), userID); err != nil {
+			if errors.Is(err, repository.ErrNotFound) {
+				http.Error(w, "User not found", http.StatusNotFound)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func GetUserStats(users repository.UserRepository) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var params UserStatsParams
 		decoder := schema.NewDecoder()
@@ -221,101 +779,352 @@ func GetUserStats(db *gorm.DB) http.HandlerFunc {
 			return
 		}
 
-		datePattern := fmt.Sprintf("%%%s%s%%", params.Year, params.Month)
+		period := jalali.NormalizeDigits(params.Year) + jalali.NormalizeDigits(params.Month)
 
-		var users []models.User
-		if err := db.Where("persian_date LIKE ?", datePattern).Find(&users).Error; err != nil {
+		matched, err := users.ListByDate(r.Context(), period)
+		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(users)
+		json.NewEncoder(w).Encode(matched)
 	}
 }
 
-func GetUsers(db *gorm.DB) http.HandlerFunc {
+// UserListResponse is the body returned by GetUsers.
+type UserListResponse struct {
+	Data []models.User `json:"data"`
+	Meta ListMeta      `json:"meta"`
+}
+
+// GetUsers handles listing users with pagination, filtering and sorting.
+// Addresses are only loaded when requested with include=addresses.
+func GetUsers(users repository.UserRepository) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		var users []models.User
+		params, err := parseUserListParams(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		query, err := userQuery(params)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 
-		// Remove the JOIN and just use Preload
-		result := db.
-			Preload("Addresses").
-			Find(&users)
+		size := params.Size()
+		meta := ListMeta{PageSize: size}
 
-		if result.Error != nil {
-			log.Printf("Error fetching users: %v", result.Error)
-			http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+		if params.CursorMode() {
+			if err := applyUserCursor(&query, params); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			// Fetch one extra row to find out whether another page exists
+			query.Limit = size + 1
+		} else {
+			meta.Page = params.PageNumber()
+			query.Offset = (meta.Page - 1) * size
+			query.Limit = size
+		}
+
+		list, total, err := users.List(r.Context(), query)
+		if err != nil {
+			log.Printf("Error fetching users: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		meta.Total = total
 
-		// Debug log
-		log.Printf("Found %d users", len(users))
-		for _, user := range users {
-			log.Printf("User ID: %d has %d addresses", user.ID, len(user.Addresses))
+		if params.CursorMode() && len(list) > size {
+			list = list[:size]
+			meta.NextCursor = encodeCursor(list[size-1].ID)
 		}
 
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(users)
+		json.NewEncoder(w).Encode(UserListResponse{Data: list, Meta: meta})
 	}
 }
 
-// GetUserById handles fetching a single user by ID
-func GetUserById(db *gorm.DB) http.HandlerFunc {
+// SearchParams holds the query parameters accepted by SearchUsers.
+type SearchParams struct {
+	Q     string `schema:"q"`
+	Limit int    `schema:"limit"`
+}
+
+// SearchResponse is the body returned by SearchUsers.
+type SearchResponse struct {
+	Data []search.Result `json:"data"`
+	Meta ListMeta        `json:"meta"`
+}
+
+// SearchUsers handles ranked lookup of users by name, phone or address text
+func SearchUsers(users repository.UserRepository) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		vars := mux.Vars(r)
-		userId := vars["id"]
+		var params SearchParams
+		decoder := schema.NewDecoder()
+		if err := decoder.Decode(&params, r.URL.Query()); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if strings.TrimSpace(params.Q) == "" {
+			http.Error(w, "q is required", http.StatusBadRequest)
+			return
+		}
+		if params.Limit <= 0 {
+			params.Limit = defaultPageSize
+		}
+		if params.Limit > maxPageSize {
+			params.Limit = maxPageSize
+		}
 
-		var user models.User
+		results, err := users.Search(r.Context(), params.Q, params.Limit)
+		if err != nil {
+			log.Printf("Error searching users: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
 
-		// Just use Preload without JOIN
-		result := db.
-			Preload("Addresses").
-			First(&user, userId)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(SearchResponse{
+			Data: results,
+			Meta: ListMeta{Total: int64(len(results)), PageSize: params.Limit},
+		})
+	}
+}
 
-		if result.Error != nil {
-			if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+// HistoryResponse is the body returned by GetUserHistory.
+type HistoryResponse struct {
+	Data []audit.Entry `json:"data"`
+	Meta ListMeta      `json:"meta"`
+}
+
+// GetUserHistory handles listing the audit trail of a user and its addresses
+func GetUserHistory(users repository.UserRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := pathID(r, "id")
+		if err != nil {
+			http.Error(w, "Invalid user ID", http.StatusBadRequest)
+			return
+		}
+
+		params, err := parseUserListParams(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		page := params.PageNumber()
+		size := params.Size()
+
+		entries, total, err := users.History(r.Context(), id, (page-1)*size, size)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(HistoryResponse{
+			Data: entries,
+			Meta: ListMeta{Total: total, Page: page, PageSize: size},
+		})
+	}
+}
+
+// maxImportSize caps the size of an uploaded spreadsheet.
+const maxImportSize = 32 << 20
+
+// ImportParams holds the form values accepted by ImportUsers besides the file.
+type ImportParams struct {
+	Format    string `schema:"format"`
+	Mapping   string `schema:"mapping"`
+	DryRun    bool   `schema:"dry_run"`
+	Mode      string `schema:"mode"`
+	BatchSize int    `schema:"batch_size"`
+}
+
+// ImportUsers handles bulk creation of users from an uploaded CSV or XLSX
+// file. With dry_run every row is validated and reported without writing.
+func ImportUsers(store repository.Store, phonePolicy validation.PhonePolicy) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, maxImportSize)
+		if err := r.ParseMultipartForm(maxImportSize); err != nil {
+			http.Error(w, "Invalid multipart form: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var params ImportParams
+		decoder := schema.NewDecoder()
+		decoder.IgnoreUnknownKeys(true)
+		if err := decoder.Decode(&params, r.Form); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		file, header, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, "file is required", http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+
+		format, err := importer.DetectFormat(params.Format, header.Filename)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		opts := importer.Options{DryRun: params.DryRun, Mode: params.Mode, BatchSize: params.BatchSize, PhonePolicy: phonePolicy}
+		if params.Mapping != "" {
+			if err := json.Unmarshal([]byte(params.Mapping), &opts.Mapping); err != nil {
+				http.Error(w, "mapping must be a JSON object of column to field", http.StatusBadRequest)
+				return
+			}
+		}
+		if err := opts.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		rows, err := importer.ReadRows(file, format)
+		if err != nil {
+			http.Error(w, "Could not read spreadsheet: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		parsed, err := importer.ParseRows(rows, opts.Mapping)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		report, err := importer.Run(r.Context(), store, parsed, opts)
+		if err != nil {
+			log.Printf("Error importing users: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		status := http.StatusOK
+		switch {
+		case report.DryRun:
+		case opts.Mode == importer.ModeAllOrNothing && report.InvalidRows > 0:
+			status = http.StatusUnprocessableEntity
+		case report.Inserted > 0:
+			status = http.StatusCreated
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(report)
+	}
+}
+
+// ExportUsers handles streaming every user that matches the listing
+// filters as CSV, JSON Lines or XLSX. The addresses parameter picks how
+// addresses are flattened in tabular formats.
+func ExportUsers(users repository.UserRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+
+		opts := exporter.Options{Format: query.Get("format"), Addresses: query.Get("addresses")}
+		if opts.Format == "" {
+			opts.Format = exporter.FormatCSV
+		}
+		if err := opts.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		params, err := parseUserListParams(query)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		q, err := userQuery(params)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		contentType, extension := exporter.ContentType(opts.Format)
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="users-%s.%s"`, time.Now().Format("20060102-150405"), extension))
+
+		// Large exports outlast the server's write timeout, which would cut
+		// the file off without the client noticing
+		if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+			log.Printf("Export may be cut off by the write timeout: %v", err)
+		}
+
+		// Headers are already sent once streaming starts, so failures can
+		// only be logged
+		if err := exporter.Export(r.Context(), w, users, q, opts); err != nil {
+			log.Printf("Error exporting users: %v", err)
+		}
+	}
+}
+
+// GetUserById handles fetching a single user by ID
+func GetUserById(users repository.UserRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := pathID(r, "id")
+		if err != nil {
+			http.Error(w, "Invalid user ID", http.StatusBadRequest)
+			return
+		}
+
+		user, err := users.Get(r.Context(), userID)
+		if err != nil {
+			if errors.Is(err, repository.ErrNotFound) {
 				http.Error(w, "User not found", http.StatusNotFound)
 				return
 			}
-			log.Printf("Error fetching user: %v", result.Error)
-			http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+			log.Printf("Error fetching user: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
 		// Debug log
 		log.Printf("User ID: %d has %d addresses", user.ID, len(user.Addresses))
 
+		tag := etag(user.Version)
+		w.Header().Set("ETag", tag)
+		if r.Header.Get("If-None-Match") == tag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(user)
 	}
 }
 
 // GetUserAddresses handles fetching addresses for a specific user
-func GetUserAddresses(db *gorm.DB) http.HandlerFunc {
+func GetUserAddresses(addresses repository.AddressRepository) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		vars := mux.Vars(r)
-		userId := vars["id"]
+		userID, err := pathID(r, "id")
+		if err != nil {
+			http.Error(w, "Invalid user ID", http.StatusBadRequest)
+			return
+		}
 
-		var addresses []models.Address
-		if err := db.Where("user_id = ?", userId).Find(&addresses).Error; err != nil {
+		list, err := addresses.ListByUser(r.Context(), userID)
+		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(addresses)
+		json.NewEncoder(w).Encode(list)
 	}
 }
 
 // AddUserAddress handles adding a new address for a user
-func AddUserAddress(db *gorm.DB) http.HandlerFunc {
+func AddUserAddress(store repository.Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		vars := mux.Vars(r)
-		userId := vars["id"]
-
-		// Convert string ID to uint
-		id, err := strconv.ParseUint(userId, 10, 32)
+		ctx := r.Context()
+		userID, err := pathID(r, "id")
 		if err != nil {
 			http.Error(w, "Invalid user ID", http.StatusBadRequest)
 			return
@@ -323,31 +1132,46 @@ func AddUserAddress(db *gorm.DB) http.HandlerFunc {
 
 		var address models.Address
 		if err := json.NewDecoder(r.Body).Decode(&address); err != nil {
+			if errs, ok := validation.FromDecodeError(err, ""); ok {
+				validation.WriteErrors(w, errs)
+				return
+			}
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
+		if errs := validation.ValidateAddress(address); len(errs) > 0 {
+			validation.WriteErrors(w, errs)
+			return
+		}
+
 		// Verify user exists
-		var user models.User
-		if err := db.First(&user, id).Error; err != nil {
+		if _, err := store.Users().Get(ctx, userID); err != nil {
 			http.Error(w, "User not found", http.StatusNotFound)
 			return
 		}
 
-		address.UserID = uint(id)
-		if err := db.Create(&address).Error; err != nil {
+		address.UserID = userID
+		if err := store.Addresses().Create(ctx, &address); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
 		// Verify address was created
-		var createdAddress models.Address
-		if err := db.First(&createdAddress, address.ID).Error; err != nil {
+		createdAddress, err := store.Addresses().Get(ctx, userID, address.ID)
+		if err != nil {
 			http.Error(w, "Failed to verify address creation", http.StatusInternalServerError)
 			return
 		}
 
+		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusCreated)
 		json.NewEncoder(w).Encode(createdAddress)
 	}
 }
+
+// pathID parses the named ID path variable.
+func pathID(r *http.Request, name string) (uint, error) {
+	id, err := strconv.ParseUint(mux.Vars(r)[name], 10, 32)
+	return uint(id), err
+}
@@ -0,0 +1,336 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	"back-forms/auth"
+	"back-forms/config"
+	"back-forms/database"
+	"back-forms/migrations"
+	"back-forms/user-service/models"
+	"back-forms/user-service/repository"
+	"back-forms/user-service/validation"
+)
+
+// newSQLStore returns a SQL store on a migrated SQLite database.
+func newSQLStore(t *testing.T) *repository.SQL {
+	t.Helper()
+	db, err := database.Open(config.Database{
+		Driver: config.DriverSQLite,
+		Path:   filepath.Join(t.TempDir(), "users.db"),
+	}, config.NewLevelVar("error"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+
+	m, err := migrations.New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Up(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return repository.NewSQL(db)
+}
+
+const userJSON = `{"firstname":"Sara","lastname":"Ahmadi","phone_number":"09121234567","gender":"Female","persian_date":"1370-05-12"}`
+
+func TestSubmitUserRejectsConcurrentDuplicates(t *testing.T) {
+	stores := map[string]repository.Store{
+		"sql":    newSQLStore(t),
+		"memory": repository.NewMemory(),
+	}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			handler := SubmitUser(store, validation.PhoneReject)
+
+			const submissions = 8
+			var wg sync.WaitGroup
+			statuses := make(chan int, submissions)
+			for i := 0; i < submissions; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					rec := httptest.NewRecorder()
+					handler(rec, httptest.NewRequest(http.MethodPost, "/api/users", strings.NewReader(userJSON)))
+					statuses <- rec.Code
+				}()
+			}
+			wg.Wait()
+			close(statuses)
+
+			counts := map[int]int{}
+			for status := range statuses {
+				counts[status]++
+			}
+			if counts[http.StatusCreated] != 1 || counts[http.StatusUnprocessableEntity] != submissions-1 {
+				t.Fatalf("statuses = %v, want one 201 and %d 422", counts, submissions-1)
+			}
+		})
+	}
+}
+
+// newRouter routes the user handlers like the service does, without
+// authentication.
+func newRouter(store repository.Store) *mux.Router {
+	router := mux.NewRouter()
+	router.HandleFunc("/api/users", GetUsers(store.Users())).Methods("GET")
+	router.HandleFunc("/api/users", SubmitUser(store, validation.PhoneReject)).Methods("POST")
+	router.HandleFunc("/api/users/export", ExportUsers(store.Users())).Methods("GET")
+	router.HandleFunc("/api/users/{id}", GetUserById(store.Users())).Methods("GET")
+	router.HandleFunc("/api/users/{id}", EditUser(store, validation.PhoneReject)).Methods("PUT")
+	router.HandleFunc("/api/users/{id}", PatchUser(store, validation.PhoneReject)).Methods("PATCH")
+	router.HandleFunc("/api/users/{id}", DeleteUser(store)).Methods("DELETE")
+	router.HandleFunc("/api/users/{id}/restore", RestoreUser(store.Users())).Methods("POST")
+	return router
+}
+
+// serve sends a request to h. header holds name and value pairs.
+func serve(h http.Handler, method, target, body string, header ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	return rec
+}
+
+func decode[T any](t *testing.T, rec *httptest.ResponseRecorder) T {
+	t.Helper()
+	var v T
+	if err := json.Unmarshal(rec.Body.Bytes(), &v); err != nil {
+		t.Fatalf("decoding %q: %v", rec.Body.String(), err)
+	}
+	return v
+}
+
+// createUser submits a user with one address and returns it.
+func createUser(t *testing.T, h http.Handler, firstname, phone, gender, date string) models.User {
+	t.Helper()
+	body := fmt.Sprintf(`{"firstname":%q,"lastname":"Ahmadi","phone_number":%q,"gender":%q,"persian_date":%q,"addresses":[{"subject":"Home","details":"Valiasr St"}]}`, firstname, phone, gender, date)
+	rec := serve(h, http.MethodPost, "/api/users", body)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("creating %s: status %d: %s", firstname, rec.Code, rec.Body)
+	}
+	return decode[UserResponse](t, rec).User
+}
+
+func TestCreateUser(t *testing.T) {
+	h := newRouter(repository.NewMemory())
+
+	created := createUser(t, h, "Sara", "0912 123 4567", "Female", "1370-05-12")
+	if created.ID == 0 || created.Version != 1 || created.PhoneNumber != "+989121234567" || len(created.Addresses) != 1 {
+		t.Fatalf("created user = %+v", created)
+	}
+
+	rec := serve(h, http.MethodGet, fmt.Sprintf("/api/users/%d", created.ID), "")
+	if rec.Code != http.StatusOK || rec.Header().Get("ETag") != `"1"` {
+		t.Fatalf("GET: status %d, ETag %q", rec.Code, rec.Header().Get("ETag"))
+	}
+	if got := decode[models.User](t, rec); got.Firstname != "Sara" || len(got.Addresses) != 1 {
+		t.Fatalf("GET returned %+v", got)
+	}
+
+	rec = serve(h, http.MethodPost, "/api/users", `{"firstname":"","lastname":"Ahmadi","phone_number":"12","gender":"Other","persian_date":"1370-05-12"}`)
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("invalid user: status %d", rec.Code)
+	}
+	fields := map[string]bool{}
+	for _, fe := range decode[validation.Response](t, rec).Errors {
+		fields[fe.Field] = true
+	}
+	if !fields["firstname"] || !fields["phone_number"] || !fields["gender"] {
+		t.Fatalf("invalid user: errors %s", rec.Body)
+	}
+
+	duplicate := `{"firstname":"Sima","lastname":"Ahmadi","phone_number":"+989121234567","gender":"Female","persian_date":"1371-01-01"}`
+	rec = serve(h, http.MethodPost, "/api/users", duplicate)
+	if rec.Code != http.StatusUnprocessableEntity || !strings.Contains(rec.Body.String(), validation.CodeDuplicatePhone) {
+		t.Fatalf("duplicate phone: status %d: %s", rec.Code, rec.Body)
+	}
+	owner := fmt.Sprintf("user %d", created.ID)
+	if strings.Contains(rec.Body.String(), owner) {
+		t.Fatalf("duplicate phone named the owner to an anonymous caller: %s", rec.Body)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/api/users", strings.NewReader(duplicate))
+	r = r.WithContext(auth.WithClaims(r.Context(), &auth.Claims{Permissions: []string{auth.PermUsersRead}}))
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	if rec.Code != http.StatusUnprocessableEntity || !strings.Contains(rec.Body.String(), owner) {
+		t.Fatalf("duplicate phone for an operator: status %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestListUsersFilters(t *testing.T) {
+	h := newRouter(repository.NewMemory())
+	createUser(t, h, "Sara", "09121234567", "Female", "1370-05-12")
+	createUser(t, h, "Ali", "09351234567", "Male", "1365-01-20")
+	createUser(t, h, "Reza", "02188776655", "Male", "1380-11-02")
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{"Sara", "Ali", "Reza"}},
+		{"gender=Male", []string{"Ali", "Reza"}},
+		{"name=al", []string{"Ali"}},
+		{"phone=%2B98935", []string{"Ali"}},
+		{"date_from=1366-01-01&date_to=1375-12-29", []string{"Sara"}},
+		{"gender=Male&sort=-persian_date", []string{"Reza", "Ali"}},
+		{"page_size=2&page=2", []string{"Reza"}},
+	}
+	for _, tt := range tests {
+		rec := serve(h, http.MethodGet, "/api/users?"+tt.query, "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%q: status %d: %s", tt.query, rec.Code, rec.Body)
+		}
+		var got []string
+		for _, user := range decode[UserListResponse](t, rec).Data {
+			got = append(got, user.Firstname)
+		}
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("%q: got %v, want %v", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestPatchUser(t *testing.T) {
+	h := newRouter(repository.NewMemory())
+	user := createUser(t, h, "Sara", "09121234567", "Female", "1370-05-12")
+	target := fmt.Sprintf("/api/users/%d", user.ID)
+
+	rec := serve(h, http.MethodPatch, target, `{"firstname":"Sima"}`, "Content-Type", mergePatchMediaType)
+	if rec.Code != http.StatusPreconditionRequired {
+		t.Fatalf("without a version: status %d", rec.Code)
+	}
+
+	rec = serve(h, http.MethodPatch, target, `{"firstname":"Sima"}`, "Content-Type", mergePatchMediaType, "If-Match", `"1"`)
+	if rec.Code != http.StatusOK || rec.Header().Get("ETag") != `"2"` {
+		t.Fatalf("merge patch: status %d, ETag %q: %s", rec.Code, rec.Header().Get("ETag"), rec.Body)
+	}
+	if got := decode[UserResponse](t, rec); got.Firstname != "Sima" || got.Lastname != "Ahmadi" || got.Version != 2 || len(got.Addresses) != 1 {
+		t.Fatalf("merge patch returned %+v", got)
+	}
+
+	rec = serve(h, http.MethodPatch, target, `[{"op":"replace","path":"/lastname","value":"Karimi"}]`, "Content-Type", jsonPatchMediaType, "If-Match", `"1"`)
+	if rec.Code != http.StatusPreconditionFailed || rec.Header().Get("ETag") != `"2"` {
+		t.Fatalf("stale If-Match: status %d, ETag %q", rec.Code, rec.Header().Get("ETag"))
+	}
+	if got := decode[models.User](t, rec); got.Firstname != "Sima" {
+		t.Fatalf("412 returned %+v, want the current user", got)
+	}
+
+	rec = serve(h, http.MethodPatch, target, `[{"op":"replace","path":"/lastname","value":"Karimi"}]`, "Content-Type", jsonPatchMediaType, "If-Match", `"2"`)
+	if rec.Code != http.StatusOK || decode[UserResponse](t, rec).Lastname != "Karimi" {
+		t.Fatalf("JSON patch: status %d: %s", rec.Code, rec.Body)
+	}
+
+	rec = serve(h, http.MethodPatch, target, `{"persian_date":"1370-13-40"}`, "Content-Type", mergePatchMediaType, "If-Match", "*")
+	if rec.Code != http.StatusUnprocessableEntity || !strings.Contains(rec.Body.String(), `"persian_date"`) {
+		t.Fatalf("invalid date: status %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestMergeCannotBeWritten(t *testing.T) {
+	h := newRouter(repository.NewMemory())
+	other := createUser(t, h, "Sara", "09121234567", "Female", "1370-05-12")
+
+	rec := serve(h, http.MethodPost, "/api/users", fmt.Sprintf(`{"firstname":"Ali","lastname":"Karimi","phone_number":"09351234567","gender":"Male","persian_date":"1365-01-20","merged_into_id":%d}`, other.ID))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create: status %d: %s", rec.Code, rec.Body)
+	}
+	user := decode[UserResponse](t, rec).User
+	if user.MergedIntoID != nil {
+		t.Fatalf("create stored merged_into_id %d", *user.MergedIntoID)
+	}
+	target := fmt.Sprintf("/api/users/%d", user.ID)
+
+	rec = serve(h, http.MethodPatch, target, fmt.Sprintf(`{"merged_into_id":%d}`, other.ID), "Content-Type", mergePatchMediaType, "If-Match", "*")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("patch: status %d: %s", rec.Code, rec.Body)
+	}
+	rec = serve(h, http.MethodPut, target, fmt.Sprintf(`{"user":{"firstname":"Reza","merged_into_id":%d}}`, other.ID), "If-Match", "*")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("put: status %d: %s", rec.Code, rec.Body)
+	}
+	if got := decode[models.User](t, serve(h, http.MethodGet, target, "")); got.Firstname != "Reza" || got.MergedIntoID != nil {
+		t.Fatalf("user after patch and put = %+v", got)
+	}
+}
+
+func TestDeleteAndRestoreUser(t *testing.T) {
+	h := newRouter(repository.NewMemory())
+	user := createUser(t, h, "Sara", "09121234567", "Female", "1370-05-12")
+	target := fmt.Sprintf("/api/users/%d", user.ID)
+
+	if rec := serve(h, http.MethodDelete, target, ""); rec.Code != http.StatusPreconditionRequired {
+		t.Fatalf("without If-Match: status %d", rec.Code)
+	}
+	if rec := serve(h, http.MethodDelete, target, "", "If-Match", `"7"`); rec.Code != http.StatusPreconditionFailed || rec.Header().Get("ETag") != `"1"` {
+		t.Fatalf("stale If-Match: status %d, ETag %q", rec.Code, rec.Header().Get("ETag"))
+	}
+	if rec := serve(h, http.MethodDelete, target, "", "If-Match", `"1"`); rec.Code != http.StatusNoContent {
+		t.Fatalf("delete: status %d: %s", rec.Code, rec.Body)
+	}
+
+	if rec := serve(h, http.MethodGet, target, ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("GET after delete: status %d", rec.Code)
+	}
+	if total := decode[UserListResponse](t, serve(h, http.MethodGet, "/api/users", "")).Meta.Total; total != 0 {
+		t.Fatalf("listed %d users after delete", total)
+	}
+	if total := decode[UserListResponse](t, serve(h, http.MethodGet, "/api/users?include_deleted=true", "")).Meta.Total; total != 1 {
+		t.Fatalf("listed %d users with include_deleted", total)
+	}
+
+	rec := serve(h, http.MethodPost, target+"/restore", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("restore: status %d: %s", rec.Code, rec.Body)
+	}
+	if got := decode[models.User](t, rec); got.DeletedAt.Valid || len(got.Addresses) != 1 {
+		t.Fatalf("restored user = %+v", got)
+	}
+	if rec := serve(h, http.MethodPost, target+"/restore", ""); rec.Code != http.StatusConflict {
+		t.Fatalf("restoring a live user: status %d", rec.Code)
+	}
+}
+
+func TestExportUsers(t *testing.T) {
+	stores := map[string]repository.Store{
+		"sql":    newSQLStore(t),
+		"memory": repository.NewMemory(),
+	}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			h := newRouter(store)
+			createUser(t, h, "Sara", "09121234567", "Female", "1370-05-12")
+			createUser(t, h, "=Ali", "09351234567", "Male", "1365-01-20")
+
+			rec := serve(h, http.MethodGet, "/api/users/export?format=csv&addresses=columns&gender=Male", "")
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", rec.Code, rec.Body)
+			}
+			body := rec.Body.String()
+			if strings.Contains(body, "Sara") || !strings.Contains(body, "'=Ali") || !strings.Contains(body, "Valiasr St") {
+				t.Fatalf("export:\n%s", body)
+			}
+		})
+	}
+}
@@ -0,0 +1,205 @@
+package controllers
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/schema"
+
+	"back-forms/jalali"
+	"back-forms/phone"
+	"back-forms/user-service/repository"
+)
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+// sortableUserColumns maps the sort keys accepted by the API to columns.
+var sortableUserColumns = map[string]string{
+	"id":           "id",
+	"firstname":    "firstname",
+	"lastname":     "lastname",
+	"phone_number": "phone_number",
+	"gender":       "gender",
+	"persian_date": "persian_date",
+	"created_at":   "created_at",
+}
+
+// UserListParams holds the query parameters accepted by the user listing
+// endpoints. Use either page/page_size or limit/cursor.
+type UserListParams struct {
+	Page     int    `schema:"page"`
+	PageSize int    `schema:"page_size"`
+	Limit    int    `schema:"limit"`
+	Cursor   string `schema:"cursor"`
+	Gender   string `schema:"gender"`
+	DateFrom string `schema:"date_from"`
+	DateTo   string `schema:"date_to"`
+	Name     string `schema:"name"`
+	Phone    string `schema:"phone"`
+	Sort     string `schema:"sort"`
+	Include  string `schema:"include"`
+	// IncludeDeleted also returns soft-deleted users
+	IncludeDeleted bool `schema:"include_deleted"`
+}
+
+// ListMeta describes the page of results returned by a listing endpoint.
+type ListMeta struct {
+	Total      int64  `json:"total"`
+	Page       int    `json:"page,omitempty"`
+	PageSize   int    `json:"page_size"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// parseUserListParams decodes and validates the listing query parameters.
+func parseUserListParams(query url.Values) (UserListParams, error) {
+	var params UserListParams
+	decoder := schema.NewDecoder()
+	decoder.IgnoreUnknownKeys(true)
+	if err := decoder.Decode(&params, query); err != nil {
+		return params, err
+	}
+
+	if params.Page < 0 || params.PageSize < 0 || params.Limit < 0 {
+		return params, errors.New("page, page_size and limit must not be negative")
+	}
+	if params.CursorMode() && params.Page > 0 {
+		return params, errors.New("page cannot be combined with limit or cursor")
+	}
+	if params.PageSize > maxPageSize || params.Limit > maxPageSize {
+		return params, fmt.Errorf("page_size and limit must be at most %d", maxPageSize)
+	}
+	return params, nil
+}
+
+// CursorMode reports whether keyset pagination was requested.
+func (p UserListParams) CursorMode() bool {
+	return p.Limit > 0 || p.Cursor != ""
+}
+
+// Size returns the number of rows per page.
+func (p UserListParams) Size() int {
+	switch {
+	case p.CursorMode() && p.Limit > 0:
+		return p.Limit
+	case !p.CursorMode() && p.PageSize > 0:
+		return p.PageSize
+	default:
+		return defaultPageSize
+	}
+}
+
+// PageNumber returns the 1-based page number for offset pagination.
+func (p UserListParams) PageNumber() int {
+	if p.Page < 1 {
+		return 1
+	}
+	return p.Page
+}
+
+// Includes reports whether the named relation was requested via include.
+func (p UserListParams) Includes(relation string) bool {
+	for _, inc := range strings.Split(p.Include, ",") {
+		if strings.TrimSpace(inc) == relation {
+			return true
+		}
+	}
+	return false
+}
+
+// userQuery converts the filter and sort parameters into a repository
+// query. Soft-deleted users are only included when include_deleted is set.
+// Paging is left to the caller.
+func userQuery(params UserListParams) (repository.UserQuery, error) {
+	q := repository.UserQuery{
+		Gender:         params.Gender,
+		Name:           params.Name,
+		IncludeDeleted: params.IncludeDeleted,
+		WithAddresses:  params.Includes("addresses"),
+	}
+	if params.DateFrom != "" {
+		from, err := jalali.Parse(params.DateFrom)
+		if err != nil {
+			return q, fmt.Errorf("date_from: %w", err)
+		}
+		q.DateFrom = from
+	}
+	if params.DateTo != "" {
+		to, err := jalali.Parse(params.DateTo)
+		if err != nil {
+			return q, fmt.Errorf("date_to: %w", err)
+		}
+		q.DateTo = to
+	}
+	if params.Phone != "" {
+		// Numbers are stored in E.164, so 0912... is matched as +98912...
+		q.PhonePrefix = phone.NormalizePrefix(params.Phone)
+	}
+
+	sort, err := userSort(params.Sort)
+	if err != nil {
+		return q, err
+	}
+	q.Sort = sort
+	return q, nil
+}
+
+// userSort converts a sort parameter such as "lastname,-created_at" into
+// sort fields. The repository appends id as a tiebreaker.
+func userSort(sort string) ([]repository.SortField, error) {
+	var fields []repository.SortField
+	for _, field := range strings.Split(sort, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		desc := strings.HasPrefix(field, "-")
+		field = strings.TrimPrefix(field, "-")
+		column, ok := sortableUserColumns[field]
+		if !ok {
+			return nil, fmt.Errorf("cannot sort by %q", field)
+		}
+		fields = append(fields, repository.SortField{Column: column, Desc: desc})
+	}
+	return fields, nil
+}
+
+// applyUserCursor restricts q to rows after the cursor. Cursors are only
+// supported when sorting by id.
+func applyUserCursor(q *repository.UserQuery, params UserListParams) error {
+	sort := strings.TrimSpace(params.Sort)
+	if sort != "" && sort != "id" && sort != "-id" {
+		return errors.New("cursor pagination only supports sort=id or sort=-id")
+	}
+	if params.Cursor == "" {
+		return nil
+	}
+	id, err := decodeCursor(params.Cursor)
+	if err != nil {
+		return err
+	}
+	q.After = uint(id)
+	return nil
+}
+
+func encodeCursor(id uint) string {
+	return base64.RawURLEncoding.EncodeToString([]byte("id:" + strconv.FormatUint(uint64(id), 10)))
+}
+
+func decodeCursor(cursor string) (uint64, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || !strings.HasPrefix(string(raw), "id:") {
+		return 0, errors.New("invalid cursor")
+	}
+	id, err := strconv.ParseUint(strings.TrimPrefix(string(raw), "id:"), 10, 64)
+	if err != nil {
+		return 0, errors.New("invalid cursor")
+	}
+	return id, nil
+}
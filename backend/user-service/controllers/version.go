@@ -0,0 +1,68 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"back-forms/user-service/repository"
+)
+
+// errVersionConflict aborts a write whose expected version is stale. It is
+// the repository's error so that both are handled alike.
+var errVersionConflict = repository.ErrVersionConflict
+
+// maxDeleteAttempts bounds the retries of a delete with a wildcard If-Match
+// that keeps losing to concurrent updates.
+const maxDeleteAttempts = 3
+
+// etag formats a row version as a strong entity tag.
+func etag(version uint) string {
+	return fmt.Sprintf(`"%d"`, version)
+}
+
+// expectedVersion returns the version the client based its write on, taken
+// from the If-Match header or, failing that, from bodyVersion. A wildcard
+// If-Match is reported as version 0. The second result is false when the
+// client sent neither.
+func expectedVersion(r *http.Request, bodyVersion uint) (uint, bool, error) {
+	header := strings.TrimSpace(r.Header.Get("If-Match"))
+	if header == "" {
+		return bodyVersion, bodyVersion > 0, nil
+	}
+	if header == "*" {
+		return 0, true, nil
+	}
+
+	// Only a single entity tag is meaningful for a single row
+	tag := strings.TrimSpace(strings.Split(header, ",")[0])
+	tag = strings.TrimPrefix(tag, "W/")
+	version, err := strconv.ParseUint(strings.Trim(tag, `"`), 10, 64)
+	if err != nil || version == 0 {
+		return 0, false, fmt.Errorf("invalid If-Match header %q", header)
+	}
+	return uint(version), true, nil
+}
+
+// versionMatches reports whether the stored version satisfies the expected
+// one. A zero expectation matches any version.
+func versionMatches(expected, stored uint) bool {
+	return expected == 0 || expected == stored
+}
+
+// writePreconditionRequired rejects an update that did not say which
+// version it was based on.
+func writePreconditionRequired(w http.ResponseWriter) {
+	http.Error(w, "If-Match header or version field is required", http.StatusPreconditionRequired)
+}
+
+// writeVersionConflict responds with 412 and the current representation so
+// the client can merge and retry.
+func writeVersionConflict(w http.ResponseWriter, version uint, current interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", etag(version))
+	w.WriteHeader(http.StatusPreconditionFailed)
+	json.NewEncoder(w).Encode(current)
+}
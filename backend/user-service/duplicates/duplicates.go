@@ -0,0 +1,233 @@
+// Package duplicates finds users that are likely the same person submitted
+// more than once and scores each candidate pair.
+package duplicates
+
+import (
+	"sort"
+	"strings"
+
+	"gorm.io/gorm"
+
+	"back-forms/persian"
+	"back-forms/phone"
+	"back-forms/user-service/models"
+)
+
+// DefaultMinScore is the lowest score reported when none is requested.
+const DefaultMinScore = 0.5
+
+// Signal weights. A pair sharing a phone number, an identical name and an
+// address scores 1.
+const (
+	phoneWeight   = 0.45
+	nameWeight    = 0.40
+	addressWeight = 0.15
+)
+
+// maxBlockSize skips blocking keys shared by so many users, such as a very
+// common first name, that comparing every pair would be too slow and would
+// mostly produce noise.
+const maxBlockSize = 200
+
+// Signals explains how a pair was scored.
+type Signals struct {
+	SamePhone       bool    `json:"same_phone"`
+	NameSimilarity  float64 `json:"name_similarity"`
+	SharedAddresses int     `json:"shared_addresses"`
+}
+
+// Candidate is a pair of users that may be duplicates. Users are ordered by
+// ID.
+type Candidate struct {
+	Users   [2]models.User `json:"users"`
+	Score   float64        `json:"score"`
+	Signals Signals        `json:"signals"`
+}
+
+// Options narrows a search.
+type Options struct {
+	// MinScore drops pairs scoring below it.
+	MinScore float64
+	// UserID, when set, only returns pairs involving that user.
+	UserID uint
+}
+
+// profile holds the normalized values a user is compared on.
+type profile struct {
+	user      models.User
+	phone     string
+	name      string
+	bigrams   map[string]int
+	addresses []addressKey
+}
+
+type addressKey struct {
+	postalCode string
+	details    string
+}
+
+// Find scores every pair of live users that share a phone number, a name
+// token or an address and returns those scoring at least opts.MinScore,
+// best first.
+func Find(db *gorm.DB, opts Options) ([]Candidate, error) {
+	if opts.MinScore <= 0 {
+		opts.MinScore = DefaultMinScore
+	}
+
+	var users []models.User
+	if err := db.Preload("Addresses").Order("id").Find(&users).Error; err != nil {
+		return nil, err
+	}
+
+	profiles := make([]profile, len(users))
+	blocks := map[string][]int{}
+	for i, user := range users {
+		profiles[i] = newProfile(user)
+		for _, key := range blockingKeys(profiles[i]) {
+			blocks[key] = append(blocks[key], i)
+		}
+	}
+
+	type pair struct{ a, b int }
+	seen := map[pair]bool{}
+	candidates := []Candidate{}
+	for _, members := range blocks {
+		if len(members) < 2 || len(members) > maxBlockSize {
+			continue
+		}
+		for x := 0; x < len(members); x++ {
+			for y := x + 1; y < len(members); y++ {
+				p := pair{members[x], members[y]}
+				if seen[p] {
+					continue
+				}
+				seen[p] = true
+
+				a, b := profiles[p.a], profiles[p.b]
+				if opts.UserID != 0 && a.user.ID != opts.UserID && b.user.ID != opts.UserID {
+					continue
+				}
+				signals := compare(a, b)
+				score := Score(signals)
+				if score < opts.MinScore {
+					continue
+				}
+				candidates = append(candidates, Candidate{
+					Users:   [2]models.User{a.user, b.user},
+					Score:   score,
+					Signals: signals,
+				})
+			}
+		}
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		ci, cj := candidates[i], candidates[j]
+		if ci.Score != cj.Score {
+			return ci.Score > cj.Score
+		}
+		if ci.Users[0].ID != cj.Users[0].ID {
+			return ci.Users[0].ID < cj.Users[0].ID
+		}
+		return ci.Users[1].ID < cj.Users[1].ID
+	})
+	return candidates, nil
+}
+
+// Score combines the signals of a pair into a value between 0 and 1.
+func Score(s Signals) float64 {
+	score := nameWeight * s.NameSimilarity
+	if s.SamePhone {
+		score += phoneWeight
+	}
+	if s.SharedAddresses > 0 {
+		score += addressWeight
+	}
+	// Round so that equal pairs sort and compare predictably
+	return float64(int(score*1000+0.5)) / 1000
+}
+
+func newProfile(user models.User) profile {
+	p := profile{
+		user:  user,
+		phone: phone.Normalize(user.PhoneNumber),
+		name:  persian.Normalize(user.Firstname + " " + user.Lastname),
+	}
+	p.bigrams = bigrams(p.name)
+	for _, address := range user.Addresses {
+		p.addresses = append(p.addresses, addressKey{
+			postalCode: persian.Digits(address.PostalCode),
+			details:    persian.Normalize(address.Details),
+		})
+	}
+	return p
+}
+
+// blockingKeys returns the keys under which a user is compared with others.
+// Only users sharing at least one key are scored.
+func blockingKeys(p profile) []string {
+	var keys []string
+	if p.phone != "" {
+		keys = append(keys, "phone:"+p.phone)
+	}
+	for _, token := range strings.Fields(p.name) {
+		if len([]rune(token)) >= 3 {
+			keys = append(keys, "name:"+token)
+		}
+	}
+	for _, address := range p.addresses {
+		if address.postalCode != "" {
+			keys = append(keys, "postal:"+address.postalCode)
+		}
+		if address.details != "" {
+			keys = append(keys, "address:"+address.details)
+		}
+	}
+	return keys
+}
+
+func compare(a, b profile) Signals {
+	s := Signals{
+		SamePhone:      a.phone != "" && a.phone == b.phone,
+		NameSimilarity: dice(a.bigrams, b.bigrams),
+	}
+	for _, x := range a.addresses {
+		for _, y := range b.addresses {
+			if (x.postalCode != "" && x.postalCode == y.postalCode) || (x.details != "" && x.details == y.details) {
+				s.SharedAddresses++
+				break
+			}
+		}
+	}
+	s.NameSimilarity = float64(int(s.NameSimilarity*1000+0.5)) / 1000
+	return s
+}
+
+// bigrams counts the character bigrams of s, padded with spaces so that
+// short names still produce some.
+func bigrams(s string) map[string]int {
+	runes := []rune(" " + s + " ")
+	counts := make(map[string]int, len(runes))
+	for i := 0; i+1 < len(runes); i++ {
+		counts[string(runes[i:i+2])]++
+	}
+	return counts
+}
+
+// dice returns the Sørensen–Dice coefficient of two bigram multisets.
+func dice(a, b map[string]int) float64 {
+	var total, shared int
+	for gram, n := range a {
+		total += n
+		if m, ok := b[gram]; ok {
+			shared += min(n, m)
+		}
+	}
+	for _, m := range b {
+		total += m
+	}
+	if total == 0 {
+		return 0
+	}
+	return 2 * float64(shared) / float64(total)
+}
@@ -0,0 +1,339 @@
+// Package exporter streams users as CSV, JSON Lines or XLSX without
+// loading the whole result set into memory.
+package exporter
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xuri/excelize/v2"
+
+	"back-forms/user-service/models"
+	"back-forms/user-service/repository"
+)
+
+// Supported export formats.
+const (
+	FormatCSV   = "csv"
+	FormatJSONL = "jsonl"
+	FormatXLSX  = "xlsx"
+)
+
+// Address flattening strategies for tabular formats.
+const (
+	// AddressesJoined writes all addresses into a single column.
+	AddressesJoined = "joined"
+	// AddressesColumns writes each address into its own group of columns.
+	AddressesColumns = "columns"
+	// AddressesRows writes one row per address, repeating the user fields.
+	AddressesRows = "rows"
+	// AddressesNone leaves addresses out.
+	AddressesNone = "none"
+)
+
+// chunkSize is the number of users read and written at a time.
+const chunkSize = 500
+
+var userColumns = []string{"id", "firstname", "lastname", "phone_number", "phone_input", "gender", "persian_date", "created_at"}
+
+var addressColumns = []string{"kind", "subject", "details", "province", "city", "postal_code", "plate", "unit"}
+
+// Options controls the shape of an export.
+type Options struct {
+	Format    string
+	Addresses string
+}
+
+// Validate checks the options and fills in defaults.
+func (o *Options) Validate() error {
+	switch o.Format {
+	case FormatCSV, FormatJSONL, FormatXLSX:
+	default:
+		return errors.New("format must be csv, jsonl or xlsx")
+	}
+	switch o.Addresses {
+	case "":
+		o.Addresses = AddressesJoined
+	case AddressesJoined, AddressesColumns, AddressesRows, AddressesNone:
+	default:
+		return fmt.Errorf("addresses must be %s, %s, %s or %s", AddressesJoined, AddressesColumns, AddressesRows, AddressesNone)
+	}
+	return nil
+}
+
+// ContentType returns the media type and file extension of a format.
+func ContentType(format string) (string, string) {
+	switch format {
+	case FormatJSONL:
+		return "application/x-ndjson", "jsonl"
+	case FormatXLSX:
+		return "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", "xlsx"
+	default:
+		return "text/csv; charset=utf-8", "csv"
+	}
+}
+
+// encoder writes users in one output format.
+type encoder interface {
+	WriteUser(user models.User) error
+	Close() error
+}
+
+// Export writes every user selected by the filters and sort of q to w,
+// reading them from users in chunks.
+func Export(ctx context.Context, w io.Writer, users repository.UserRepository, q repository.UserQuery, opts Options) error {
+	addressColumns := 0
+	if opts.Format != FormatJSONL && opts.Addresses == AddressesColumns {
+		var err error
+		if addressColumns, err = users.MaxAddresses(ctx, q); err != nil {
+			return err
+		}
+	}
+
+	enc, err := newEncoder(w, opts, addressColumns)
+	if err != nil {
+		return err
+	}
+
+	q.WithAddresses = opts.Addresses != AddressesNone
+	err = users.Each(ctx, q, chunkSize, func(batch []models.User) error {
+		for _, user := range batch {
+			if err := enc.WriteUser(user); err != nil {
+				return err
+			}
+		}
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+func newEncoder(w io.Writer, opts Options, addressColumns int) (encoder, error) {
+	if opts.Format == FormatJSONL {
+		return &jsonlEncoder{enc: json.NewEncoder(w), withAddresses: opts.Addresses != AddressesNone}, nil
+	}
+
+	var records recordWriter
+	if opts.Format == FormatCSV {
+		// The byte order mark makes Excel open the file as UTF-8
+		if _, err := io.WriteString(w, "\xef\xbb\xbf"); err != nil {
+			return nil, err
+		}
+		records = &csvWriter{w: csv.NewWriter(w)}
+	} else {
+		xw, err := newXLSXWriter(w)
+		if err != nil {
+			return nil, err
+		}
+		records = xw
+	}
+
+	enc := &tableEncoder{records: records, strategy: opts.Addresses, addressColumns: addressColumns}
+	if err := records.Write(enc.header()); err != nil {
+		return nil, err
+	}
+	return enc, nil
+}
+
+// jsonlEncoder writes one JSON object per line.
+type jsonlEncoder struct {
+	enc           *json.Encoder
+	withAddresses bool
+}
+
+func (e *jsonlEncoder) WriteUser(user models.User) error {
+	if !e.withAddresses {
+		user.Addresses = nil
+	} else if user.Addresses == nil {
+		user.Addresses = []models.Address{}
+	}
+	return e.enc.Encode(user)
+}
+
+func (e *jsonlEncoder) Close() error {
+	return nil
+}
+
+// recordWriter writes rows of cells.
+type recordWriter interface {
+	Write(record []string) error
+	Close() error
+}
+
+// tableEncoder flattens users into rows for CSV and XLSX.
+type tableEncoder struct {
+	records        recordWriter
+	strategy       string
+	addressColumns int
+}
+
+func (e *tableEncoder) header() []string {
+	header := append([]string{}, userColumns...)
+	switch e.strategy {
+	case AddressesJoined:
+		header = append(header, "addresses")
+	case AddressesRows:
+		for _, column := range addressColumns {
+			header = append(header, "address_"+column)
+		}
+	case AddressesColumns:
+		for i := 0; i < e.addressColumns; i++ {
+			for _, column := range addressColumns {
+				header = append(header, fmt.Sprintf("addresses[%d].%s", i, column))
+			}
+		}
+	}
+	return header
+}
+
+func (e *tableEncoder) WriteUser(user models.User) error {
+	base := []string{
+		strconv.FormatUint(uint64(user.ID), 10),
+		user.Firstname,
+		user.Lastname,
+		user.PhoneNumber,
+		user.PhoneInput,
+		user.Gender,
+		user.PersianDate.String(),
+		user.CreatedAt.Format(time.RFC3339),
+	}
+
+	switch e.strategy {
+	case AddressesJoined:
+		parts := make([]string, len(user.Addresses))
+		for i, address := range user.Addresses {
+			parts[i] = joinedAddress(address)
+		}
+		return e.records.Write(append(base, strings.Join(parts, " | ")))
+	case AddressesRows:
+		if len(user.Addresses) == 0 {
+			return e.records.Write(append(base, addressValues(models.Address{})...))
+		}
+		for _, address := range user.Addresses {
+			record := append(append([]string{}, base...), addressValues(address)...)
+			if err := e.records.Write(record); err != nil {
+				return err
+			}
+		}
+		return nil
+	case AddressesColumns:
+		record := base
+		for i := 0; i < e.addressColumns; i++ {
+			if i < len(user.Addresses) {
+				record = append(record, addressValues(user.Addresses[i])...)
+			} else {
+				record = append(record, addressValues(models.Address{})...)
+			}
+		}
+		return e.records.Write(record)
+	default:
+		return e.records.Write(base)
+	}
+}
+
+// addressValues returns the cells of an address in addressColumns order.
+func addressValues(a models.Address) []string {
+	return []string{a.Kind, a.Subject, a.Details, a.Province, a.City, a.PostalCode, a.Plate, a.Unit}
+}
+
+// joinedAddress formats an address as "subject: details, city, province, postal_code".
+func joinedAddress(a models.Address) string {
+	parts := []string{a.Details}
+	for _, part := range []string{a.City, a.Province, a.PostalCode} {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return a.Subject + ": " + strings.Join(parts, ", ")
+}
+
+func (e *tableEncoder) Close() error {
+	return e.records.Close()
+}
+
+type csvWriter struct {
+	w *csv.Writer
+}
+
+func (c *csvWriter) Write(record []string) error {
+	escaped := make([]string, len(record))
+	for i, value := range record {
+		escaped[i] = escapeFormula(value)
+	}
+	return c.w.Write(escaped)
+}
+
+// escapeFormula keeps spreadsheet programs from evaluating a CSV cell as a
+// formula, which also keeps numbers such as +989121234567 intact. Names
+// and addresses come from the public form, so they cannot be trusted.
+// The importer removes the quote again. XLSX cells are written as strings
+// and need no escaping.
+func escapeFormula(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
+
+func (c *csvWriter) Close() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// xlsxWriter streams rows into a single sheet. The workbook is written to
+// the output when it is closed.
+type xlsxWriter struct {
+	out    io.Writer
+	file   *excelize.File
+	stream *excelize.StreamWriter
+	row    int
+}
+
+const xlsxSheet = "Users"
+
+func newXLSXWriter(out io.Writer) (*xlsxWriter, error) {
+	f := excelize.NewFile()
+	if err := f.SetSheetName("Sheet1", xlsxSheet); err != nil {
+		return nil, err
+	}
+	stream, err := f.NewStreamWriter(xlsxSheet)
+	if err != nil {
+		return nil, err
+	}
+	return &xlsxWriter{out: out, file: f, stream: stream}, nil
+}
+
+func (x *xlsxWriter) Write(record []string) error {
+	x.row++
+	cells := make([]interface{}, len(record))
+	for i, value := range record {
+		cells[i] = value
+	}
+	cell, err := excelize.CoordinatesToCellName(1, x.row)
+	if err != nil {
+		return err
+	}
+	return x.stream.SetRow(cell, cells)
+}
+
+func (x *xlsxWriter) Close() error {
+	defer x.file.Close()
+	if err := x.stream.Flush(); err != nil {
+		return err
+	}
+	_, err := x.file.WriteTo(x.out)
+	return err
+}
@@ -0,0 +1,327 @@
+// Package idempotency makes retried POST requests safe. A client sends an
+// Idempotency-Key header; the first request with a key runs and its
+// response is stored, and later requests with the same key get the stored
+// response back instead of running again.
+package idempotency
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"back-forms/auth"
+)
+
+// Header is the request header carrying the key.
+const Header = "Idempotency-Key"
+
+// DefaultTTL is how long responses are kept when no TTL is configured.
+const DefaultTTL = 24 * time.Hour
+
+// MaxKeyLength is the longest key accepted.
+const MaxKeyLength = 255
+
+// MaxBodySize caps the request bodies read to hash and replay, since the
+// wrapper sits in front of the public submission route.
+const MaxBodySize = 1 << 20
+
+// lockTimeout is how long a request may stay in flight before its key is
+// considered abandoned, for example after a crash, and may be taken over.
+const lockTimeout = time.Minute
+
+// sweepInterval is how often expired records are deleted.
+const sweepInterval = time.Hour
+
+// replayedHeaders are the response headers stored and replayed along with
+// the status and body.
+var replayedHeaders = []string{"Content-Type", "ETag", "Location"}
+
+// Record is the stored outcome of a request. Status is zero while the first
+// request is still in flight.
+type Record struct {
+	ID          uint   `gorm:"primaryKey"`
+	Scope       string `gorm:"not null;uniqueIndex:idx_idempotency_scope_key"`
+	Key         string `gorm:"not null;uniqueIndex:idx_idempotency_scope_key"`
+	RequestHash string `gorm:"not null"`
+	Status      int    `gorm:"not null;default:0"`
+	Header      string `gorm:"type:text;not null;default:''"`
+	Body        []byte
+	CreatedAt   time.Time
+	ExpiresAt   time.Time `gorm:"not null;index"`
+}
+
+// TableName keeps the record table name descriptive.
+func (Record) TableName() string {
+	return "idempotency_keys"
+}
+
+// Store replays responses for repeated idempotency keys.
+type Store struct {
+	db  *gorm.DB
+	ttl time.Duration
+	// ClientIP returns the address that keys of anonymous callers are
+	// scoped to. It defaults to the remote address of the connection.
+	ClientIP func(r *http.Request) string
+
+	mu        sync.Mutex
+	lastSweep time.Time
+}
+
+// New returns a Store keeping responses for ttl, or DefaultTTL when ttl is
+// not positive.
+func New(db *gorm.DB, ttl time.Duration) *Store {
+	if ttl <= 0 {
+		ttl = DefaultTTL
+	}
+	return &Store{db: db, ttl: ttl}
+}
+
+var errKeyTaken = errors.New("idempotency key taken")
+
+// Wrap makes h idempotent for requests carrying an Idempotency-Key header.
+// Keys are scoped to the caller, so two clients may use the same key:
+// authenticated callers by API key or operator, which needs auth.Middleware
+// to run first, and anonymous ones by IP address. Server errors are not
+// stored, so a request that failed that way can be retried with the same
+// key.
+func (s *Store) Wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(Header)
+		if key == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > MaxKeyLength {
+			writeError(w, http.StatusBadRequest, "invalid_idempotency_key", "Idempotency-Key must be at most 255 characters")
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MaxBodySize))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(w, http.StatusRequestEntityTooLarge, "body_too_large", "Request body must be at most 1 MiB")
+			return
+		}
+		if err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		// The bookkeeping outlives the client: when it disconnects while the
+		// handler runs, the response must still be stored or the key freed,
+		// or a retry would find the key in flight and then run again
+		db := s.db.WithContext(context.WithoutCancel(r.Context()))
+		s.sweep(db)
+
+		record := Record{
+			Scope:       s.scope(r),
+			Key:         key,
+			RequestHash: requestHash(r, body),
+		}
+		existing, err := s.acquire(db, &record)
+		if errors.Is(err, errKeyTaken) {
+			existing = &Record{RequestHash: record.RequestHash}
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if existing != nil {
+			switch {
+			case existing.RequestHash != record.RequestHash:
+				writeError(w, http.StatusUnprocessableEntity, "idempotency_key_reused", "Idempotency-Key was already used for a different request")
+			case existing.Status == 0:
+				w.Header().Set("Retry-After", "1")
+				writeError(w, http.StatusConflict, "idempotency_key_in_flight", "A request with this Idempotency-Key is still being processed")
+			default:
+				replay(w, existing)
+			}
+			return
+		}
+
+		recorder := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		completed := false
+		defer func() {
+			if !completed {
+				// The handler panicked; free the key so the client can retry
+				s.release(db, record.ID)
+			}
+		}()
+		h.ServeHTTP(recorder, r)
+		completed = true
+
+		if recorder.status >= http.StatusInternalServerError {
+			s.release(db, record.ID)
+			return
+		}
+		header := map[string]string{}
+		for _, name := range replayedHeaders {
+			if value := recorder.Header().Get(name); value != "" {
+				header[name] = value
+			}
+		}
+		encoded, _ := json.Marshal(header)
+		if err := db.Model(&Record{}).Where("id = ?", record.ID).Updates(map[string]interface{}{
+			"status": recorder.status,
+			"header": string(encoded),
+			"body":   recorder.body.Bytes(),
+		}).Error; err != nil {
+			log.Printf("idempotency: storing response for key %q: %v", key, err)
+		}
+	})
+}
+
+// acquire claims record's key for this request. When another request
+// already holds the key it returns that request's record instead.
+func (s *Store) acquire(db *gorm.DB, record *Record) (*Record, error) {
+	now := time.Now()
+	record.ExpiresAt = now.Add(s.ttl)
+	for attempt := 0; attempt < 2; attempt++ {
+		result := db.Clauses(clause.OnConflict{DoNothing: true}).Create(record)
+		if result.Error != nil {
+			return nil, result.Error
+		}
+		if result.RowsAffected == 1 {
+			return nil, nil
+		}
+
+		var existing Record
+		err := db.Where("scope = ? AND key = ?", record.Scope, record.Key).First(&existing).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			// Deleted in between; try to insert again
+			record.ID = 0
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		expired := !now.Before(existing.ExpiresAt)
+		abandoned := existing.Status == 0 && now.Sub(existing.CreatedAt) > lockTimeout
+		if !expired && !abandoned {
+			return &existing, nil
+		}
+		// Take over a stale record, guarding against another request doing
+		// the same at once
+		result = db.Model(&Record{}).
+			Where("id = ? AND status = ? AND created_at = ?", existing.ID, existing.Status, existing.CreatedAt).
+			Updates(map[string]interface{}{
+				"request_hash": record.RequestHash,
+				"status":       0,
+				"header":       "",
+				"body":         nil,
+				"created_at":   now,
+				"expires_at":   record.ExpiresAt,
+			})
+		if result.Error != nil {
+			return nil, result.Error
+		}
+		if result.RowsAffected == 1 {
+			record.ID = existing.ID
+			return nil, nil
+		}
+	}
+	return nil, errKeyTaken
+}
+
+// release deletes an in-flight record so its key can be used again.
+func (s *Store) release(db *gorm.DB, id uint) {
+	if err := db.Where("id = ? AND status = 0", id).Delete(&Record{}).Error; err != nil {
+		log.Printf("idempotency: releasing record %d: %v", id, err)
+	}
+}
+
+// sweep deletes expired records at most once per sweepInterval.
+func (s *Store) sweep(db *gorm.DB) {
+	s.mu.Lock()
+	now := time.Now()
+	due := now.Sub(s.lastSweep) >= sweepInterval
+	if due {
+		s.lastSweep = now
+	}
+	s.mu.Unlock()
+	if !due {
+		return
+	}
+	if err := db.Where("expires_at <= ?", now).Delete(&Record{}).Error; err != nil {
+		log.Printf("idempotency: deleting expired records: %v", err)
+	}
+}
+
+// scope identifies the caller a key belongs to.
+func (s *Store) scope(r *http.Request) string {
+	if claims, ok := auth.ClaimsFrom(r.Context()); ok {
+		if claims.APIKeyID != 0 {
+			return "key:" + strconv.FormatUint(uint64(claims.APIKeyID), 10)
+		}
+		return "operator:" + strconv.FormatUint(uint64(claims.OperatorID()), 10)
+	}
+	if s.ClientIP != nil {
+		return "ip:" + s.ClientIP(r)
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return "ip:" + r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// requestHash fingerprints a request so that reusing a key for a different
+// request can be detected.
+func requestHash(r *http.Request, body []byte) string {
+	sum := sha256.New()
+	io.WriteString(sum, r.Method+" "+r.URL.Path+"\n")
+	sum.Write(body)
+	return hex.EncodeToString(sum.Sum(nil))
+}
+
+func replay(w http.ResponseWriter, record *Record) {
+	var header map[string]string
+	json.Unmarshal([]byte(record.Header), &header)
+	for name, value := range header {
+		w.Header().Set(name, value)
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(record.Status)
+	w.Write(record.Body)
+}
+
+// responseRecorder passes a response through while keeping a copy.
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if !rec.wroteHeader {
+		rec.status = status
+		rec.wroteHeader = true
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	rec.wroteHeader = true
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(auth.ErrorResponse{Error: code, Message: message})
+}
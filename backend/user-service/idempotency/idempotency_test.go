@@ -0,0 +1,119 @@
+package idempotency
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gorm.io/gorm"
+
+	"back-forms/config"
+	"back-forms/database"
+	"back-forms/migrations"
+)
+
+func newTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	db, err := database.Open(config.Database{
+		Driver: config.DriverSQLite,
+		Path:   filepath.Join(t.TempDir(), "idempotency.db"),
+	}, config.NewLevelVar("error"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+
+	m, err := migrations.New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Up(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// counting returns a handler answering 201 and the number of times it ran.
+func counting() (http.Handler, *int) {
+	calls := 0
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"id":1}`))
+	}), &calls
+}
+
+func post(h http.Handler, remoteAddr, key string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/api/users", strings.NewReader(`{"firstname":"Sara"}`))
+	r.RemoteAddr = remoteAddr
+	r.Header.Set(Header, key)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	return rec
+}
+
+func TestWrapScopesAnonymousKeysByIP(t *testing.T) {
+	h, calls := counting()
+	wrapped := New(newTestDB(t), 0).Wrap(h)
+
+	if rec := post(wrapped, "203.0.113.1:4000", "k"); rec.Code != http.StatusCreated {
+		t.Fatalf("first request: status %d", rec.Code)
+	}
+	rec := post(wrapped, "203.0.113.1:4001", "k")
+	if rec.Code != http.StatusCreated || rec.Header().Get("Idempotent-Replayed") != "true" {
+		t.Fatalf("retry from the same IP: status %d, replayed %q", rec.Code, rec.Header().Get("Idempotent-Replayed"))
+	}
+	if rec := post(wrapped, "198.51.100.7:4000", "k"); rec.Header().Get("Idempotent-Replayed") != "" {
+		t.Fatal("request from another IP was replayed")
+	}
+	if *calls != 2 {
+		t.Fatalf("handler ran %d times, want 2", *calls)
+	}
+}
+
+func TestWrapStoresResponseAfterClientDisconnects(t *testing.T) {
+	h, calls := counting()
+	ctx, cancel := context.WithCancel(context.Background())
+	disconnecting := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The client goes away while the request is being handled
+		cancel()
+		h.ServeHTTP(w, r)
+	})
+	wrapped := New(newTestDB(t), 0).Wrap(disconnecting)
+
+	r := httptest.NewRequest(http.MethodPost, "/api/users", strings.NewReader(`{"firstname":"Sara"}`)).WithContext(ctx)
+	r.Header.Set(Header, "k")
+	wrapped.ServeHTTP(httptest.NewRecorder(), r)
+
+	rec := post(wrapped, r.RemoteAddr, "k")
+	if rec.Code != http.StatusCreated || rec.Header().Get("Idempotent-Replayed") != "true" {
+		t.Fatalf("retry: status %d, replayed %q", rec.Code, rec.Header().Get("Idempotent-Replayed"))
+	}
+	if *calls != 1 {
+		t.Fatalf("handler ran %d times, want 1", *calls)
+	}
+}
+
+func TestWrapRejectsLargeBodies(t *testing.T) {
+	h, calls := counting()
+	wrapped := New(newTestDB(t), 0).Wrap(h)
+
+	r := httptest.NewRequest(http.MethodPost, "/api/users", strings.NewReader(strings.Repeat("x", MaxBodySize+1)))
+	r.Header.Set(Header, "k")
+	rec := httptest.NewRecorder()
+	wrapped.ServeHTTP(rec, r)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("status %d, want 413", rec.Code)
+	}
+	if *calls != 0 {
+		t.Fatalf("handler ran %d times, want 0", *calls)
+	}
+}
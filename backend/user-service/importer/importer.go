@@ -0,0 +1,585 @@
+// Package importer turns CSV and XLSX spreadsheets of paper-form submissions
+// into validated users and inserts them in batches.
+package importer
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/xuri/excelize/v2"
+
+	"back-forms/jalali"
+	"back-forms/phone"
+	"back-forms/user-service/models"
+	"back-forms/user-service/repository"
+	"back-forms/user-service/validation"
+)
+
+// Supported spreadsheet formats.
+const (
+	FormatCSV  = "csv"
+	FormatXLSX = "xlsx"
+)
+
+// Import modes.
+const (
+	// ModeAllOrNothing inserts nothing unless every row is valid.
+	ModeAllOrNothing = "all_or_nothing"
+	// ModeSkipBadRows inserts the valid rows and reports the rest.
+	ModeSkipBadRows = "skip_bad_rows"
+)
+
+// CodeInsertFailed marks a valid row that the database rejected.
+const CodeInsertFailed = "insert_failed"
+
+// DefaultBatchSize is the number of users inserted per statement.
+const DefaultBatchSize = 100
+
+// userFields are the mapping targets for user columns.
+var userFields = map[string]bool{
+	"firstname":    true,
+	"lastname":     true,
+	"phone_number": true,
+	"gender":       true,
+	"persian_date": true,
+}
+
+// MaxAddressColumns caps the address index in mapping targets, so
+// addresses[0] to addresses[MaxAddressColumns-1] can be imported.
+const MaxAddressColumns = 20
+
+// addressField matches mapping targets such as addresses[0].subject.
+var addressField = regexp.MustCompile(`^addresses\[(\d+)\]\.(subject|details|kind|province|city|postal_code|plate|unit)$`)
+
+// genderAliases maps accepted spellings to the stored gender values.
+var genderAliases = map[string]string{
+	"male":   "Male",
+	"m":      "Male",
+	"مرد":    "Male",
+	"female": "Female",
+	"f":      "Female",
+	"زن":     "Female",
+}
+
+// Options controls how a spreadsheet is imported.
+type Options struct {
+	// Mapping maps column headers to user fields. Headers that are not
+	// mapped are matched against the field names directly.
+	Mapping   map[string]string
+	DryRun    bool
+	Mode      string
+	BatchSize int
+	// PhonePolicy decides what happens to rows whose phone number is
+	// already used by a stored user or by an earlier row.
+	PhonePolicy validation.PhonePolicy
+}
+
+// Row is a parsed spreadsheet row.
+type Row struct {
+	Line   int
+	User   models.User
+	Errors validation.Errors
+}
+
+// RowError lists the problems found in one spreadsheet row.
+type RowError struct {
+	Row    int               `json:"row"`
+	Errors validation.Errors `json:"errors"`
+}
+
+// Report summarizes an import.
+type Report struct {
+	DryRun      bool       `json:"dry_run"`
+	Mode        string     `json:"mode"`
+	TotalRows   int        `json:"total_rows"`
+	ValidRows   int        `json:"valid_rows"`
+	InvalidRows int        `json:"invalid_rows"`
+	Inserted    int        `json:"inserted"`
+	Rows        []RowError `json:"rows"`
+	Warnings    []RowError `json:"warnings"`
+}
+
+// Validate checks the options and fills in defaults.
+func (o *Options) Validate() error {
+	switch o.Mode {
+	case "":
+		o.Mode = ModeAllOrNothing
+	case ModeAllOrNothing, ModeSkipBadRows:
+	default:
+		return fmt.Errorf("mode must be %s or %s", ModeAllOrNothing, ModeSkipBadRows)
+	}
+	if o.BatchSize <= 0 {
+		o.BatchSize = DefaultBatchSize
+	}
+	if o.PhonePolicy == "" {
+		o.PhonePolicy = validation.PhoneReject
+	}
+	for header, field := range o.Mapping {
+		if addressField.MatchString(field) && !validTarget(field) {
+			return addressLimitError(header)
+		}
+		if !validTarget(field) {
+			return fmt.Errorf("column %q is mapped to unknown field %q", header, field)
+		}
+	}
+	return nil
+}
+
+// DetectFormat picks the format from an explicit value or a file name.
+func DetectFormat(format, filename string) (string, error) {
+	if format == "" {
+		lower := strings.ToLower(filename)
+		switch {
+		case strings.HasSuffix(lower, ".csv"):
+			format = FormatCSV
+		case strings.HasSuffix(lower, ".xlsx"):
+			format = FormatXLSX
+		}
+	}
+	switch format {
+	case FormatCSV, FormatXLSX:
+		return format, nil
+	default:
+		return "", errors.New("format must be csv or xlsx")
+	}
+}
+
+// ReadRows reads all rows, including the header row, from a spreadsheet.
+func ReadRows(r io.Reader, format string) ([][]string, error) {
+	switch format {
+	case FormatCSV:
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		// Spreadsheets saved from Excel start with a UTF-8 byte order mark
+		data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+		reader := csv.NewReader(bytes.NewReader(data))
+		reader.FieldsPerRecord = -1
+		reader.TrimLeadingSpace = true
+		rows, err := reader.ReadAll()
+		for _, cells := range rows {
+			for i, cell := range cells {
+				cells[i] = unescapeFormula(cell)
+			}
+		}
+		return rows, err
+	case FormatXLSX:
+		f, err := excelize.OpenReader(r)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		sheets := f.GetSheetList()
+		if len(sheets) == 0 {
+			return nil, errors.New("workbook has no sheets")
+		}
+		return f.GetRows(sheets[0])
+	default:
+		return nil, fmt.Errorf("unsupported format %q", format)
+	}
+}
+
+// ParseRows maps spreadsheet rows onto users and validates each of them.
+// The first row must be the header. Blank rows are skipped.
+func ParseRows(rows [][]string, mapping map[string]string) ([]Row, error) {
+	if len(rows) == 0 {
+		return nil, errors.New("spreadsheet is empty")
+	}
+
+	targets := make([]string, len(rows[0]))
+	mapped := 0
+	for i, header := range rows[0] {
+		header = strings.TrimSpace(header)
+		if field, ok := mapping[header]; ok {
+			targets[i] = field
+		} else if field := strings.ToLower(header); validTarget(field) {
+			targets[i] = field
+		} else if addressField.MatchString(field) {
+			return nil, addressLimitError(header)
+		}
+		if targets[i] != "" {
+			mapped++
+		}
+	}
+	if mapped == 0 {
+		return nil, errors.New("no columns could be mapped to user fields")
+	}
+
+	var parsed []Row
+	for i, cells := range rows[1:] {
+		if blank(cells) {
+			continue
+		}
+		parsed = append(parsed, parseRow(i+2, targets, cells))
+	}
+	return parsed, nil
+}
+
+func parseRow(line int, targets, cells []string) Row {
+	row := Row{Line: line}
+	dateInvalid := false
+	addresses := map[int]*models.Address{}
+
+	for i, target := range targets {
+		if target == "" || i >= len(cells) {
+			continue
+		}
+		value := strings.TrimSpace(cells[i])
+
+		switch target {
+		case "firstname":
+			row.User.Firstname = value
+		case "lastname":
+			row.User.Lastname = value
+		case "phone_number":
+			row.User.PhoneNumber = value
+		case "gender":
+			if g, ok := genderAliases[strings.ToLower(value)]; ok {
+				value = g
+			}
+			row.User.Gender = value
+		case "persian_date":
+			if value == "" {
+				continue
+			}
+			date, err := jalali.Parse(value)
+			if err != nil {
+				row.Errors.Add("persian_date", validation.CodeInvalidDate, err.Error())
+				dateInvalid = true
+				continue
+			}
+			row.User.PersianDate = date
+		default:
+			m := addressField.FindStringSubmatch(target)
+			index, _ := strconv.Atoi(m[1])
+			address, ok := addresses[index]
+			if !ok {
+				address = &models.Address{}
+				addresses[index] = address
+			}
+			switch m[2] {
+			case "subject":
+				address.Subject = value
+			case "details":
+				address.Details = value
+			case "kind":
+				address.Kind = strings.ToLower(value)
+			case "province":
+				address.Province = value
+			case "city":
+				address.City = value
+			case "postal_code":
+				address.PostalCode = value
+			case "plate":
+				address.Plate = value
+			case "unit":
+				address.Unit = value
+			}
+		}
+	}
+
+	// Collect addresses in index order, dropping those whose columns were
+	// all empty
+	indexes := make([]int, 0, len(addresses))
+	for index := range addresses {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+	for _, index := range indexes {
+		if address := addresses[index]; *address != (models.Address{}) {
+			row.User.Addresses = append(row.User.Addresses, *address)
+		}
+	}
+
+	for _, fe := range validation.ValidateUser(row.User) {
+		if fe.Field == "persian_date" && dateInvalid {
+			continue
+		}
+		row.Errors = append(row.Errors, fe)
+	}
+	return row
+}
+
+// errRejected rolls back an all-or-nothing import with invalid rows.
+var errRejected = errors.New("import has invalid rows")
+
+// Run inserts the valid rows according to opts and returns the report.
+// In all-or-nothing mode every batch is written in one transaction. In
+// skip-bad-rows mode each batch commits on its own, and a batch the database
+// rejects is retried row by row so only the offending rows are skipped.
+// Phone numbers are checked against the stored users inside the
+// transaction that inserts them.
+func Run(ctx context.Context, store repository.Store, rows []Row, opts Options) (Report, error) {
+	report := Report{
+		DryRun:    opts.DryRun,
+		Mode:      opts.Mode,
+		TotalRows: len(rows),
+		Rows:      []RowError{},
+		Warnings:  []RowError{},
+	}
+
+	if opts.PhonePolicy != validation.PhoneAllow {
+		report.Warnings = checkFilePhones(rows, opts.PhonePolicy)
+	}
+
+	var valid []Row
+	for _, row := range rows {
+		if len(row.Errors) > 0 {
+			report.Rows = append(report.Rows, RowError{Row: row.Line, Errors: row.Errors})
+			continue
+		}
+		valid = append(valid, row)
+	}
+
+	var err error
+	switch {
+	case opts.DryRun:
+		var rejected, warnings []RowError
+		rejected, warnings, err = checkStoredPhones(ctx, store.Users(), valid, opts.PhonePolicy)
+		report.Rows = append(report.Rows, rejected...)
+		report.Warnings = append(report.Warnings, warnings...)
+	case len(valid) == 0:
+	case opts.Mode == ModeAllOrNothing:
+		err = insertAll(ctx, store, valid, opts, &report)
+	default:
+		err = insertValid(ctx, store, valid, opts, &report)
+	}
+
+	report.Rows = mergeRows(report.Rows)
+	report.Warnings = mergeRows(report.Warnings)
+	report.InvalidRows = len(report.Rows)
+	report.ValidRows = report.TotalRows - report.InvalidRows
+	return report, err
+}
+
+// insertAll inserts rows in one transaction, or nothing if any row of the
+// import is invalid.
+func insertAll(ctx context.Context, store repository.Store, rows []Row, opts Options, report *Report) error {
+	err := store.Transaction(ctx, func(tx repository.Store) error {
+		rejected, warnings, err := checkStoredPhones(ctx, tx.Users(), rows, opts.PhonePolicy)
+		if err != nil {
+			return err
+		}
+		report.Rows = append(report.Rows, rejected...)
+		report.Warnings = append(report.Warnings, warnings...)
+		if len(report.Rows) > 0 {
+			return errRejected
+		}
+
+		for start := 0; start < len(rows); start += opts.BatchSize {
+			end := start + opts.BatchSize
+			if end > len(rows) {
+				end = len(rows)
+			}
+			if err := tx.Users().CreateBatch(ctx, accepted(rows[start:end], nil)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	switch {
+	case errors.Is(err, errRejected):
+		return nil
+	case err != nil:
+		return err
+	}
+	report.Inserted = len(rows)
+	return nil
+}
+
+// insertValid inserts rows in batches that commit on their own, skipping
+// the rows that cannot be inserted.
+func insertValid(ctx context.Context, store repository.Store, rows []Row, opts Options, report *Report) error {
+	for start := 0; start < len(rows); start += opts.BatchSize {
+		end := start + opts.BatchSize
+		if end > len(rows) {
+			end = len(rows)
+		}
+		batch := rows[start:end]
+
+		var rejected, warnings []RowError
+		var users []models.User
+		err := store.Transaction(ctx, func(tx repository.Store) error {
+			var err error
+			if rejected, warnings, err = checkStoredPhones(ctx, tx.Users(), batch, opts.PhonePolicy); err != nil {
+				return err
+			}
+			if users = accepted(batch, rejected); len(users) == 0 {
+				return nil
+			}
+			return tx.Users().CreateBatch(ctx, users)
+		})
+		if err == nil {
+			report.Rows = append(report.Rows, rejected...)
+			report.Warnings = append(report.Warnings, warnings...)
+			report.Inserted += len(users)
+			continue
+		}
+
+		for _, row := range batch {
+			var rejected, warnings []RowError
+			err := store.Transaction(ctx, func(tx repository.Store) error {
+				var err error
+				rejected, warnings, err = checkStoredPhones(ctx, tx.Users(), []Row{row}, opts.PhonePolicy)
+				if err != nil || len(rejected) > 0 {
+					return err
+				}
+				user := row.User
+				return tx.Users().Create(ctx, &user)
+			})
+			if err != nil {
+				var errs validation.Errors
+				errs.Add("", CodeInsertFailed, err.Error())
+				report.Rows = append(report.Rows, RowError{Row: row.Line, Errors: errs})
+				continue
+			}
+			report.Rows = append(report.Rows, rejected...)
+			report.Warnings = append(report.Warnings, warnings...)
+			if len(rejected) == 0 {
+				report.Inserted++
+			}
+		}
+	}
+	return nil
+}
+
+// accepted returns the users of the rows that are not rejected.
+func accepted(rows []Row, rejected []RowError) []models.User {
+	skip := make(map[int]bool, len(rejected))
+	for _, re := range rejected {
+		skip[re.Row] = true
+	}
+	users := make([]models.User, 0, len(rows))
+	for _, row := range rows {
+		if !skip[row.Line] {
+			users = append(users, row.User)
+		}
+	}
+	return users
+}
+
+// checkFilePhones applies the phone uniqueness policy to the valid rows
+// against earlier rows of the same file. Rejected duplicates are added to
+// the row errors; warnings are returned.
+func checkFilePhones(rows []Row, policy validation.PhonePolicy) []RowError {
+	warnings := []RowError{}
+	firstLine := map[string]int{}
+	for i := range rows {
+		row := &rows[i]
+		if len(row.Errors) > 0 {
+			continue
+		}
+		number := phone.Normalize(row.User.PhoneNumber)
+		line, ok := firstLine[number]
+		if !ok {
+			firstLine[number] = row.Line
+			continue
+		}
+
+		var duplicates validation.Errors
+		duplicates.Add("phone_number", validation.CodeDuplicatePhone, fmt.Sprintf("is already used in row %d", line))
+		errs, warns := policy.Apply(duplicates)
+		row.Errors = append(row.Errors, errs...)
+		if len(warns) > 0 {
+			warnings = append(warnings, RowError{Row: row.Line, Errors: warns})
+		}
+	}
+	return warnings
+}
+
+// checkStoredPhones applies the phone uniqueness policy to rows against the
+// stored users and returns the rejected rows and the warnings. Under
+// PhoneReject the numbers are locked first, so that inside a transaction
+// they stay unused until it ends.
+func checkStoredPhones(ctx context.Context, users repository.UserRepository, rows []Row, policy validation.PhonePolicy) (rejected, warnings []RowError, err error) {
+	if policy == validation.PhoneAllow || len(rows) == 0 {
+		return nil, nil, nil
+	}
+	numbers := make([]string, len(rows))
+	for i, row := range rows {
+		numbers[i] = phone.Normalize(row.User.PhoneNumber)
+	}
+	if policy == validation.PhoneReject {
+		if err := users.LockPhones(ctx, numbers); err != nil {
+			return nil, nil, err
+		}
+	}
+	owners, err := users.PhoneOwners(ctx, numbers)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for i, row := range rows {
+		ids := owners[numbers[i]]
+		if len(ids) == 0 {
+			continue
+		}
+		errs, warns := policy.Apply(validation.Errors{validation.DuplicatePhoneError("phone_number", ids)})
+		if len(errs) > 0 {
+			rejected = append(rejected, RowError{Row: row.Line, Errors: errs})
+		}
+		if len(warns) > 0 {
+			warnings = append(warnings, RowError{Row: row.Line, Errors: warns})
+		}
+	}
+	return rejected, warnings, nil
+}
+
+// mergeRows sorts row errors by row and joins those of the same row.
+func mergeRows(rows []RowError) []RowError {
+	sort.SliceStable(rows, func(i, j int) bool {
+		return rows[i].Row < rows[j].Row
+	})
+	merged := []RowError{}
+	for _, re := range rows {
+		if n := len(merged); n > 0 && merged[n-1].Row == re.Row {
+			merged[n-1].Errors = append(append(validation.Errors{}, merged[n-1].Errors...), re.Errors...)
+			continue
+		}
+		merged = append(merged, re)
+	}
+	return merged
+}
+
+// unescapeFormula removes the quote the exporter puts before CSV cells that
+// a spreadsheet program would evaluate as a formula, such as +989121234567.
+func unescapeFormula(cell string) string {
+	if len(cell) > 1 && cell[0] == '\'' && strings.ContainsRune("=+-@\t\r", rune(cell[1])) {
+		return cell[1:]
+	}
+	return cell
+}
+
+func validTarget(field string) bool {
+	if userFields[field] {
+		return true
+	}
+	m := addressField.FindStringSubmatch(field)
+	if m == nil {
+		return false
+	}
+	index, err := strconv.Atoi(m[1])
+	return err == nil && index < MaxAddressColumns
+}
+
+func addressLimitError(header string) error {
+	return fmt.Errorf("column %q is past the last address; at most %d addresses can be imported", header, MaxAddressColumns)
+}
+
+func blank(cells []string) bool {
+	for _, cell := range cells {
+		if strings.TrimSpace(cell) != "" {
+			return false
+		}
+	}
+	return true
+}
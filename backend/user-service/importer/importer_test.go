@@ -0,0 +1,257 @@
+package importer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"back-forms/config"
+	"back-forms/database"
+	"back-forms/jalali"
+	"back-forms/migrations"
+	"back-forms/user-service/exporter"
+	"back-forms/user-service/models"
+	"back-forms/user-service/repository"
+	"back-forms/user-service/validation"
+)
+
+// newSQLStore returns a SQL store on a migrated SQLite database.
+func newSQLStore(t *testing.T) *repository.SQL {
+	t.Helper()
+	db, err := database.Open(config.Database{
+		Driver: config.DriverSQLite,
+		Path:   filepath.Join(t.TempDir(), "import.db"),
+	}, config.NewLevelVar("error"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+
+	m, err := migrations.New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Up(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return repository.NewSQL(db)
+}
+
+// parse parses a CSV spreadsheet whose rows follow the header row.
+func parse(t *testing.T, lines ...string) []Row {
+	t.Helper()
+	csv := "firstname,lastname,phone_number,gender,persian_date\n" + strings.Join(lines, "\n")
+	rows, err := ReadRows(strings.NewReader(csv), FormatCSV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseRows(rows, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed
+}
+
+func TestParseRowsAddressOrder(t *testing.T) {
+	rows := [][]string{
+		{"firstname", "lastname", "phone_number", "gender", "persian_date", "addresses[19].subject", "addresses[19].details", "addresses[2].subject", "addresses[2].details", "addresses[5].subject"},
+		{"Sara", "Ahmadi", "09121234567", "female", "1370/05/12", "Work", "Azadi St", "Home", "Valiasr St", ""},
+	}
+	parsed, err := ParseRows(rows, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parsed) != 1 || len(parsed[0].Errors) > 0 {
+		t.Fatalf("parsed = %+v", parsed)
+	}
+	addresses := parsed[0].User.Addresses
+	if len(addresses) != 2 || addresses[0].Subject != "Home" || addresses[1].Subject != "Work" {
+		t.Fatalf("addresses = %+v, want Home then Work", addresses)
+	}
+}
+
+func TestAddressIndexLimit(t *testing.T) {
+	rows := [][]string{
+		{"firstname", "addresses[999999999].subject"},
+		{"Sara", "Home"},
+	}
+	if _, err := ParseRows(rows, nil); err == nil || !strings.Contains(err.Error(), "addresses[999999999]") {
+		t.Fatalf("ParseRows error = %v, want the address limit", err)
+	}
+
+	opts := Options{Mapping: map[string]string{"Subject": "addresses[20].subject"}}
+	if err := opts.Validate(); err == nil {
+		t.Fatal("Validate accepted addresses[20]")
+	}
+	opts = Options{Mapping: map[string]string{"Subject": "addresses[19].subject"}}
+	if err := opts.Validate(); err != nil {
+		t.Fatalf("Validate rejected addresses[19]: %v", err)
+	}
+}
+
+func TestExportRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	users := repository.NewMemory().Users()
+	stored := []models.User{
+		{
+			Firstname: "Sara", Lastname: "Ahmadi", PhoneNumber: "+989121234567", Gender: "Female",
+			PersianDate: jalali.Date{Year: 1370, Month: 5, Day: 12},
+			Addresses:   []models.Address{{Kind: models.AddressKindHome, Subject: "Home", Details: "Valiasr St"}},
+		},
+		{Firstname: "=Ali", Lastname: "-Karimi", PhoneNumber: "+982188776655", Gender: "Male", PersianDate: jalali.Date{Year: 1365, Month: 1, Day: 20}},
+	}
+	for i := range stored {
+		if err := users.Create(ctx, &stored[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var buf bytes.Buffer
+	opts := exporter.Options{Format: exporter.FormatCSV, Addresses: exporter.AddressesColumns}
+	if err := exporter.Export(ctx, &buf, users, repository.UserQuery{}, opts); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "'+989121234567") {
+		t.Fatalf("export did not escape the phone number:\n%s", buf.String())
+	}
+
+	rows, err := ReadRows(&buf, FormatCSV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseRows(rows, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parsed) != len(stored) {
+		t.Fatalf("parsed %d rows, want %d", len(parsed), len(stored))
+	}
+	for i, row := range parsed {
+		want := stored[i]
+		got := row.User
+		if len(row.Errors) > 0 {
+			t.Errorf("row %d: %v", row.Line, row.Errors)
+		}
+		if got.Firstname != want.Firstname || got.Lastname != want.Lastname || got.PhoneNumber != want.PhoneNumber || got.PersianDate != want.PersianDate {
+			t.Errorf("row %d = %+v, want %+v", row.Line, got, want)
+		}
+		if len(got.Addresses) != len(want.Addresses) || (len(got.Addresses) > 0 && got.Addresses[0].Subject != want.Addresses[0].Subject) {
+			t.Errorf("row %d addresses = %+v, want %+v", row.Line, got.Addresses, want.Addresses)
+		}
+	}
+}
+
+func TestRunChecksStoredPhonesPerBatch(t *testing.T) {
+	ctx := context.Background()
+	store := repository.NewMemory()
+	existing := models.User{Firstname: "Sara", Lastname: "Ahmadi", PhoneNumber: "+989121234567", Gender: "Female", PersianDate: jalali.Date{Year: 1370, Month: 5, Day: 12}}
+	if err := store.Users().Create(ctx, &existing); err != nil {
+		t.Fatal(err)
+	}
+
+	rows := parse(t,
+		"Ali,Karimi,09351234567,male,1365/01/20",
+		"Sima,Ahmadi,0912 123 4567,female,1371/01/01",
+		"Reza,Karimi,09351234567,male,1380/11/02",
+		"Nima,Rahimi,02188776655,male,1380/11/02",
+	)
+	opts := Options{Mode: ModeSkipBadRows, BatchSize: 2}
+	if err := opts.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	report, err := Run(ctx, store, rows, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Inserted != 2 || report.ValidRows != 2 || report.InvalidRows != 2 {
+		t.Fatalf("report = %+v, want 2 inserted and 2 invalid", report)
+	}
+	if len(report.Rows) != 2 || report.Rows[0].Row != 3 || report.Rows[1].Row != 4 {
+		t.Fatalf("invalid rows = %+v, want rows 3 and 4", report.Rows)
+	}
+	if report.Rows[0].Errors[0].Code != validation.CodeDuplicatePhone {
+		t.Fatalf("row 3 errors = %v", report.Rows[0].Errors)
+	}
+}
+
+// slowStore pauses after every phone lookup, widening the window in which
+// a concurrent import could insert the number just checked.
+type slowStore struct {
+	repository.Store
+}
+
+func (s slowStore) Users() repository.UserRepository {
+	return slowUsers{s.Store.Users()}
+}
+
+func (s slowStore) Transaction(ctx context.Context, fn func(tx repository.Store) error) error {
+	return s.Store.Transaction(ctx, func(tx repository.Store) error {
+		return fn(slowStore{tx})
+	})
+}
+
+type slowUsers struct {
+	repository.UserRepository
+}
+
+func (u slowUsers) PhoneOwners(ctx context.Context, numbers []string) (map[string][]uint, error) {
+	owners, err := u.UserRepository.PhoneOwners(ctx, numbers)
+	time.Sleep(20 * time.Millisecond)
+	return owners, err
+}
+
+func TestRunRejectsConcurrentDuplicates(t *testing.T) {
+	stores := map[string]repository.Store{
+		"sql":    newSQLStore(t),
+		"memory": repository.NewMemory(),
+	}
+	for name, store := range stores {
+		store := slowStore{store}
+		t.Run(name, func(t *testing.T) {
+			const imports = 8
+			var wg sync.WaitGroup
+			inserted := make([]int, imports)
+			errs := make([]error, imports)
+			rows := make([][]Row, imports)
+			for i := range rows {
+				rows[i] = parse(t, fmt.Sprintf("User%d,Ahmadi,09121234567,female,1370/05/12", i))
+			}
+			for i := 0; i < imports; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					opts := Options{Mode: ModeSkipBadRows}
+					if i%2 == 0 {
+						opts.Mode = ModeAllOrNothing
+					}
+					if errs[i] = opts.Validate(); errs[i] != nil {
+						return
+					}
+					report, err := Run(context.Background(), store, rows[i], opts)
+					inserted[i], errs[i] = report.Inserted, err
+				}(i)
+			}
+			wg.Wait()
+
+			total := 0
+			for i := range inserted {
+				if errs[i] != nil {
+					t.Fatalf("import %d: %v", i, errs[i])
+				}
+				total += inserted[i]
+			}
+			if total != 1 {
+				t.Fatalf("inserted %d users with the same number, want 1", total)
+			}
+		})
+	}
+}
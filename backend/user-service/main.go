@@ -1,151 +1,354 @@
 package main
 
 import (
+	"context"
+	_ "embed"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
-	"time"
+	"os"
+	"strings"
 
 	"github.com/gorilla/mux"
 	"github.com/rs/cors"
-	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
-	"gorm.io/gorm/logger"
 
+	"back-forms/auth"
+	"back-forms/config"
+	"back-forms/database"
+	"back-forms/migrations"
+	"back-forms/openapi"
+	"back-forms/ratelimit"
+	"back-forms/server"
+	"back-forms/user-service/audit"
 	"back-forms/user-service/controllers"
+	"back-forms/user-service/idempotency"
 	"back-forms/user-service/models"
+	"back-forms/user-service/repository"
+	"back-forms/user-service/search"
+	"back-forms/user-service/validation"
 )
 
-func debugDatabase(db *gorm.DB) {
-	var userCount int64
-	db.Model(&models.User{}).Count(&userCount)
-	log.Printf("Total users: %d", userCount)
-
-	var addressCount int64
-	db.Model(&models.Address{}).Count(&addressCount)
-	log.Printf("Total addresses: %d", addressCount)
-
-	var addresses []models.Address
-	db.Find(&addresses)
-	for _, addr := range addresses {
-		log.Printf("Address ID: %d, User ID: %d, Subject: %s", addr.ID, addr.UserID, addr.Subject)
-	}
-
-	var result map[string]interface{}
-	db.Raw(`
-        SELECT 
-            tc.constraint_name, 
-            tc.table_name, 
-            kcu.column_name, 
-            ccu.table_name AS foreign_table_name,
-            ccu.column_name AS foreign_column_name 
-        FROM information_schema.table_constraints AS tc 
-        JOIN information_schema.key_column_usage AS kcu
-            ON tc.constraint_name = kcu.constraint_name
-        JOIN information_schema.constraint_column_usage AS ccu
-            ON ccu.constraint_name = tc.constraint_name
-        WHERE tc.constraint_type = 'FOREIGN KEY' 
-        AND tc.table_name = 'addresses';
-    `).Find(&result)
-	log.Printf("Foreign key details: %+v", result)
+// openAPIDocument describes every route of the service. It is served at
+// /openapi.json and, when enabled, checked against the traffic.
+//
+//go:embed openapi.yaml
+var openAPIDocument []byte
+
+// initDB brings the schema up to date, or checks that it is when
+// autoMigrate is off, and prepares the data the handlers rely on.
+func initDB(db *gorm.DB, migrator *migrations.Migrator, autoMigrate bool) error {
+	ctx := context.Background()
+	if autoMigrate {
+		log.Println("Running database migrations...")
+		applied, err := migrator.Up(ctx)
+		if err != nil {
+			return err
+		}
+		for _, migration := range applied {
+			log.Printf("Applied migration %04d_%s", migration.Version, migration.Name)
+		}
+	} else if err := migrator.Verify(ctx); err != nil {
+		return fmt.Errorf("%w; run the migrate up command", err)
+	}
+
+	// The audit callbacks go first so the backfills below are recorded too
+	log.Println("Enabling audit trail...")
+	if err := audit.Setup(db); err != nil {
+		return err
+	}
+	system := db.WithContext(audit.WithActor(ctx, audit.SystemActor))
+
+	log.Println("Normalizing phone numbers...")
+	if err := backfillPhones(system); err != nil {
+		return err
+	}
+
+	log.Println("Preparing operator accounts...")
+	if err := auth.Setup(db); err != nil {
+		return err
+	}
+
+	log.Println("Backfilling search text...")
+	return search.Backfill(system)
 }
 
-func initDB() (*gorm.DB, error) {
-	dsn := "user=myuser password=mypassword dbname=formsdb port=5432 sslmode=disable TimeZone=Asia/Tehran"
+// backfillPhones stores the phone numbers of users created before numbers
+// were normalized in E.164 form, keeping the old value as the input.
+func backfillPhones(db *gorm.DB) error {
+	var users []models.User
+	result := db.Where("phone_input = ''").FindInBatches(&users, 500, func(tx *gorm.DB, batch int) error {
+		for i := range users {
+			if err := tx.Omit("Addresses").Save(&users[i]).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected > 0 {
+		log.Printf("Normalized phone numbers of %d users", result.RowsAffected)
+	}
+	return nil
+}
 
-	newLogger := logger.New(
-		log.New(log.Writer(), "\r\n", log.LstdFlags),
-		logger.Config{
-			SlowThreshold:             time.Second,
-			LogLevel:                  logger.Info,
-			IgnoreRecordNotFoundError: false,
-			Colorful:                  true,
-		},
-	)
+// setupCORS allows the configured origins, which can change on reload.
+func setupCORS(origins *config.Origins, debug bool) *cors.Cors {
+	return cors.New(cors.Options{
+		AllowOriginFunc:  origins.Allowed,
+		AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+		AllowedHeaders:   []string{"Content-Type", "Authorization", "X-API-Key", "Idempotency-Key", "If-Match", "If-None-Match", "X-Request-ID"},
+		ExposedHeaders:   []string{"ETag", "X-Request-ID", "Idempotent-Replayed", "Retry-After", "RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "RateLimit-Policy"},
+		AllowCredentials: true,
+		Debug:            debug,
+	})
+}
 
-	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{
-		Logger: newLogger,
+// operatorActor attributes audited writes to the authenticated operator.
+func operatorActor(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if claims, ok := auth.ClaimsFrom(r.Context()); ok {
+			r = r.WithContext(audit.WithActor(r.Context(), claims.Username))
+		}
+		next.ServeHTTP(w, r)
 	})
+}
+
+// protect wraps h so that it only runs for callers granted every one of
+// perms.
+func protect(h http.Handler, perms ...string) http.Handler {
+	return auth.Require(perms...)(h)
+}
+
+// defaultRateLimits are the rate limit rules used unless the configured
+// rules override them; see ratelimit.ParseRules for the format.
+const defaultRateLimits = "auth.login=10/m,users.create=30/m:10,users.import=10/h,addresses.create=60/m"
+
+func newLimiter(db *gorm.DB, cfg config.RateLimit) (*ratelimit.Limiter, error) {
+	rules, err := ratelimit.ParseRules(defaultRateLimits)
 	if err != nil {
 		return nil, err
 	}
-
-	sqlDB, err := db.DB()
+	overrides, err := ratelimit.ParseRules(cfg.Rules)
 	if err != nil {
 		return nil, err
 	}
+	for name, limit := range overrides {
+		rules[name] = limit
+	}
 
-	sqlDB.SetMaxIdleConns(10)
-	sqlDB.SetMaxOpenConns(100)
-	sqlDB.SetConnMaxLifetime(time.Hour)
-
-	log.Println("Running database migrations...")
-	err = db.AutoMigrate(&models.User{}, &models.Address{})
-	if err != nil {
-		return nil, err
+	var store ratelimit.Store = ratelimit.NewMemoryStore()
+	if cfg.Store == "postgres" {
+		store = ratelimit.NewPostgresStore(db)
 	}
 
-	return db, nil
+	limiter := ratelimit.New(store, rules)
+	limiter.TrustProxy = cfg.TrustProxy
+	return limiter, nil
 }
 
-func setupCORS() *cors.Cors {
-	return cors.New(cors.Options{
-		AllowedOrigins:   []string{"http://localhost:3000"},
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Content-Type", "Authorization"},
-		AllowCredentials: true,
-		Debug:            true,
-	})
-}
+func setupRoutes(router *mux.Router, db *gorm.DB, authn *auth.Authenticator, limiter *ratelimit.Limiter, idem *idempotency.Store, phonePolicy validation.PhonePolicy) {
+	store := repository.NewSQL(db)
+
+	root := router.PathPrefix("/api").Subrouter()
+	root.Use(audit.Middleware)
+
+	// Authentication routes are open without a token
+	root.Handle("/auth/login", limiter.Wrap("auth.login", controllers.Login(db, authn))).Methods("POST")
+	root.HandleFunc("/auth/refresh", controllers.Refresh(db, authn)).Methods("POST")
+	root.HandleFunc("/auth/logout", controllers.Logout(db, authn)).Methods("POST")
+
+	// So is the public form: anyone may submit a user, so submissions are
+	// rate limited and their idempotency keys scoped by client IP. Operators
+	// may still authenticate, to be told which users share a phone number
+	submit := auth.Optional(authn, db)(operatorActor(idem.Wrap(controllers.SubmitUser(store, phonePolicy))))
+	root.Handle("/users", limiter.Wrap("users.create", submit)).Methods("POST")
+
+	// Region lookups feed the address dropdowns of the public form
+	root.HandleFunc("/provinces", controllers.GetProvinces()).Methods("GET")
+	root.HandleFunc("/provinces/{id}/cities", controllers.GetProvinceCities()).Methods("GET")
 
-func setupRoutes(router *mux.Router, db *gorm.DB) {
-	api := router.PathPrefix("/api").Subrouter()
+	api := root.NewRoute().Subrouter()
+	api.Use(auth.Middleware(authn, db), operatorActor)
+	api.HandleFunc("/auth/me", controllers.CurrentOperator(db)).Methods("GET")
 
 	// User routes
-	api.HandleFunc("/users", controllers.GetUsers(db)).Methods("GET")
-	api.HandleFunc("/users", controllers.SubmitUser(db)).Methods("POST")
-	api.HandleFunc("/users/{id}", controllers.GetUserById(db)).Methods("GET")
-	api.HandleFunc("/users/{id}", controllers.EditUser(db)).Methods("PUT")
+	api.Handle("/users", protect(controllers.GetUsers(store.Users()), auth.PermUsersRead)).Methods("GET")
+	api.Handle("/users/search", protect(controllers.SearchUsers(store.Users()), auth.PermUsersRead)).Methods("GET")
+	api.Handle("/users/import", limiter.Wrap("users.import", protect(controllers.ImportUsers(store, phonePolicy), auth.PermUsersWrite))).Methods("POST")
+	api.Handle("/users/export", protect(controllers.ExportUsers(store.Users()), auth.PermUsersRead)).Methods("GET")
+	api.Handle("/users/duplicates", protect(controllers.FindDuplicates(db), auth.PermUsersRead)).Methods("GET")
+	api.Handle("/users/merge", protect(controllers.MergeUsers(db), auth.PermUsersWrite, auth.PermUsersDelete)).Methods("POST")
+	api.Handle("/users/{id}", protect(controllers.GetUserById(store.Users()), auth.PermUsersRead)).Methods("GET")
+	api.Handle("/users/{id}", protect(controllers.EditUser(store, phonePolicy), auth.PermUsersWrite)).Methods("PUT")
+	api.Handle("/users/{id}", protect(controllers.PatchUser(store, phonePolicy), auth.PermUsersWrite)).Methods("PATCH")
+	api.Handle("/users/{id}", protect(controllers.DeleteUser(store), auth.PermUsersDelete)).Methods("DELETE")
+	api.Handle("/users/{id}/restore", protect(controllers.RestoreUser(store.Users()), auth.PermUsersDelete)).Methods("POST")
+	api.Handle("/users/{id}/history", protect(controllers.GetUserHistory(store.Users()), auth.PermUsersRead)).Methods("GET")
 
 	// Address routes
-	api.HandleFunc("/users/{id}/addresses", controllers.GetUserAddresses(db)).Methods("GET")
-	api.HandleFunc("/users/{id}/addresses", controllers.AddUserAddress(db)).Methods("POST")
-	api.HandleFunc("/users/{userId}/addresses/{addressId}", controllers.EditAddress(db)).Methods("PUT")
-	api.HandleFunc("/users/{userId}/addresses/{addressId}", controllers.DeleteAddress(db)).Methods("DELETE")
+	api.Handle("/users/{id}/addresses", protect(controllers.GetUserAddresses(store.Addresses()), auth.PermUsersRead)).Methods("GET")
+	api.Handle("/users/{id}/addresses", limiter.Wrap("addresses.create", protect(idem.Wrap(controllers.AddUserAddress(store)), auth.PermUsersWrite))).Methods("POST")
+	api.Handle("/users/{userId}/addresses/{addressId}", protect(controllers.EditAddress(store), auth.PermUsersWrite)).Methods("PUT")
+	api.Handle("/users/{userId}/addresses/{addressId}", protect(controllers.DeleteAddress(store.Addresses()), auth.PermUsersDelete)).Methods("DELETE")
 
 	// Stats route
-	api.HandleFunc("/user-stats", controllers.GetUserStats(db)).Methods("GET")
+	api.Handle("/user-stats", protect(controllers.GetUserStats(store.Users()), auth.PermUsersRead)).Methods("GET")
+
+	// Admin routes
+	admin := api.PathPrefix("/admin").Subrouter()
+	admin.Use(auth.Require(auth.PermAdmin))
+	admin.HandleFunc("/users/{id}", controllers.PurgeUser(store.Users())).Methods("DELETE")
+	admin.HandleFunc("/permissions", controllers.ListPermissions()).Methods("GET")
+	admin.HandleFunc("/roles", controllers.ListRoles(db)).Methods("GET")
+	admin.HandleFunc("/roles", controllers.CreateRole(db)).Methods("POST")
+	admin.HandleFunc("/roles/{id}", controllers.UpdateRole(db)).Methods("PUT")
+	admin.HandleFunc("/roles/{id}", controllers.DeleteRole(db)).Methods("DELETE")
+	admin.HandleFunc("/operators", controllers.ListOperators(db)).Methods("GET")
+	admin.HandleFunc("/operators", controllers.CreateOperator(db)).Methods("POST")
+	admin.HandleFunc("/operators/{id}", controllers.UpdateOperator(db)).Methods("PATCH")
+	admin.HandleFunc("/api-keys", controllers.ListAPIKeys(db)).Methods("GET")
+	admin.HandleFunc("/api-keys", controllers.CreateAPIKey(db)).Methods("POST")
+	admin.HandleFunc("/api-keys/{id}/rotate", controllers.RotateAPIKey(db)).Methods("POST")
+	admin.HandleFunc("/api-keys/{id}", controllers.RevokeAPIKey(db)).Methods("DELETE")
 
 	// Global OPTIONS handler
 	router.PathPrefix("/").Methods("OPTIONS").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-API-Key, Idempotency-Key, If-Match, If-None-Match, X-Request-ID")
 		w.WriteHeader(http.StatusOK)
 	})
 }
 
+// migrationCheck fails readiness while migrations are pending.
+func migrationCheck(migrator *migrations.Migrator) server.Check {
+	return server.Check{
+		Name: "migrations",
+		Run: func(ctx context.Context, _ *gorm.DB) error {
+			return migrator.Verify(ctx)
+		},
+	}
+}
+
+// splitCommand separates the flags from a migrate subcommand, as in
+// "user-service -config config.yaml migrate up".
+func splitCommand(args []string) (flags, command []string) {
+	for i, arg := range args {
+		if arg == "migrate" {
+			return args[:i], args[i+1:]
+		}
+	}
+	return args, nil
+}
+
 func main() {
+	args, command := splitCommand(os.Args[1:])
+	defaults := config.Default()
+	defaults.Server.Addr = ":8081"
+	loader := config.NewLoader(defaults, args)
+	cfg, err := loader.Load()
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	log.Printf("Configuration:\n%s", cfg)
+
+	phonePolicy, err := validation.ParsePhonePolicy(cfg.Users.PhoneUniqueness)
+	if err != nil {
+		log.Fatalf("Invalid users.phone_uniqueness: %v", err)
+	}
+
+	authn, err := auth.New(cfg.Auth.Secret)
+	if err != nil {
+		log.Fatalf("Invalid auth.secret: %v", err)
+	}
+	authn.AccessTTL = cfg.Auth.AccessTTL
+	authn.RefreshTTL = cfg.Auth.RefreshTTL
+
+	level := config.NewLevelVar(cfg.Log.Level)
+	origins := config.NewOrigins(cfg.CORS.AllowedOrigins)
+
 	log.Println("Initializing database connection...")
-	db, err := initDB()
+	db, err := database.Open(cfg.Database, level)
 	if err != nil {
+		log.Fatalf("Failed to connect to database: %v", err)
+	}
+	migrator, err := migrations.New(db)
+	if err != nil {
+		log.Fatalf("Failed to load migrations: %v", err)
+	}
+
+	if command != nil {
+		err := migrations.Command(context.Background(), migrator, command, os.Stdout)
+		if errors.Is(err, migrations.ErrUsage) {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		if err != nil {
+			log.Fatalf("migrate: %v", err)
+		}
+		return
+	}
+
+	if err := initDB(db, migrator, cfg.Database.AutoMigrate); err != nil {
 		log.Fatalf("Failed to initialize database: %v", err)
 	}
 
-	debugDatabase(db)
+	// The first operator account can be created from the configuration
+	if username := cfg.Auth.OperatorUsername; username != "" {
+		if err := auth.EnsureOperator(db, username, cfg.Auth.OperatorPassword); err != nil {
+			log.Fatalf("Failed to create operator %q: %v", username, err)
+		}
+	}
+
+	limiter, err := newLimiter(db, cfg.RateLimit)
+	if err != nil {
+		log.Fatalf("Invalid rate limits: %v", err)
+	}
+	log.Printf("Rate limits: %s", strings.Join(limiter.Rules(), ", "))
+
+	// Ready once the database answers and no migrations are pending
+	probes := server.NewProbes(db, migrationCheck(migrator))
+
+	doc, err := openapi.Load(openAPIDocument)
+	if err != nil {
+		log.Fatalf("Invalid OpenAPI document: %v", err)
+	}
 
 	router := mux.NewRouter()
-	setupRoutes(router, db)
-	corsHandler := setupCORS().Handler(router)
+	router.Use(doc.Middleware(openapi.Options{
+		Requests:  cfg.OpenAPI.ValidateRequests,
+		Responses: cfg.OpenAPI.ValidateResponses,
+	}))
+	router.Handle("/openapi.json", doc).Methods("GET")
+	probes.Register(router)
+	idem := idempotency.New(db, cfg.Idempotency.TTL)
+	idem.ClientIP = limiter.ClientIP
+	setupRoutes(router, db, authn, limiter, idem, phonePolicy)
+	if missing := doc.Undocumented(router); len(missing) > 0 {
+		log.Printf("Routes missing from the OpenAPI document: %s", strings.Join(missing, ", "))
+	}
+	corsHandler := setupCORS(origins, level.Enabled(config.LevelDebug)).Handler(router)
+
+	// Other settings need a restart to change
+	loader.Watch(func(next config.Config) {
+		origins.Set(next.CORS.AllowedOrigins)
+		level.Set(next.Log.Level)
+		log.Printf("Reloaded configuration: cors.allowed_origins=%v log.level=%s", next.CORS.AllowedOrigins, next.Log.Level)
+	})
 
-	server := &http.Server{
-		Addr:         ":8081",
+	srv := &http.Server{
+		Addr:         cfg.Server.Addr,
 		Handler:      corsHandler,
-		ReadTimeout:  15 * time.Second,
-		WriteTimeout: 15 * time.Second,
-		IdleTimeout:  60 * time.Second,
+		ReadTimeout:  cfg.Server.ReadTimeout,
+		WriteTimeout: cfg.Server.WriteTimeout,
+		IdleTimeout:  cfg.Server.IdleTimeout,
 	}
 
-	log.Printf("User Service starting on http://localhost%s", server.Addr)
-	if err := server.ListenAndServe(); err != nil {
-		log.Fatalf("Server failed to start: %v", err)
+	log.Printf("User Service starting on %s", srv.Addr)
+	if err := server.Run(srv, probes, db, cfg.Server.PreStopDelay, cfg.Server.ShutdownTimeout); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Fatalf("Server failed: %v", err)
 	}
 }
@@ -4,27 +4,101 @@ import (
 	"time"
 
 	"gorm.io/gorm"
+
+	"back-forms/jalali"
+	"back-forms/persian"
+	"back-forms/phone"
+	"back-forms/user-service/regions"
 )
 
 // User represents the structure of a user in the database.
+// PhoneNumber is stored in E.164 form; PhoneInput keeps what was typed.
 type User struct {
 	ID          uint           `json:"id" gorm:"primaryKey"`
 	Firstname   string         `json:"firstname" gorm:"not null"`
 	Lastname    string         `json:"lastname" gorm:"not null"`
-	PhoneNumber string         `json:"phone_number" gorm:"not null"`
+	PhoneNumber string         `json:"phone_number" gorm:"not null;index"`
+	PhoneInput  string         `json:"phone_input" gorm:"not null;default:''"`
 	Gender      string         `json:"gender" gorm:"not null"`
-	PersianDate string         `json:"persian_date" gorm:"not null"`
+	PersianDate jalali.Date    `json:"persian_date" gorm:"not null"`
 	CreatedAt   time.Time      `json:"created_at"`
 	DeletedAt   gorm.DeletedAt `json:"deleted_at" gorm:"index"`
 	Addresses   []Address      `json:"addresses" gorm:"foreignKey:UserID;references:ID"`
+	Version     uint           `json:"version" gorm:"not null;default:1"`
+	SearchText  string         `json:"-" gorm:"not null;default:''"`
+	// MergedIntoID is set on a user soft-deleted by a merge.
+	MergedIntoID *uint `json:"merged_into_id,omitempty" gorm:"index"`
+}
+
+// BeforeCreate starts every new user at version 1.
+func (u *User) BeforeCreate(tx *gorm.DB) error {
+	u.Version = 1
+	return nil
 }
 
+// BeforeSave stores the phone number in E.164 form, remembering the original
+// input, and keeps the normalized search text in sync with the user fields.
+func (u *User) BeforeSave(tx *gorm.DB) error {
+	if n, err := phone.Parse(u.PhoneNumber); err == nil && n.E164 != u.PhoneNumber {
+		u.PhoneInput = u.PhoneNumber
+		u.PhoneNumber = n.E164
+	} else if phone.Normalize(u.PhoneInput) != u.PhoneNumber {
+		// The number was given in canonical form, or changed without
+		// touching PhoneInput
+		u.PhoneInput = u.PhoneNumber
+	}
+
+	u.SearchText = persian.Normalize(u.Firstname + " " + u.Lastname + " " + persian.Digits(u.PhoneNumber) + " " + persian.Digits(u.PhoneInput))
+	return nil
+}
+
+// Address kinds stored in Address.Kind.
+const (
+	AddressKindHome  = "home"
+	AddressKindWork  = "work"
+	AddressKindOther = "other"
+)
+
 // Address represents the structure of an address associated with a user.
+// Province and City hold the canonical names from the regions dataset.
 type Address struct {
-	ID      uint   `json:"id" gorm:"primaryKey"`
-	UserID  uint   `json:"user_id" gorm:"not null"`
-	Subject string `json:"subject" gorm:"not null"`
-	Details string `json:"details" gorm:"not null"`
+	ID         uint           `json:"id" gorm:"primaryKey"`
+	UserID     uint           `json:"user_id" gorm:"not null"`
+	Kind       string         `json:"kind" gorm:"not null;default:'other'"`
+	Subject    string         `json:"subject" gorm:"not null"`
+	Details    string         `json:"details" gorm:"not null"`
+	Province   string         `json:"province" gorm:"not null;default:'';index:idx_addresses_region"`
+	City       string         `json:"city" gorm:"not null;default:'';index:idx_addresses_region"`
+	PostalCode string         `json:"postal_code" gorm:"not null;default:''"`
+	Plate      string         `json:"plate" gorm:"not null;default:''"`
+	Unit       string         `json:"unit" gorm:"not null;default:''"`
+	DeletedAt  gorm.DeletedAt `json:"deleted_at,omitempty" gorm:"index"`
+	Version    uint           `json:"version" gorm:"not null;default:1"`
+	SearchText string         `json:"-" gorm:"not null;default:''"`
+}
+
+// BeforeCreate starts every new address at version 1.
+func (a *Address) BeforeCreate(tx *gorm.DB) error {
+	a.Version = 1
+	return nil
+}
+
+// BeforeSave canonicalizes the structured fields and keeps the normalized
+// search text in sync with the address fields.
+func (a *Address) BeforeSave(tx *gorm.DB) error {
+	if a.Kind == "" {
+		a.Kind = AddressKindOther
+	}
+	if province, ok := regions.FindProvince(a.Province); ok {
+		a.Province = province.Name
+		if city, ok := province.FindCity(a.City); ok {
+			a.City = city
+		}
+	}
+	a.PostalCode = persian.Digits(a.PostalCode)
+
+	a.SearchText = persian.Normalize(a.Subject + " " + a.Details + " " + a.Province + " " + a.City + " " + a.PostalCode)
+	return nil
 }
 
 // UserStats represents the aggregated user statistics.
@@ -0,0 +1,64 @@
+// Package regions provides an offline reference list of Iranian provinces
+// and their main cities for address validation and form dropdowns.
+package regions
+
+import (
+	_ "embed"
+	"encoding/json"
+	"strings"
+
+	"back-forms/persian"
+)
+
+//go:embed iran.json
+var iranJSON []byte
+
+// Province is a province together with the cities accepted in it.
+type Province struct {
+	ID     string   `json:"id"`
+	Name   string   `json:"name"`
+	NameEn string   `json:"name_en"`
+	Cities []string `json:"cities"`
+}
+
+var provinces []Province
+
+func init() {
+	if err := json.Unmarshal(iranJSON, &provinces); err != nil {
+		panic("regions: invalid embedded dataset: " + err.Error())
+	}
+}
+
+// Provinces returns all provinces in dataset order.
+func Provinces() []Province {
+	return provinces
+}
+
+// FindProvince looks a province up by ID, Persian name or English name.
+// Names are compared after Persian normalization.
+func FindProvince(value string) (Province, bool) {
+	key := persian.Normalize(value)
+	if key == "" {
+		return Province{}, false
+	}
+	for _, p := range provinces {
+		if key == p.ID || key == persian.Normalize(p.Name) || key == strings.ToLower(p.NameEn) {
+			return p, true
+		}
+	}
+	return Province{}, false
+}
+
+// FindCity returns the canonical spelling of a city in p.
+func (p Province) FindCity(value string) (string, bool) {
+	key := persian.Normalize(value)
+	if key == "" {
+		return "", false
+	}
+	for _, city := range p.Cities {
+		if key == persian.Normalize(city) {
+			return city, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,537 @@
+package repository
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+
+	"back-forms/user-service/audit"
+	"back-forms/user-service/models"
+	"back-forms/user-service/search"
+)
+
+// Memory is a Store that keeps users and addresses in process memory. It
+// runs the model hooks like the database does, but not the audit
+// callbacks. Transactions work on a copy of the data that replaces it on
+// commit, and hold a lock that serializes them with every other call.
+type Memory struct {
+	mu   sync.Mutex
+	data *memoryData
+}
+
+// memoryData is the content of a Memory store. Users are kept without
+// their addresses.
+type memoryData struct {
+	users         map[uint]models.User
+	addresses     map[uint]models.Address
+	lastUserID    uint
+	lastAddressID uint
+}
+
+// NewMemory returns an empty Memory store.
+func NewMemory() *Memory {
+	return &Memory{data: &memoryData{users: map[uint]models.User{}, addresses: map[uint]models.Address{}}}
+}
+
+// Users implements Store.
+func (m *Memory) Users() UserRepository {
+	return memoryUsers{memoryView{store: m}}
+}
+
+// Addresses implements Store.
+func (m *Memory) Addresses() AddressRepository {
+	return memoryAddresses{memoryView{store: m}}
+}
+
+// Transaction implements Store.
+func (m *Memory) Transaction(ctx context.Context, fn func(tx Store) error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	data := m.data.clone()
+	if err := fn(&memoryTx{data: data}); err != nil {
+		return err
+	}
+	m.data = data
+	return nil
+}
+
+// memoryTx is the Store passed to a Memory transaction. Its repositories
+// work on the copy without locking, since the transaction holds the lock.
+type memoryTx struct {
+	data *memoryData
+}
+
+func (t *memoryTx) Users() UserRepository {
+	return memoryUsers{memoryView{tx: t.data}}
+}
+
+func (t *memoryTx) Addresses() AddressRepository {
+	return memoryAddresses{memoryView{tx: t.data}}
+}
+
+// Transaction runs nested transactions as part of the outer one.
+func (t *memoryTx) Transaction(ctx context.Context, fn func(tx Store) error) error {
+	return fn(t)
+}
+
+// memoryView gives repositories access to either the store's data or the
+// copy of a transaction.
+type memoryView struct {
+	store *Memory
+	tx    *memoryData
+}
+
+// do runs fn on the data. Outside a transaction a failing fn must not have
+// changed anything.
+func (v memoryView) do(fn func(d *memoryData) error) error {
+	if v.tx != nil {
+		return fn(v.tx)
+	}
+	v.store.mu.Lock()
+	defer v.store.mu.Unlock()
+	return fn(v.store.data)
+}
+
+func (d *memoryData) clone() *memoryData {
+	c := &memoryData{
+		users:         make(map[uint]models.User, len(d.users)),
+		addresses:     make(map[uint]models.Address, len(d.addresses)),
+		lastUserID:    d.lastUserID,
+		lastAddressID: d.lastAddressID,
+	}
+	for id, user := range d.users {
+		c.users[id] = user
+	}
+	for id, address := range d.addresses {
+		c.addresses[id] = address
+	}
+	return c
+}
+
+// user returns a live user with its live addresses.
+func (d *memoryData) user(id uint) (models.User, bool) {
+	user, ok := d.users[id]
+	if !ok || user.DeletedAt.Valid {
+		return models.User{}, false
+	}
+	user.Addresses = d.userAddresses(id)
+	return user, true
+}
+
+// userAddresses returns the live addresses of a user ordered by ID.
+func (d *memoryData) userAddresses(userID uint) []models.Address {
+	addresses := []models.Address{}
+	for _, address := range d.addresses {
+		if address.UserID == userID && !address.DeletedAt.Valid {
+			addresses = append(addresses, address)
+		}
+	}
+	sort.Slice(addresses, func(i, j int) bool { return addresses[i].ID < addresses[j].ID })
+	return addresses
+}
+
+func (d *memoryData) insertAddress(address *models.Address) error {
+	if err := address.BeforeCreate(nil); err != nil {
+		return err
+	}
+	if err := address.BeforeSave(nil); err != nil {
+		return err
+	}
+	d.lastAddressID++
+	address.ID = d.lastAddressID
+	d.addresses[address.ID] = *address
+	return nil
+}
+
+type memoryUsers struct {
+	memoryView
+}
+
+func (r memoryUsers) Create(ctx context.Context, user *models.User) error {
+	return r.do(func(d *memoryData) error {
+		if err := user.BeforeCreate(nil); err != nil {
+			return err
+		}
+		if err := user.BeforeSave(nil); err != nil {
+			return err
+		}
+		d.lastUserID++
+		user.ID = d.lastUserID
+		if user.CreatedAt.IsZero() {
+			user.CreatedAt = time.Now()
+		}
+		for i := range user.Addresses {
+			user.Addresses[i].UserID = user.ID
+			if err := d.insertAddress(&user.Addresses[i]); err != nil {
+				return err
+			}
+		}
+		stored := *user
+		stored.Addresses = nil
+		d.users[user.ID] = stored
+		return nil
+	})
+}
+
+func (r memoryUsers) CreateBatch(ctx context.Context, users []models.User) error {
+	for i := range users {
+		if err := r.Create(ctx, &users[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r memoryUsers) Get(ctx context.Context, id uint) (models.User, error) {
+	var user models.User
+	err := r.do(func(d *memoryData) error {
+		var ok bool
+		if user, ok = d.user(id); !ok {
+			return ErrNotFound
+		}
+		return nil
+	})
+	return user, err
+}
+
+// GetForUpdate needs no row lock: transactions are already serialized.
+func (r memoryUsers) GetForUpdate(ctx context.Context, id uint) (models.User, error) {
+	return r.Get(ctx, id)
+}
+
+func (r memoryUsers) GetIncludingDeleted(ctx context.Context, id uint) (models.User, error) {
+	var user models.User
+	err := r.do(func(d *memoryData) error {
+		var ok bool
+		if user, ok = d.users[id]; !ok {
+			return ErrNotFound
+		}
+		return nil
+	})
+	return user, err
+}
+
+func (r memoryUsers) List(ctx context.Context, q UserQuery) ([]models.User, int64, error) {
+	users := []models.User{}
+	var total int64
+	err := r.do(func(d *memoryData) error {
+		var matched []models.User
+		for _, user := range d.users {
+			if matchesUser(user, q) {
+				matched = append(matched, user)
+			}
+		}
+		total = int64(len(matched))
+
+		sortFields := withID(q.Sort)
+		sort.Slice(matched, func(i, j int) bool {
+			for _, field := range sortFields {
+				cmp, ok := userColumns[field.Column]
+				if !ok {
+					continue
+				}
+				if c := cmp(matched[i], matched[j]); c != 0 {
+					return (c < 0) != field.Desc
+				}
+			}
+			return false
+		})
+
+		for _, user := range matched {
+			if q.After != 0 && (descendingByID(q.Sort) && user.ID >= q.After || !descendingByID(q.Sort) && user.ID <= q.After) {
+				continue
+			}
+			users = append(users, user)
+		}
+		users = page(users, q.Offset, q.Limit)
+		if q.WithAddresses {
+			for i := range users {
+				users[i].Addresses = d.userAddresses(users[i].ID)
+			}
+		}
+		return nil
+	})
+	return users, total, err
+}
+
+// matchesUser reports whether user passes the filters of q.
+func matchesUser(user models.User, q UserQuery) bool {
+	date := user.PersianDate.Compact()
+	name := strings.ToLower(q.Name)
+	switch {
+	case user.DeletedAt.Valid && !q.IncludeDeleted:
+	case q.Gender != "" && user.Gender != q.Gender:
+	case !q.DateFrom.IsZero() && date < q.DateFrom.Compact():
+	case !q.DateTo.IsZero() && date > q.DateTo.Compact():
+	case name != "" && !strings.HasPrefix(strings.ToLower(user.Firstname), name) && !strings.HasPrefix(strings.ToLower(user.Lastname), name):
+	case q.PhonePrefix != "" && !strings.HasPrefix(user.PhoneNumber, q.PhonePrefix):
+	default:
+		return true
+	}
+	return false
+}
+
+func page(users []models.User, offset, limit int) []models.User {
+	if offset >= len(users) {
+		return []models.User{}
+	}
+	users = users[offset:]
+	if limit > 0 && limit < len(users) {
+		users = users[:limit]
+	}
+	return users
+}
+
+func (r memoryUsers) Each(ctx context.Context, q UserQuery, size int, fn func(users []models.User) error) error {
+	q.After, q.Offset, q.Limit = 0, 0, 0
+	users, _, err := r.List(ctx, q)
+	if err != nil {
+		return err
+	}
+	for start := 0; start < len(users); start += size {
+		end := start + size
+		if end > len(users) {
+			end = len(users)
+		}
+		if err := fn(users[start:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r memoryUsers) MaxAddresses(ctx context.Context, q UserQuery) (int, error) {
+	max := 0
+	err := r.do(func(d *memoryData) error {
+		for _, user := range d.users {
+			if n := len(d.userAddresses(user.ID)); matchesUser(user, q) && n > max {
+				max = n
+			}
+		}
+		return nil
+	})
+	return max, err
+}
+
+func (r memoryUsers) ListByDate(ctx context.Context, period string) ([]models.User, error) {
+	users := []models.User{}
+	err := r.do(func(d *memoryData) error {
+		for _, user := range d.users {
+			if !user.DeletedAt.Valid && strings.Contains(user.PersianDate.Compact(), period) {
+				users = append(users, user)
+			}
+		}
+		sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+		return nil
+	})
+	return users, err
+}
+
+// History is always empty, since Memory keeps no audit trail.
+func (r memoryUsers) History(ctx context.Context, userID uint, offset, limit int) ([]audit.Entry, int64, error) {
+	return []audit.Entry{}, 0, nil
+}
+
+// Search ranks substring matches like the database does; there is no
+// fuzzy matching.
+func (r memoryUsers) Search(ctx context.Context, q string, limit int) ([]search.Result, error) {
+	term := search.Term(q)
+	results := []search.Result{}
+	if term == "" {
+		return results, nil
+	}
+	err := r.do(func(d *memoryData) error {
+		for id := range d.users {
+			user, ok := d.user(id)
+			if !ok {
+				continue
+			}
+			rank := 0.0
+			if strings.Contains(user.SearchText, term) {
+				rank = 1
+			} else {
+				for _, address := range user.Addresses {
+					if strings.Contains(address.SearchText, term) {
+						rank = 0.9
+						break
+					}
+				}
+			}
+			if rank > 0 {
+				results = append(results, search.Result{User: user, Rank: rank})
+			}
+		}
+		return nil
+	})
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Rank != results[j].Rank {
+			return results[i].Rank > results[j].Rank
+		}
+		return results[i].ID < results[j].ID
+	})
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	return results, err
+}
+
+func (r memoryUsers) PhoneOwners(ctx context.Context, numbers []string) (map[string][]uint, error) {
+	owners := map[string][]uint{}
+	err := r.do(func(d *memoryData) error {
+		wanted := make(map[string]bool, len(numbers))
+		for _, number := range numbers {
+			wanted[number] = true
+		}
+		for _, user := range d.users {
+			if !user.DeletedAt.Valid && wanted[user.PhoneNumber] {
+				owners[user.PhoneNumber] = append(owners[user.PhoneNumber], user.ID)
+			}
+		}
+		for _, ids := range owners {
+			sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		}
+		return nil
+	})
+	return owners, err
+}
+
+// LockPhones has nothing to do, since transactions hold the store lock.
+func (r memoryUsers) LockPhones(ctx context.Context, numbers []string) error {
+	return nil
+}
+
+func (r memoryUsers) Update(ctx context.Context, user *models.User) error {
+	return r.do(func(d *memoryData) error {
+		if _, ok := d.users[user.ID]; !ok {
+			return ErrNotFound
+		}
+		if err := user.BeforeSave(nil); err != nil {
+			return err
+		}
+		stored := *user
+		stored.Addresses = nil
+		d.users[user.ID] = stored
+		return nil
+	})
+}
+
+func (r memoryUsers) Delete(ctx context.Context, user *models.User) error {
+	return r.do(func(d *memoryData) error {
+		stored, ok := d.users[user.ID]
+		if !ok {
+			return ErrNotFound
+		}
+		deletedAt := gorm.DeletedAt{Time: time.Now(), Valid: true}
+		for id, address := range d.addresses {
+			if address.UserID == user.ID && !address.DeletedAt.Valid {
+				address.DeletedAt = deletedAt
+				d.addresses[id] = address
+			}
+		}
+		stored.DeletedAt = deletedAt
+		d.users[user.ID] = stored
+		user.DeletedAt = deletedAt
+		return nil
+	})
+}
+
+func (r memoryUsers) Restore(ctx context.Context, user models.User) error {
+	return r.do(func(d *memoryData) error {
+		stored, ok := d.users[user.ID]
+		if !ok {
+			return ErrNotFound
+		}
+		for id, address := range d.addresses {
+			if address.UserID == user.ID && address.DeletedAt.Valid && address.DeletedAt.Time.Equal(user.DeletedAt.Time) {
+				address.DeletedAt = gorm.DeletedAt{}
+				d.addresses[id] = address
+			}
+		}
+		stored.DeletedAt = gorm.DeletedAt{}
+		stored.MergedIntoID = nil
+		d.users[user.ID] = stored
+		return nil
+	})
+}
+
+func (r memoryUsers) Purge(ctx context.Context, id uint) error {
+	return r.do(func(d *memoryData) error {
+		if _, ok := d.users[id]; !ok {
+			return ErrNotFound
+		}
+		for addressID, address := range d.addresses {
+			if address.UserID == id {
+				delete(d.addresses, addressID)
+			}
+		}
+		delete(d.users, id)
+		return nil
+	})
+}
+
+type memoryAddresses struct {
+	memoryView
+}
+
+func (r memoryAddresses) ListByUser(ctx context.Context, userID uint) ([]models.Address, error) {
+	var addresses []models.Address
+	err := r.do(func(d *memoryData) error {
+		addresses = d.userAddresses(userID)
+		return nil
+	})
+	return addresses, err
+}
+
+func (r memoryAddresses) Get(ctx context.Context, userID, id uint) (models.Address, error) {
+	var address models.Address
+	err := r.do(func(d *memoryData) error {
+		var ok bool
+		address, ok = d.addresses[id]
+		if !ok || address.UserID != userID || address.DeletedAt.Valid {
+			return ErrNotFound
+		}
+		return nil
+	})
+	return address, err
+}
+
+// GetForUpdate needs no row lock: transactions are already serialized.
+func (r memoryAddresses) GetForUpdate(ctx context.Context, userID, id uint) (models.Address, error) {
+	return r.Get(ctx, userID, id)
+}
+
+func (r memoryAddresses) Create(ctx context.Context, address *models.Address) error {
+	return r.do(func(d *memoryData) error {
+		return d.insertAddress(address)
+	})
+}
+
+func (r memoryAddresses) Update(ctx context.Context, address *models.Address) error {
+	return r.do(func(d *memoryData) error {
+		if _, ok := d.addresses[address.ID]; !ok {
+			return ErrNotFound
+		}
+		if err := address.BeforeSave(nil); err != nil {
+			return err
+		}
+		d.addresses[address.ID] = *address
+		return nil
+	})
+}
+
+func (r memoryAddresses) Delete(ctx context.Context, address models.Address) error {
+	return r.do(func(d *memoryData) error {
+		stored, ok := d.addresses[address.ID]
+		if !ok || stored.DeletedAt.Valid || stored.Version != address.Version {
+			return ErrVersionConflict
+		}
+		stored.DeletedAt = gorm.DeletedAt{Time: time.Now(), Valid: true}
+		d.addresses[address.ID] = stored
+		return nil
+	})
+}
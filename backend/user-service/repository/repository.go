@@ -0,0 +1,176 @@
+// Package repository stores users and addresses. Handlers depend on the
+// interfaces here instead of on a database: SQL backs them in the service
+// and Memory keeps everything in process memory, so the HTTP behavior can
+// be exercised without a database.
+package repository
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"back-forms/jalali"
+	"back-forms/user-service/audit"
+	"back-forms/user-service/models"
+	"back-forms/user-service/search"
+)
+
+var (
+	// ErrNotFound is returned when the requested row does not exist or is
+	// soft-deleted.
+	ErrNotFound = errors.New("not found")
+	// ErrVersionConflict is returned when a row changed since it was read.
+	ErrVersionConflict = errors.New("version conflict")
+)
+
+// UserRepository stores users. Reads only return live users unless stated
+// otherwise.
+type UserRepository interface {
+	// Create inserts user together with its addresses.
+	Create(ctx context.Context, user *models.User) error
+	// CreateBatch inserts users together with their addresses, in as few
+	// statements as the store allows.
+	CreateBatch(ctx context.Context, users []models.User) error
+	// Get returns a user with its live addresses.
+	Get(ctx context.Context, id uint) (models.User, error)
+	// GetForUpdate is Get that also locks the user until the surrounding
+	// transaction ends.
+	GetForUpdate(ctx context.Context, id uint) (models.User, error)
+	// GetIncludingDeleted returns a user even when it is soft-deleted,
+	// without its addresses.
+	GetIncludingDeleted(ctx context.Context, id uint) (models.User, error)
+	// List returns the users selected by q and how many match its filters
+	// regardless of paging.
+	List(ctx context.Context, q UserQuery) ([]models.User, int64, error)
+	// Each calls fn with the users selected by the filters and sort of q, a
+	// chunk of up to size users at a time, so that all of them need not be
+	// held in memory. Paging is ignored. fn must not keep the chunk.
+	Each(ctx context.Context, q UserQuery, size int, fn func(users []models.User) error) error
+	// MaxAddresses returns the largest number of addresses held by any of
+	// the users selected by the filters of q.
+	MaxAddresses(ctx context.Context, q UserQuery) (int, error)
+	// ListByDate returns the users whose compact birth date contains period,
+	// such as "140203" for a month, without their addresses.
+	ListByDate(ctx context.Context, period string) ([]models.User, error)
+	// History returns the audit entries of a user and its addresses, oldest
+	// first, and how many there are regardless of paging.
+	History(ctx context.Context, userID uint, offset, limit int) ([]audit.Entry, int64, error)
+	// Search returns up to limit users matching q by name, phone number or
+	// address, best match first.
+	Search(ctx context.Context, q string, limit int) ([]search.Result, error)
+	// PhoneOwners returns the IDs of the users using each of the given E.164
+	// numbers.
+	PhoneOwners(ctx context.Context, numbers []string) (map[string][]uint, error)
+	// LockPhones keeps other transactions from writing users with any of
+	// the given E.164 numbers until the surrounding transaction ends, so
+	// that a number can be checked for uniqueness and then written.
+	LockPhones(ctx context.Context, numbers []string) error
+	// Update saves the fields of user. Its addresses are left alone.
+	Update(ctx context.Context, user *models.User) error
+	// Delete soft-deletes user and its live addresses, stamping them with
+	// the same time so that Restore only brings back those addresses.
+	Delete(ctx context.Context, user *models.User) error
+	// Restore undoes Delete and clears the merge of user.
+	Restore(ctx context.Context, user models.User) error
+	// Purge permanently removes a user and all of its addresses, including
+	// soft-deleted ones.
+	Purge(ctx context.Context, id uint) error
+}
+
+// AddressRepository stores addresses. Reads only return live addresses.
+type AddressRepository interface {
+	// ListByUser returns the addresses of a user.
+	ListByUser(ctx context.Context, userID uint) ([]models.Address, error)
+	// Get returns an address of a user.
+	Get(ctx context.Context, userID, id uint) (models.Address, error)
+	// GetForUpdate is Get that also locks the address until the surrounding
+	// transaction ends.
+	GetForUpdate(ctx context.Context, userID, id uint) (models.Address, error)
+	// Create inserts address.
+	Create(ctx context.Context, address *models.Address) error
+	// Update saves the fields of address.
+	Update(ctx context.Context, address *models.Address) error
+	// Delete soft-deletes address, or returns ErrVersionConflict when it
+	// changed since it was read.
+	Delete(ctx context.Context, address models.Address) error
+}
+
+// Store hands out the repositories and runs transactions across them.
+type Store interface {
+	Users() UserRepository
+	Addresses() AddressRepository
+	// Transaction runs fn with a Store whose repositories share one
+	// transaction. It commits when fn returns nil and rolls back otherwise.
+	Transaction(ctx context.Context, fn func(tx Store) error) error
+}
+
+// UserQuery selects users for List.
+type UserQuery struct {
+	Gender string
+	// DateFrom and DateTo bound the birth date, inclusive, when not zero.
+	DateFrom jalali.Date
+	DateTo   jalali.Date
+	// Name matches the start of the first or last name, ignoring case.
+	Name string
+	// PhonePrefix matches the start of the E.164 phone number.
+	PhonePrefix    string
+	IncludeDeleted bool
+	// Sort orders the users. The id column is always the last tiebreaker.
+	Sort []SortField
+	// After keeps the users that come after this ID in the sort order, which
+	// must then be by id alone. Zero starts at the beginning.
+	After  uint
+	Offset int
+	// Limit caps the number of users returned; zero returns all of them.
+	Limit         int
+	WithAddresses bool
+}
+
+// SortField is one key of a user ordering.
+type SortField struct {
+	Column string
+	Desc   bool
+}
+
+// userColumns compares two users by each sortable column.
+var userColumns = map[string]func(a, b models.User) int{
+	"id":           func(a, b models.User) int { return compare(a.ID, b.ID) },
+	"firstname":    func(a, b models.User) int { return strings.Compare(a.Firstname, b.Firstname) },
+	"lastname":     func(a, b models.User) int { return strings.Compare(a.Lastname, b.Lastname) },
+	"phone_number": func(a, b models.User) int { return strings.Compare(a.PhoneNumber, b.PhoneNumber) },
+	"gender":       func(a, b models.User) int { return strings.Compare(a.Gender, b.Gender) },
+	"persian_date": func(a, b models.User) int { return strings.Compare(a.PersianDate.Compact(), b.PersianDate.Compact()) },
+	"created_at":   func(a, b models.User) int { return a.CreatedAt.Compare(b.CreatedAt) },
+}
+
+// SortableColumn reports whether users can be sorted by column.
+func SortableColumn(column string) bool {
+	_, ok := userColumns[column]
+	return ok
+}
+
+// withID appends the id tiebreaker to sort unless it is already there.
+func withID(sort []SortField) []SortField {
+	for _, field := range sort {
+		if field.Column == "id" {
+			return sort
+		}
+	}
+	return append(sort[:len(sort):len(sort)], SortField{Column: "id"})
+}
+
+// descendingByID reports whether sort orders by id from newest to oldest,
+// which makes After keep the smaller IDs.
+func descendingByID(sort []SortField) bool {
+	return len(sort) > 0 && sort[0].Column == "id" && sort[0].Desc
+}
+
+func compare(a, b uint) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,360 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"back-forms/user-service/audit"
+	"back-forms/user-service/models"
+	"back-forms/user-service/search"
+	"back-forms/user-service/validation"
+)
+
+// SQL is a Store backed by the service database, Postgres or SQLite.
+type SQL struct {
+	db *gorm.DB
+}
+
+// NewSQL returns a Store using db.
+func NewSQL(db *gorm.DB) *SQL {
+	return &SQL{db: db}
+}
+
+// Users implements Store.
+func (p *SQL) Users() UserRepository {
+	return sqlUsers{p.db}
+}
+
+// Addresses implements Store.
+func (p *SQL) Addresses() AddressRepository {
+	return sqlAddresses{p.db}
+}
+
+// Transaction implements Store.
+func (p *SQL) Transaction(ctx context.Context, fn func(tx Store) error) error {
+	return p.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		return fn(&SQL{db: tx})
+	})
+}
+
+// filterUsers returns a scope narrowing a users query to the filters of q.
+// Sorting and paging are left to the caller.
+func filterUsers(q UserQuery) func(*gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		if q.IncludeDeleted {
+			db = db.Unscoped()
+		}
+		if q.Gender != "" {
+			db = db.Where("gender = ?", q.Gender)
+		}
+		if !q.DateFrom.IsZero() {
+			db = db.Where("persian_date >= ?", q.DateFrom.Compact())
+		}
+		if !q.DateTo.IsZero() {
+			db = db.Where("persian_date <= ?", q.DateTo.Compact())
+		}
+		if q.Name != "" {
+			// SQLite's LIKE already ignores case, Postgres needs ILIKE
+			like := "LIKE"
+			if db.Dialector.Name() == "postgres" {
+				like = "ILIKE"
+			}
+			prefix := escapeLike(q.Name) + "%"
+			db = db.Where(`firstname `+like+` ? ESCAPE '\' OR lastname `+like+` ? ESCAPE '\'`, prefix, prefix)
+		}
+		if q.PhonePrefix != "" {
+			db = db.Where(`phone_number LIKE ? ESCAPE '\'`, escapeLike(q.PhonePrefix)+"%")
+		}
+		return db
+	}
+}
+
+// orderUsers returns a scope ordering a users query by sort, with id as the
+// last tiebreaker. Unknown columns are ignored.
+func orderUsers(sort []SortField) func(*gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		for _, field := range withID(sort) {
+			if SortableColumn(field.Column) {
+				db = db.Order(clause.OrderByColumn{Column: clause.Column{Name: field.Column}, Desc: field.Desc})
+			}
+		}
+		return db
+	}
+}
+
+type sqlUsers struct {
+	db *gorm.DB
+}
+
+func (r sqlUsers) Create(ctx context.Context, user *models.User) error {
+	return r.db.WithContext(ctx).Create(user).Error
+}
+
+func (r sqlUsers) CreateBatch(ctx context.Context, users []models.User) error {
+	return r.db.WithContext(ctx).Create(&users).Error
+}
+
+func (r sqlUsers) Get(ctx context.Context, id uint) (models.User, error) {
+	var user models.User
+	err := r.db.WithContext(ctx).Preload("Addresses").First(&user, id).Error
+	return user, notFound(err)
+}
+
+func (r sqlUsers) GetForUpdate(ctx context.Context, id uint) (models.User, error) {
+	var user models.User
+	err := r.db.WithContext(ctx).Clauses(clause.Locking{Strength: "UPDATE"}).Preload("Addresses").First(&user, id).Error
+	return user, notFound(err)
+}
+
+func (r sqlUsers) GetIncludingDeleted(ctx context.Context, id uint) (models.User, error) {
+	var user models.User
+	err := r.db.WithContext(ctx).Unscoped().First(&user, id).Error
+	return user, notFound(err)
+}
+
+func (r sqlUsers) List(ctx context.Context, q UserQuery) ([]models.User, int64, error) {
+	query := r.db.WithContext(ctx).Model(&models.User{}).Scopes(filterUsers(q))
+
+	var total int64
+	if err := query.Session(&gorm.Session{}).Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	query = query.Scopes(orderUsers(q.Sort))
+	if q.WithAddresses {
+		query = query.Preload("Addresses")
+	}
+	if q.After != 0 {
+		if descendingByID(q.Sort) {
+			query = query.Where("id < ?", q.After)
+		} else {
+			query = query.Where("id > ?", q.After)
+		}
+	}
+	if q.Offset > 0 {
+		query = query.Offset(q.Offset)
+	}
+	if q.Limit > 0 {
+		query = query.Limit(q.Limit)
+	}
+
+	users := []models.User{}
+	if err := query.Find(&users).Error; err != nil {
+		return nil, 0, err
+	}
+	return users, total, nil
+}
+
+func (r sqlUsers) Each(ctx context.Context, q UserQuery, size int, fn func(users []models.User) error) error {
+	db := r.db.WithContext(ctx)
+	rows, err := db.Model(&models.User{}).Scopes(filterUsers(q), orderUsers(q.Sort)).Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	batch := make([]models.User, 0, size)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if q.WithAddresses {
+			if err := loadAddresses(db, batch); err != nil {
+				return err
+			}
+		}
+		if err := fn(batch); err != nil {
+			return err
+		}
+		batch = batch[:0]
+		return nil
+	}
+
+	for rows.Next() {
+		var user models.User
+		if err := db.ScanRows(rows, &user); err != nil {
+			return err
+		}
+		batch = append(batch, user)
+		if len(batch) == size {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return flush()
+}
+
+// loadAddresses fills in the live addresses of users with one query.
+func loadAddresses(db *gorm.DB, users []models.User) error {
+	ids := make([]uint, len(users))
+	index := make(map[uint]int, len(users))
+	for i, user := range users {
+		ids[i] = user.ID
+		index[user.ID] = i
+	}
+
+	var addresses []models.Address
+	if err := db.Where("user_id IN ?", ids).Order("id").Find(&addresses).Error; err != nil {
+		return err
+	}
+	for _, address := range addresses {
+		i := index[address.UserID]
+		users[i].Addresses = append(users[i].Addresses, address)
+	}
+	return nil
+}
+
+func (r sqlUsers) MaxAddresses(ctx context.Context, q UserQuery) (int, error) {
+	db := r.db.WithContext(ctx)
+	ids := db.Model(&models.User{}).Scopes(filterUsers(q)).Select("users.id")
+	counts := db.Model(&models.Address{}).
+		Select("COUNT(*) AS c").
+		Where("user_id IN (?)", ids).
+		Group("user_id")
+
+	var max int
+	err := db.Table("(?) AS counts", counts).Select("COALESCE(MAX(c), 0)").Scan(&max).Error
+	return max, err
+}
+
+func (r sqlUsers) ListByDate(ctx context.Context, period string) ([]models.User, error) {
+	var users []models.User
+	err := r.db.WithContext(ctx).Where(`persian_date LIKE ? ESCAPE '\'`, "%"+escapeLike(period)+"%").Find(&users).Error
+	return users, err
+}
+
+func (r sqlUsers) History(ctx context.Context, userID uint, offset, limit int) ([]audit.Entry, int64, error) {
+	return audit.History(r.db.WithContext(ctx), userID, offset, limit)
+}
+
+func (r sqlUsers) Search(ctx context.Context, q string, limit int) ([]search.Result, error) {
+	return search.Users(r.db.WithContext(ctx), q, limit)
+}
+
+func (r sqlUsers) PhoneOwners(ctx context.Context, numbers []string) (map[string][]uint, error) {
+	return validation.PhoneOwners(r.db.WithContext(ctx), numbers)
+}
+
+// phoneLockSpace is the first key of the advisory locks on phone numbers,
+// which keeps them apart from other advisory locks.
+const phoneLockSpace = 0x70686f6e
+
+// LockPhones takes a transaction-scoped advisory lock per number on
+// Postgres, in a fixed order so that two writers cannot deadlock. SQLite
+// transactions already hold the database write lock from BEGIN IMMEDIATE.
+func (r sqlUsers) LockPhones(ctx context.Context, numbers []string) error {
+	if r.db.Dialector.Name() != "postgres" {
+		return nil
+	}
+	sorted := append([]string{}, numbers...)
+	sort.Strings(sorted)
+	for _, number := range sorted {
+		if err := r.db.WithContext(ctx).Exec("SELECT pg_advisory_xact_lock(?, hashtext(?))", phoneLockSpace, number).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r sqlUsers) Update(ctx context.Context, user *models.User) error {
+	return r.db.WithContext(ctx).Omit("Addresses").Save(user).Error
+}
+
+func (r sqlUsers) Delete(ctx context.Context, user *models.User) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		if err := tx.Model(&models.Address{}).Where("user_id = ?", user.ID).Update("deleted_at", now).Error; err != nil {
+			return err
+		}
+		return tx.Model(user).Update("deleted_at", now).Error
+	})
+}
+
+func (r sqlUsers) Restore(ctx context.Context, user models.User) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Model(&models.Address{}).
+			Where("user_id = ? AND deleted_at = ?", user.ID, user.DeletedAt.Time).
+			Update("deleted_at", nil).Error; err != nil {
+			return err
+		}
+		return tx.Unscoped().Model(&user).Updates(map[string]interface{}{"deleted_at": nil, "merged_into_id": nil}).Error
+	})
+}
+
+func (r sqlUsers) Purge(ctx context.Context, id uint) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var user models.User
+		if err := tx.Unscoped().First(&user, id).Error; err != nil {
+			return notFound(err)
+		}
+		if err := tx.Unscoped().Where("user_id = ?", user.ID).Delete(&models.Address{}).Error; err != nil {
+			return err
+		}
+		return tx.Unscoped().Delete(&user).Error
+	})
+}
+
+type sqlAddresses struct {
+	db *gorm.DB
+}
+
+func (r sqlAddresses) ListByUser(ctx context.Context, userID uint) ([]models.Address, error) {
+	var addresses []models.Address
+	err := r.db.WithContext(ctx).Where("user_id = ?", userID).Find(&addresses).Error
+	return addresses, err
+}
+
+func (r sqlAddresses) Get(ctx context.Context, userID, id uint) (models.Address, error) {
+	var address models.Address
+	err := r.db.WithContext(ctx).Where("id = ? AND user_id = ?", id, userID).First(&address).Error
+	return address, notFound(err)
+}
+
+func (r sqlAddresses) GetForUpdate(ctx context.Context, userID, id uint) (models.Address, error) {
+	var address models.Address
+	err := r.db.WithContext(ctx).Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("id = ? AND user_id = ?", id, userID).First(&address).Error
+	return address, notFound(err)
+}
+
+func (r sqlAddresses) Create(ctx context.Context, address *models.Address) error {
+	return r.db.WithContext(ctx).Create(address).Error
+}
+
+func (r sqlAddresses) Update(ctx context.Context, address *models.Address) error {
+	return r.db.WithContext(ctx).Save(address).Error
+}
+
+func (r sqlAddresses) Delete(ctx context.Context, address models.Address) error {
+	// Guard against a concurrent update
+	result := r.db.WithContext(ctx).Where("version = ?", address.Version).Delete(&address)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrVersionConflict
+	}
+	return nil
+}
+
+// notFound converts gorm's missing row error to ErrNotFound.
+func notFound(err error) error {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrNotFound
+	}
+	return err
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
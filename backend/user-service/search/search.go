@@ -0,0 +1,158 @@
+// Package search implements ranked user lookup over names, phone numbers and
+// addresses using PostgreSQL trigram indexes on normalized text. SQLite has
+// no trigram matching, so there only substring matches are found.
+package search
+
+import (
+	"log"
+	"strings"
+
+	"gorm.io/gorm"
+
+	"back-forms/persian"
+	"back-forms/user-service/models"
+)
+
+// Result is a user matched by a search together with its relevance.
+type Result struct {
+	models.User
+	Rank float64 `json:"rank"`
+}
+
+// Backfill fills in the search text of rows written before the column
+// existed. The trigram indexes are created by the migrations.
+func Backfill(db *gorm.DB) error {
+	var users []models.User
+	result := db.Where("search_text = ''").FindInBatches(&users, 500, func(tx *gorm.DB, batch int) error {
+		for i := range users {
+			if err := tx.Save(&users[i]).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected > 0 {
+		log.Printf("Backfilled search text for %d users", result.RowsAffected)
+	}
+
+	var addresses []models.Address
+	result = db.Where("search_text = ''").FindInBatches(&addresses, 500, func(tx *gorm.DB, batch int) error {
+		for i := range addresses {
+			if err := tx.Save(&addresses[i]).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected > 0 {
+		log.Printf("Backfilled search text for %d addresses", result.RowsAffected)
+	}
+	return nil
+}
+
+// Term normalizes q the same way as the indexed text.
+func Term(q string) string {
+	term := persian.Normalize(q)
+	if digits := persian.Digits(q); digits != "" && strings.Trim(term, "0123456789 -+()") == "" {
+		// Phone fragments may be typed with spaces or dashes
+		term = digits
+	}
+	return term
+}
+
+// Users returns up to limit users whose name, phone number or addresses
+// match q, ordered by descending rank.
+func Users(db *gorm.DB, q string, limit int) ([]Result, error) {
+	term := Term(q)
+	if term == "" {
+		return []Result{}, nil
+	}
+	pattern := "%" + escapeLike(term) + "%"
+
+	query := trigramQuery
+	if db.Dialector.Name() != "postgres" {
+		query = substringQuery
+	}
+	var ranked []struct {
+		ID   uint
+		Rank float64
+	}
+	err := db.Raw(query, map[string]interface{}{"term": term, "pattern": pattern, "limit": limit}).Scan(&ranked).Error
+	if err != nil {
+		return nil, err
+	}
+	if len(ranked) == 0 {
+		return []Result{}, nil
+	}
+
+	ids := make([]uint, len(ranked))
+	for i, r := range ranked {
+		ids[i] = r.ID
+	}
+
+	var users []models.User
+	if err := db.Preload("Addresses").Where("id IN ?", ids).Find(&users).Error; err != nil {
+		return nil, err
+	}
+	byID := make(map[uint]models.User, len(users))
+	for _, user := range users {
+		byID[user.ID] = user
+	}
+
+	results := make([]Result, 0, len(ranked))
+	for _, r := range ranked {
+		if user, ok := byID[r.ID]; ok {
+			results = append(results, Result{User: user, Rank: r.Rank})
+		}
+	}
+	return results, nil
+}
+
+// trigramQuery ranks users by trigram word similarity, with substring
+// matches ranked first.
+const trigramQuery = `
+        SELECT u.id,
+            MAX(GREATEST(
+                word_similarity(@term, u.search_text),
+                COALESCE(word_similarity(@term, a.search_text), 0),
+                CASE WHEN u.search_text LIKE @pattern ESCAPE '\' THEN 1 ELSE 0 END,
+                CASE WHEN a.search_text LIKE @pattern ESCAPE '\' THEN 0.9 ELSE 0 END
+            )) AS rank
+        FROM users u
+        LEFT JOIN addresses a ON a.user_id = u.id AND a.deleted_at IS NULL
+        WHERE u.deleted_at IS NULL
+            AND (u.search_text LIKE @pattern ESCAPE '\'
+                OR a.search_text LIKE @pattern ESCAPE '\'
+                OR @term <% u.search_text
+                OR @term <% a.search_text)
+        GROUP BY u.id
+        ORDER BY rank DESC, u.id
+        LIMIT @limit
+    `
+
+// substringQuery ranks the users whose own text contains the term above
+// those matched through an address.
+const substringQuery = `
+        SELECT u.id,
+            MAX(CASE WHEN u.search_text LIKE @pattern ESCAPE '\' THEN 1 ELSE 0.9 END) AS rank
+        FROM users u
+        LEFT JOIN addresses a ON a.user_id = u.id AND a.deleted_at IS NULL
+        WHERE u.deleted_at IS NULL
+            AND (u.search_text LIKE @pattern ESCAPE '\'
+                OR a.search_text LIKE @pattern ESCAPE '\')
+        GROUP BY u.id
+        ORDER BY rank DESC, u.id
+        LIMIT @limit
+    `
+
+var likeReplacer = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+func escapeLike(s string) string {
+	return likeReplacer.Replace(s)
+}
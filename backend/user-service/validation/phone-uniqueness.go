@@ -0,0 +1,140 @@
+package validation
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gorm.io/gorm"
+
+	"back-forms/phone"
+	"back-forms/user-service/models"
+)
+
+// CodeDuplicatePhone marks a phone number that another user already has.
+const CodeDuplicatePhone = "duplicate_phone"
+
+// PhonePolicy decides what happens when a phone number is already used by
+// another user.
+type PhonePolicy string
+
+// Phone uniqueness policies.
+const (
+	// PhoneReject refuses a duplicate number with a validation error.
+	PhoneReject PhonePolicy = "reject"
+	// PhoneAllow accepts duplicates silently.
+	PhoneAllow PhonePolicy = "allow"
+	// PhoneWarn accepts duplicates and reports them as warnings.
+	PhoneWarn PhonePolicy = "warn"
+)
+
+// ParsePhonePolicy parses a policy name. An empty name means PhoneReject.
+func ParsePhonePolicy(name string) (PhonePolicy, error) {
+	switch p := PhonePolicy(name); p {
+	case "":
+		return PhoneReject, nil
+	case PhoneReject, PhoneAllow, PhoneWarn:
+		return p, nil
+	default:
+		return "", fmt.Errorf("phone policy must be %s, %s or %s", PhoneReject, PhoneAllow, PhoneWarn)
+	}
+}
+
+// Apply sorts duplicate errors found by CheckPhone according to the policy:
+// they are kept as errors under PhoneReject, become warnings under
+// PhoneWarn and are dropped under PhoneAllow.
+func (p PhonePolicy) Apply(duplicates Errors) (errs, warnings Errors) {
+	switch p {
+	case PhoneAllow:
+		return nil, nil
+	case PhoneWarn:
+		return nil, duplicates
+	default:
+		return duplicates, nil
+	}
+}
+
+// PhoneDirectory finds the users using phone numbers.
+type PhoneDirectory interface {
+	// PhoneOwners returns the IDs of the live users using each of the given
+	// E.164 numbers, in ascending order.
+	PhoneOwners(ctx context.Context, numbers []string) (map[string][]uint, error)
+}
+
+// maxReportedOwners caps the user IDs listed in a duplicate phone error.
+const maxReportedOwners = 5
+
+// Check looks for live users other than user that have the same phone
+// number once normalized, and sorts any match with Apply. Numbers that do
+// not parse are left to ValidateUser.
+func (p PhonePolicy) Check(ctx context.Context, dir PhoneDirectory, user models.User) (errs, warnings Errors, err error) {
+	if p == PhoneAllow {
+		return nil, nil, nil
+	}
+	n, err := phone.Parse(user.PhoneNumber)
+	if err != nil {
+		return nil, nil, nil
+	}
+
+	owners, err := dir.PhoneOwners(ctx, []string{n.E164})
+	if err != nil {
+		return nil, nil, err
+	}
+	var ids []uint
+	for _, id := range owners[n.E164] {
+		if id != user.ID && len(ids) < maxReportedOwners {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return nil, nil, nil
+	}
+
+	errs, warnings = p.Apply(Errors{DuplicatePhoneError("phone_number", ids)})
+	return errs, warnings, nil
+}
+
+// PhoneOwners returns the IDs of the live users using each of the given
+// E.164 numbers.
+func PhoneOwners(db *gorm.DB, numbers []string) (map[string][]uint, error) {
+	owners := map[string][]uint{}
+	if len(numbers) == 0 {
+		return owners, nil
+	}
+
+	var rows []struct {
+		ID          uint
+		PhoneNumber string
+	}
+	err := db.Model(&models.User{}).
+		Select("id, phone_number").
+		Where("phone_number IN ?", numbers).
+		Order("id").
+		Find(&rows).Error
+	for _, row := range rows {
+		owners[row.PhoneNumber] = append(owners[row.PhoneNumber], row.ID)
+	}
+	return owners, err
+}
+
+// DuplicatePhoneError builds the error reported for a number used by ids.
+// Without ids the users are not named.
+func DuplicatePhoneError(field string, ids []uint) FieldError {
+	if len(ids) == 0 {
+		return FieldError{Field: field, Code: CodeDuplicatePhone, Message: "is already used by another user"}
+	}
+	parts := make([]string, len(ids))
+	for i, id := range ids {
+		parts[i] = strconv.FormatUint(uint64(id), 10)
+	}
+	owner := "user"
+	if len(ids) > 1 {
+		owner = "users"
+	}
+	return FieldError{
+		Field:   field,
+		Code:    CodeDuplicatePhone,
+		Message: fmt.Sprintf("is already used by %s %s", owner, strings.Join(parts, ", ")),
+	}
+}
@@ -0,0 +1,136 @@
+package validation
+
+import (
+	"fmt"
+	"strings"
+
+	"back-forms/jalali"
+	"back-forms/phone"
+	"back-forms/user-service/models"
+	"back-forms/user-service/regions"
+)
+
+// Field length limits for users and addresses.
+const (
+	MaxNameLength    = 100
+	MaxSubjectLength = 100
+	MaxDetailsLength = 500
+	MaxPlateLength   = 20
+)
+
+// Genders lists the accepted values for User.Gender.
+var Genders = []string{"Male", "Female"}
+
+// AddressKinds lists the accepted values for Address.Kind.
+var AddressKinds = []string{models.AddressKindHome, models.AddressKindWork, models.AddressKindOther}
+
+// ValidateUser checks a user and its addresses. Address errors are reported
+// as addresses[i].field.
+func ValidateUser(user models.User) Errors {
+	var errs Errors
+
+	if required(&errs, "firstname", user.Firstname) {
+		maxLength(&errs, "firstname", user.Firstname, MaxNameLength)
+	}
+	if required(&errs, "lastname", user.Lastname) {
+		maxLength(&errs, "lastname", user.Lastname, MaxNameLength)
+	}
+	if required(&errs, "phone_number", user.PhoneNumber) && !validPhone(user.PhoneNumber) {
+		errs.Add("phone_number", CodeInvalidPhone, "must be an Iranian mobile or landline number, or an international number starting with +")
+	}
+	if required(&errs, "gender", user.Gender) && !oneOf(user.Gender, Genders) {
+		errs.Add("gender", CodeInvalidChoice, fmt.Sprintf("must be one of %s", strings.Join(Genders, ", ")))
+	}
+	validateDate(&errs, "persian_date", user.PersianDate)
+
+	for i, address := range user.Addresses {
+		errs.Extend(fmt.Sprintf("addresses[%d]", i), ValidateAddress(address))
+	}
+
+	return errs
+}
+
+// ValidateAddress checks a single address.
+func ValidateAddress(address models.Address) Errors {
+	var errs Errors
+
+	if required(&errs, "subject", address.Subject) {
+		maxLength(&errs, "subject", address.Subject, MaxSubjectLength)
+	}
+	if required(&errs, "details", address.Details) {
+		maxLength(&errs, "details", address.Details, MaxDetailsLength)
+	}
+	if address.Kind != "" && !oneOf(address.Kind, AddressKinds) {
+		errs.Add("kind", CodeInvalidChoice, fmt.Sprintf("must be one of %s", strings.Join(AddressKinds, ", ")))
+	}
+
+	// Structured location fields are optional, but a city needs a province
+	// and both must come from the reference dataset
+	if address.Province != "" || address.City != "" {
+		province, ok := regions.FindProvince(address.Province)
+		switch {
+		case address.Province == "":
+			errs.Add("province", CodeRequired, "is required when city is set")
+		case !ok:
+			errs.Add("province", CodeInvalidChoice, "is not a known province")
+		case address.City != "":
+			if _, ok := province.FindCity(address.City); !ok {
+				errs.Add("city", CodeInvalidChoice, fmt.Sprintf("is not a known city in %s", province.Name))
+			}
+		}
+	}
+	if address.PostalCode != "" && !validPostalCode(address.PostalCode) {
+		errs.Add("postal_code", CodeInvalidPostalCode, "must be a valid 10-digit Iranian postal code")
+	}
+	maxLength(&errs, "plate", address.Plate, MaxPlateLength)
+	maxLength(&errs, "unit", address.Unit, MaxPlateLength)
+
+	return errs
+}
+
+func validateDate(errs *Errors, field string, date jalali.Date) {
+	if date.IsZero() {
+		errs.Add(field, CodeRequired, "is required")
+		return
+	}
+	if err := date.Validate(); err != nil {
+		errs.Add(field, CodeInvalidDate, err.Error())
+	}
+}
+
+func validPhone(number string) bool {
+	_, err := phone.Parse(number)
+	return err == nil
+}
+
+// validPostalCode checks the structure of an Iranian postal code: ten
+// digits, no 0 or 2 in the first five, no 5 in the fifth, no 2 in the last
+// five and not starting with four identical digits.
+func validPostalCode(code string) bool {
+	code = strings.NewReplacer(" ", "", "-", "").Replace(jalali.NormalizeDigits(code))
+	if len(code) != 10 {
+		return false
+	}
+	for i, c := range code {
+		switch {
+		case c < '0' || c > '9':
+			return false
+		case i < 5 && (c == '0' || c == '2'):
+			return false
+		case i == 4 && c == '5':
+			return false
+		case i >= 5 && c == '2':
+			return false
+		}
+	}
+	return strings.Count(code[:4], code[:1]) != 4
+}
+
+func oneOf(value string, allowed []string) bool {
+	for _, a := range allowed {
+		if value == a {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,104 @@
+package validation
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"back-forms/jalali"
+)
+
+// Error codes returned in FieldError.Code.
+const (
+	CodeRequired      = "required"
+	CodeTooLong       = "too_long"
+	CodeInvalidChoice = "invalid_choice"
+	CodeInvalidDate   = "invalid_date"
+	CodeInvalidPhone  = "invalid_phone"
+	CodeInvalidType   = "invalid_type"
+
+	CodeInvalidPostalCode = "invalid_postal_code"
+	CodeTooShort          = "too_short"
+	CodeTaken             = "taken"
+)
+
+// FieldError describes a single invalid field in a request body.
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Errors is a list of field errors. A nil or empty Errors means the value
+// is valid.
+type Errors []FieldError
+
+// Add appends a field error to the list.
+func (e *Errors) Add(field, code, message string) {
+	*e = append(*e, FieldError{Field: field, Code: code, Message: message})
+}
+
+// Extend appends every error in other, prefixing each field with prefix.
+func (e *Errors) Extend(prefix string, other Errors) {
+	for _, fe := range other {
+		if prefix != "" {
+			fe.Field = prefix + "." + fe.Field
+		}
+		*e = append(*e, fe)
+	}
+}
+
+// Error implements the error interface.
+func (e Errors) Error() string {
+	msgs := make([]string, len(e))
+	for i, fe := range e {
+		msgs[i] = fmt.Sprintf("%s: %s", fe.Field, fe.Message)
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Response is the body returned with a 422 Unprocessable Entity status.
+type Response struct {
+	Errors Errors `json:"errors"`
+}
+
+// WriteErrors writes errs as a 422 response.
+func WriteErrors(w http.ResponseWriter, errs Errors) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	json.NewEncoder(w).Encode(Response{Errors: errs})
+}
+
+// FromDecodeError converts a JSON decoding error caused by a bad field value
+// into field errors. It returns false for errors that are not tied to a
+// specific field, such as malformed JSON.
+func FromDecodeError(err error, dateField string) (Errors, bool) {
+	var errs Errors
+
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.Is(err, jalali.ErrInvalidDate):
+		errs.Add(dateField, CodeInvalidDate, err.Error())
+	case errors.As(err, &typeErr) && typeErr.Field != "":
+		errs.Add(typeErr.Field, CodeInvalidType, fmt.Sprintf("must be a %s", typeErr.Type))
+	default:
+		return nil, false
+	}
+	return errs, true
+}
+
+func required(errs *Errors, field, value string) bool {
+	if strings.TrimSpace(value) == "" {
+		errs.Add(field, CodeRequired, "is required")
+		return false
+	}
+	return true
+}
+
+func maxLength(errs *Errors, field, value string, max int) {
+	if len([]rune(value)) > max {
+		errs.Add(field, CodeTooLong, fmt.Sprintf("must be at most %d characters", max))
+	}
+}
@@ -1,11 +1,31 @@
-import { useState } from 'react';
+import { useEffect, useState } from 'react';
 import { BrowserRouter as Router, Routes, Route } from 'react-router-dom';
 import SubmitUserPage  from './pages/SubmitUserPage';
 import ReportPage from "./pages/ReportPage";
+import LoginPage from './pages/LoginPage';
+import { isLoggedIn, logout } from './api';
 import './App.css';
 import Report from './components/Report'
 
 function App() {
+  const [loggedIn, setLoggedIn] = useState(isLoggedIn());
+
+  // Tokens change on login, logout and when a refresh fails
+  useEffect(() => {
+    const onAuthChange = () => setLoggedIn(isLoggedIn());
+    window.addEventListener('auth-change', onAuthChange);
+    return () => window.removeEventListener('auth-change', onAuthChange);
+  }, []);
+
+  if (!loggedIn) {
+    return (
+      <div>
+        <h1>User Management System</h1>
+        <LoginPage />
+      </div>
+    );
+  }
+
   return (
     <Router>
       <div>
@@ -14,6 +34,7 @@ function App() {
           <ul>
             <li><a href="/">Submit User</a></li>
             <li><a href="/report">Generate Report</a></li>
+            <li><button type="button" onClick={() => logout()}>Sign out</button></li>
           </ul>
         </nav>
         <Routes>
@@ -0,0 +1,91 @@
+// api/auth.ts
+import axios, { AxiosError, InternalAxiosRequestConfig } from "axios";
+import { TokenPair } from "../types";
+
+const USER_SERVICE_URL = "http://localhost:8081";
+const STORAGE_KEY = "auth";
+
+type StoredTokens = Pick<TokenPair, "access_token" | "refresh_token">;
+
+const loadTokens = (): StoredTokens | null => {
+    const raw = localStorage.getItem(STORAGE_KEY);
+    return raw ? (JSON.parse(raw) as StoredTokens) : null;
+};
+
+const saveTokens = (pair: TokenPair | null) => {
+    if (pair) {
+        localStorage.setItem(STORAGE_KEY, JSON.stringify({
+            access_token: pair.access_token,
+            refresh_token: pair.refresh_token,
+        }));
+    } else {
+        localStorage.removeItem(STORAGE_KEY);
+    }
+    window.dispatchEvent(new Event("auth-change"));
+};
+
+export const isLoggedIn = () => loadTokens() !== null;
+
+export const login = async (username: string, password: string) => {
+    const response = await axios.post<TokenPair>(`${USER_SERVICE_URL}/api/auth/login`, { username, password });
+    saveTokens(response.data);
+};
+
+export const logout = async () => {
+    const tokens = loadTokens();
+    saveTokens(null);
+    if (tokens) {
+        await axios.post(`${USER_SERVICE_URL}/api/auth/logout`, { refresh_token: tokens.refresh_token })
+            .catch((error) => console.error("Error logging out:", error));
+    }
+};
+
+// Concurrent 401s share a single refresh request
+let refreshing: Promise<string | null> | null = null;
+
+const refreshAccessToken = () => {
+    if (!refreshing) {
+        const tokens = loadTokens();
+        refreshing = (tokens
+            ? axios.post<TokenPair>(`${USER_SERVICE_URL}/api/auth/refresh`, { refresh_token: tokens.refresh_token })
+                .then((response) => {
+                    saveTokens(response.data);
+                    return response.data.access_token;
+                })
+                .catch(() => {
+                    saveTokens(null);
+                    return null;
+                })
+            : Promise.resolve(null)
+        ).finally(() => {
+            refreshing = null;
+        });
+    }
+    return refreshing;
+};
+
+const isAuthRequest = (config?: InternalAxiosRequestConfig) => !!config?.url?.includes("/api/auth/");
+
+// Attach the access token to every request to the services
+axios.interceptors.request.use((config) => {
+    const tokens = loadTokens();
+    if (tokens && !isAuthRequest(config)) {
+        config.headers.Authorization = `Bearer ${tokens.access_token}`;
+    }
+    return config;
+});
+
+// Refresh an expired access token once and retry the request
+axios.interceptors.response.use(undefined, async (error: AxiosError) => {
+    const config = error.config as (InternalAxiosRequestConfig & { _retried?: boolean }) | undefined;
+    if (error.response?.status !== 401 || !config || config._retried || isAuthRequest(config)) {
+        throw error;
+    }
+    const accessToken = await refreshAccessToken();
+    if (!accessToken) {
+        throw error;
+    }
+    config._retried = true;
+    config.headers.Authorization = `Bearer ${accessToken}`;
+    return axios(config);
+});
@@ -1,14 +1,36 @@
 // api/index.ts
 import axios from "axios";
-import { User, Address } from "../types";
+import {
+    User,
+    Address,
+    UserListParams,
+    UserListResponse,
+    UserWithWarnings,
+    Province,
+    ReportData,
+    ProvinceCities,
+    DuplicateListResponse,
+    MergeRequest,
+    MergeResponse,
+    Role,
+    Operator,
+    Permission,
+    ApiKey,
+    ApiKeyWithSecret,
+} from "../types";
+import "./auth";
+
+export { login, logout, isLoggedIn } from "./auth";
 
 const USER_SERVICE_URL = "http://localhost:8081";
 const REPORT_SERVICE_URL = "http://localhost:8082";
 
-// Get all users
-export const getUsers = async () => {
+// Get a page of users
+export const getUsers = async (params: UserListParams = {}) => {
     try {
-        const response = await axios.get(`${USER_SERVICE_URL}/api/users`);
+        const response = await axios.get<UserListResponse>(`${USER_SERVICE_URL}/api/users`, {
+            params: { include: "addresses", page_size: 100, ...params },
+        });
         return response.data;
     } catch (error) {
         console.error("Error fetching users:", error);
@@ -16,6 +38,19 @@ export const getUsers = async () => {
     }
 };
 
+// Search users by name, phone or address
+export const searchUsers = async (q: string, limit?: number) => {
+    try {
+        const response = await axios.get(`${USER_SERVICE_URL}/api/users/search`, {
+            params: { q, limit },
+        });
+        return response.data;
+    } catch (error) {
+        console.error("Error searching users:", error);
+        throw error;
+    }
+};
+
 // Get user by ID
 export const getUserById = async (id: number) => {
     try {
@@ -28,7 +63,9 @@ export const getUserById = async (id: number) => {
 };
 
 // Submit or edit user
-export const submitUser = async (userData: User) => {
+// Creation requests carry an Idempotency-Key so that a retry after a lost
+// response returns the first result instead of creating a duplicate
+export const submitUser = async (userData: User, idempotencyKey = crypto.randomUUID()): Promise<UserWithWarnings> => {
     try {
         if (userData.id) {
             // Edit existing user
@@ -44,7 +81,8 @@ export const submitUser = async (userData: User) => {
             // Create new user
             const response = await axios.post(
                 `${USER_SERVICE_URL}/api/users`,
-                userData
+                userData,
+                { headers: { "Idempotency-Key": idempotencyKey } }
             );
             return response.data;
         }
@@ -54,6 +92,56 @@ export const submitUser = async (userData: User) => {
     }
 };
 
+// Partially update user with a JSON Merge Patch; send null to clear a field
+export const patchUser = async (id: number, patch: Record<string, unknown>) => {
+    try {
+        const response = await axios.patch(`${USER_SERVICE_URL}/api/users/${id}`, patch, {
+            headers: { "Content-Type": "application/merge-patch+json" },
+        });
+        return response.data;
+    } catch (error) {
+        console.error("Error patching user:", error);
+        throw error;
+    }
+};
+
+// Soft-delete user; without a version whatever is stored is deleted
+export const deleteUser = async (id: number, version?: number) => {
+    try {
+        await axios.delete(`${USER_SERVICE_URL}/api/users/${id}`, {
+            headers: { "If-Match": version ? `"${version}"` : "*" },
+        });
+        return true;
+    } catch (error) {
+        console.error("Error deleting user:", error);
+        throw error;
+    }
+};
+
+// Restore soft-deleted user
+export const restoreUser = async (id: number) => {
+    try {
+        const response = await axios.post(`${USER_SERVICE_URL}/api/users/${id}/restore`);
+        return response.data;
+    } catch (error) {
+        console.error("Error restoring user:", error);
+        throw error;
+    }
+};
+
+// Get the change history of a user and its addresses
+export const getUserHistory = async (id: number, page = 1) => {
+    try {
+        const response = await axios.get(`${USER_SERVICE_URL}/api/users/${id}/history`, {
+            params: { page },
+        });
+        return response.data;
+    } catch (error) {
+        console.error("Error fetching user history:", error);
+        throw error;
+    }
+};
+
 // Edit address
 export const editAddress = async (userId: number, addressId: number, address: Address) => {
   try {
@@ -76,13 +164,14 @@ export const editAddress = async (userId: number, addressId: number, address: Ad
   }
 };
 
-// Delete address
-export const deleteAddress = async (userId: number, addressId: number) => {
+// Delete address; without a version whatever is stored is deleted
+export const deleteAddress = async (userId: number, addressId: number, version?: number) => {
   try {
     const response = await fetch(`/api/users/${userId}/addresses/${addressId}`, {
       method: 'DELETE',
       headers: {
         'Content-Type': 'application/json',
+        'If-Match': version ? `"${version}"` : '*',
       },
     });
 
@@ -109,11 +198,12 @@ export const getUserAddresses = async (userId: number) => {
 };
 
 // Add address to user
-export const addUserAddress = async (userId: number, address: Address) => {
+export const addUserAddress = async (userId: number, address: Address, idempotencyKey = crypto.randomUUID()) => {
     try {
         const response = await axios.post(
             `${USER_SERVICE_URL}/api/users/${userId}/addresses`,
-            address
+            address,
+            { headers: { "Idempotency-Key": idempotencyKey } }
         );
         return response.data;
     } catch (error) {
@@ -122,6 +212,52 @@ export const addUserAddress = async (userId: number, address: Address) => {
     }
 };
 
+// Find pairs of users that are likely the same person
+export const findDuplicates = async (params: { min_score?: number; user_id?: number; page?: number; page_size?: number } = {}) => {
+    try {
+        const response = await axios.get<DuplicateListResponse>(`${USER_SERVICE_URL}/api/users/duplicates`, { params });
+        return response.data;
+    } catch (error) {
+        console.error("Error finding duplicate users:", error);
+        throw error;
+    }
+};
+
+// Merge the loser into the survivor
+export const mergeUsers = async (request: MergeRequest) => {
+    try {
+        const response = await axios.post<MergeResponse>(`${USER_SERVICE_URL}/api/users/merge`, request);
+        return response.data;
+    } catch (error) {
+        console.error("Error merging users:", error);
+        throw error;
+    }
+};
+
+// Get the provinces accepted in addresses
+export const getProvinces = async () => {
+    try {
+        const response = await axios.get<Province[]>(`${USER_SERVICE_URL}/api/provinces`);
+        return response.data;
+    } catch (error) {
+        console.error("Error fetching provinces:", error);
+        throw error;
+    }
+};
+
+// Get the cities of a province, by ID or name
+export const getProvinceCities = async (province: string) => {
+    try {
+        const response = await axios.get<ProvinceCities>(
+            `${USER_SERVICE_URL}/api/provinces/${encodeURIComponent(province)}/cities`
+        );
+        return response.data;
+    } catch (error) {
+        console.error("Error fetching cities:", error);
+        throw error;
+    }
+};
+
 // Get user stats
 export const getUserStats = async (year: string, month: string) => {
     try {
@@ -141,7 +277,7 @@ export const getUserStats = async (year: string, month: string) => {
 export const generateReport = async () => {
     try {
         console.log('Calling Report API...');
-        const response = await axios.get(`${REPORT_SERVICE_URL}/api/report`);
+        const response = await axios.get<ReportData>(`${REPORT_SERVICE_URL}/api/report`);
         console.log('Report API Response:', response.data);
         return response.data;
     } catch (error) {
@@ -149,3 +285,63 @@ export const generateReport = async () => {
         throw error;
     }
 };
+
+// Admin: permissions, roles and operators
+export const getPermissions = async (): Promise<Permission[]> => {
+    const response = await axios.get(`${USER_SERVICE_URL}/api/admin/permissions`);
+    return response.data;
+};
+
+export const getRoles = async (): Promise<Role[]> => {
+    const response = await axios.get(`${USER_SERVICE_URL}/api/admin/roles`);
+    return response.data;
+};
+
+export const createRole = async (role: Omit<Role, "id">): Promise<Role> => {
+    const response = await axios.post(`${USER_SERVICE_URL}/api/admin/roles`, role);
+    return response.data;
+};
+
+export const updateRole = async (id: number, role: Omit<Role, "id">): Promise<Role> => {
+    const response = await axios.put(`${USER_SERVICE_URL}/api/admin/roles/${id}`, role);
+    return response.data;
+};
+
+export const deleteRole = async (id: number) => {
+    await axios.delete(`${USER_SERVICE_URL}/api/admin/roles/${id}`);
+};
+
+export const getOperators = async (): Promise<Operator[]> => {
+    const response = await axios.get(`${USER_SERVICE_URL}/api/admin/operators`);
+    return response.data;
+};
+
+export const createOperator = async (username: string, password: string, roles: string[]): Promise<Operator> => {
+    const response = await axios.post(`${USER_SERVICE_URL}/api/admin/operators`, { username, password, roles });
+    return response.data;
+};
+
+export const updateOperator = async (id: number, changes: { roles?: string[]; disabled?: boolean }): Promise<Operator> => {
+    const response = await axios.patch(`${USER_SERVICE_URL}/api/admin/operators/${id}`, changes);
+    return response.data;
+};
+
+// Admin: API keys for machine clients
+export const getApiKeys = async (): Promise<ApiKey[]> => {
+    const response = await axios.get(`${USER_SERVICE_URL}/api/admin/api-keys`);
+    return response.data;
+};
+
+export const createApiKey = async (name: string, scopes: Permission[], expiresAt?: string): Promise<ApiKeyWithSecret> => {
+    const response = await axios.post(`${USER_SERVICE_URL}/api/admin/api-keys`, { name, scopes, expires_at: expiresAt });
+    return response.data;
+};
+
+export const rotateApiKey = async (id: number): Promise<ApiKeyWithSecret> => {
+    const response = await axios.post(`${USER_SERVICE_URL}/api/admin/api-keys/${id}/rotate`);
+    return response.data;
+};
+
+export const revokeApiKey = async (id: number) => {
+    await axios.delete(`${USER_SERVICE_URL}/api/admin/api-keys/${id}`);
+};
@@ -6,6 +6,7 @@ import {
   ResponsiveContainer
 } from 'recharts';
 import { generateReport } from '../api';
+import { ReportData } from '../types';
 import styles from '../styles/Report.module.css';
 
 const COLORS = ['#0088FE', '#FF8042'];
@@ -16,7 +17,7 @@ const months = [
 ];
 
 const Report: React.FC = () => {
-  const [data, setData] = useState<any>(null);
+  const [data, setData] = useState<ReportData | null>(null);
 
   useEffect(() => {
     generateReport().then(response => {
@@ -40,7 +41,7 @@ const Report: React.FC = () => {
   }))
 
   const barData = allWeeks.map(week => {
-    const weekData = (data.weekly || []).find((w: any) => w.date === week.name);
+    const weekData = (data.weekly || []).find(w => w.date === week.name);
     return {
       name: week.name,
       male: weekData ? weekData.male_count : 0,
@@ -57,7 +58,7 @@ const Report: React.FC = () => {
 
   const trendData = months.map((month, index) => {
     const monthNum = (index + 1).toString().padStart(2, '0');
-    const monthData = data.monthly.find((m: any) => m.date === monthNum);
+    const monthData = (data.monthly || []).find(m => m.date === monthNum);
     
     console.log(`Processing month ${month} (${monthNum}):`, monthData);
     
@@ -0,0 +1,64 @@
+import React, { useState } from "react";
+import axios from "axios";
+import { login } from "../api";
+import styles from "../styles/SubmitUserPage.module.css";
+
+function LoginPage() {
+  const [username, setUsername] = useState("");
+  const [password, setPassword] = useState("");
+  const [error, setError] = useState<string | null>(null);
+  const [loading, setLoading] = useState(false);
+
+  const handleSubmit = async (e: React.FormEvent) => {
+    e.preventDefault();
+    setLoading(true);
+    setError(null);
+    try {
+      await login(username, password);
+    } catch (error) {
+      if (axios.isAxiosError(error) && error.response?.status === 401) {
+        setError("Invalid username or password");
+      } else {
+        setError("Could not sign in, please try again");
+      }
+    } finally {
+      setLoading(false);
+    }
+  };
+
+  return (
+    <div className={styles.container}>
+      <h2>Sign in</h2>
+      <form onSubmit={handleSubmit}>
+        <div className={styles.formGroup}>
+          <label>Username:</label>
+          <input
+            type="text"
+            value={username}
+            onChange={(e) => setUsername(e.target.value)}
+            autoComplete="username"
+            required
+          />
+        </div>
+        <div className={styles.formGroup}>
+          <label>Password:</label>
+          <input
+            type="password"
+            value={password}
+            onChange={(e) => setPassword(e.target.value)}
+            autoComplete="current-password"
+            required
+          />
+        </div>
+        {error && <div className={styles.error}>{error}</div>}
+        <div className={styles.buttonGroup}>
+          <button type="submit" disabled={loading}>
+            {loading ? "Signing in..." : "Sign in"}
+          </button>
+        </div>
+      </form>
+    </div>
+  );
+}
+
+export default LoginPage;
@@ -1,9 +1,10 @@
 import React, { useState, useEffect, useCallback, memo } from "react";
+import axios from "axios";
 import DatePicker from "react-multi-date-picker";
 import persian from "react-date-object/calendars/persian";
 import persian_fa from "react-date-object/locales/persian_fa";
-import { submitUser, getUsers, editAddress, deleteAddress } from "../api";
-import { User, Address } from "../types";
+import { submitUser, getUsers, editAddress, deleteAddress, getProvinces, getProvinceCities } from "../api";
+import { User, Address, FieldError, Province, ValidationErrorResponse } from "../types";
 import styles from "../styles/SubmitUserPage.module.css";
 
 // Add these interfaces
@@ -20,6 +21,7 @@ interface FormDataType {
   gender: string;
   persian_date: string;
   addresses: Address[];
+  version?: number;
 }
 
 const initialFormData: FormDataType = {
@@ -31,9 +33,36 @@ const initialFormData: FormDataType = {
   addresses: [],
 };
 
+type FieldErrors = Record<string, string>;
+
+// Shows non-fatal warnings such as a phone number shared with another user
+const showWarnings = (warnings?: FieldError[]) => {
+  if (warnings && warnings.length > 0) {
+    window.alert(warnings.map((w) => `${w.field} ${w.message}`).join('\n'));
+  }
+};
+
+// Maps a 422 response from the user service onto form field names
+const toFieldErrors = (error: unknown): FieldErrors | null => {
+  if (!axios.isAxiosError(error) || error.response?.status !== 422) {
+    return null;
+  }
+  const data = error.response.data as ValidationErrorResponse;
+  return (data.errors || []).reduce<FieldErrors>((acc, fieldError) => {
+    acc[fieldError.field] = fieldError.message;
+    return acc;
+  }, {});
+};
+
 const initialAddressData: Address = {
+  kind: "other",
   subject: "",
   details: "",
+  province: "",
+  city: "",
+  postal_code: "",
+  plate: "",
+  unit: "",
 };
 
 const AddressActions = memo(({ 
@@ -74,7 +103,8 @@ const FormInput = memo(({
   value, 
   onChange, 
   type = "text", 
-  required = false 
+  required = false,
+  error
 }: {
   label: string;
   name: string;
@@ -82,6 +112,7 @@ const FormInput = memo(({
   onChange: (e: React.ChangeEvent<HTMLInputElement>) => void;
   type?: string;
   required?: boolean;
+  error?: string;
 }) => (
   <div className={styles.formGroup}>
     <label>{label}:</label>
@@ -92,6 +123,7 @@ const FormInput = memo(({
       onChange={onChange}
       required={required}
     />
+    {error && <span className={styles.fieldError}>{error}</span>}
   </div>
 ));
 
@@ -101,13 +133,15 @@ const FormSelect = memo(({
   name, 
   value, 
   onChange, 
-  options 
+  options,
+  error
 }: {
   label: string;
   name: string;
   value: string;
   onChange: (e: React.ChangeEvent<HTMLSelectElement>) => void;
   options: { value: string; label: string; }[];
+  error?: string;
 }) => (
   <div className={styles.formGroup}>
     <label>{label}:</label>
@@ -118,6 +152,7 @@ const FormSelect = memo(({
         </option>
       ))}
     </select>
+    {error && <span className={styles.fieldError}>{error}</span>}
   </div>
 ));
 
@@ -134,7 +169,8 @@ const UserFormModal = memo(({
   addresses,
   isEditing,
   onEditAddress,
-  onDeleteAddress
+  onDeleteAddress,
+  fieldErrors
 }: {
 formData: FormDataType;
   onInputChange: (e: React.ChangeEvent<HTMLInputElement | HTMLSelectElement>) => void;
@@ -148,6 +184,7 @@ formData: FormDataType;
   isEditing: boolean;
   onEditAddress: (address: Address, index: number) => void;
   onDeleteAddress: (address: Address, index: number) => void;
+  fieldErrors: FieldErrors;
 }) => (
   <div className={styles.modal}>
     <div className={styles.modalContent}>
@@ -160,6 +197,7 @@ formData: FormDataType;
             value={formData.firstname}
             onChange={onInputChange}
             required
+            error={fieldErrors.firstname}
           />
           <FormInput
             label="Last Name"
@@ -167,6 +205,7 @@ formData: FormDataType;
             value={formData.lastname}
             onChange={onInputChange}
             required
+            error={fieldErrors.lastname}
           />
           <FormInput
             label="Phone Number"
@@ -174,6 +213,7 @@ formData: FormDataType;
             value={formData.phone_number}
             onChange={onInputChange}
             required
+            error={fieldErrors.phone_number}
           />
           <FormSelect
             label="Gender"
@@ -185,6 +225,7 @@ formData: FormDataType;
               { value: "Male", label: "Male" },
               { value: "Female", label: "Female" }
             ]}
+            error={fieldErrors.gender}
           />
           <div className={styles.formGroup}>
             <label>Date:</label>
@@ -196,6 +237,9 @@ formData: FormDataType;
               format="YYYYMMDD"
               calendarPosition="bottom-center"
             />
+            {fieldErrors.persian_date && (
+              <span className={styles.fieldError}>{fieldErrors.persian_date}</span>
+            )}
           </div>
         </div>
 
@@ -210,14 +254,34 @@ formData: FormDataType;
                   <tr>
                     <th>Subject</th>
                     <th>Details</th>
+                    <th>Location</th>
                     <th>Actions</th>
                   </tr>
                 </thead>
                 <tbody>
                   {addresses.map((address, index) => (
                     <tr key={index}>
-                      <td>{address.subject}</td>
-                      <td>{address.details}</td>
+                      <td>
+                        {address.subject}
+                        {fieldErrors[`addresses[${index}].subject`] && (
+                          <span className={styles.fieldError}>{fieldErrors[`addresses[${index}].subject`]}</span>
+                        )}
+                      </td>
+                      <td>
+                        {address.details}
+                        {fieldErrors[`addresses[${index}].details`] && (
+                          <span className={styles.fieldError}>{fieldErrors[`addresses[${index}].details`]}</span>
+                        )}
+                      </td>
+                      <td>
+                        {[address.city, address.province, address.postal_code].filter(Boolean).join('، ')}
+                        {['province', 'city', 'postal_code', 'kind', 'plate', 'unit'].map((field) => {
+                          const message = fieldErrors[`addresses[${index}].${field}`];
+                          return message && (
+                            <span key={field} className={styles.fieldError}>{message}</span>
+                          );
+                        })}
+                      </td>
                       <td>
                         <AddressActions
                           onEdit={() => onEditAddress(address, index)}
@@ -252,51 +316,121 @@ const AddressFormModal = memo(({
   isEditing // Add this prop
 }: {
   address: Address;
-  onInputChange: (e: React.ChangeEvent<HTMLInputElement>) => void;
+  onInputChange: (e: React.ChangeEvent<HTMLInputElement | HTMLSelectElement>) => void;
   onSubmit: () => void;
   onClose: () => void;
   isEditing: boolean; // Add this type
-}) => (
-  <div className={styles.modal}>
-    <div className={styles.modalContent}>
-      <h2>{isEditing ? 'Edit Address' : 'New Address'}</h2>
-      <div className={styles.addressFormGrid}>
-        <div className={styles.formGroup}>
-          <label>Subject:</label>
-          <input
-            type="text"
-            name="subject"
-            value={address.subject}
-            onChange={onInputChange}
-            required
-          />
+}) => {
+  const [provinces, setProvinces] = useState<Province[]>([]);
+  const [cities, setCities] = useState<string[]>([]);
+
+  useEffect(() => {
+    getProvinces().then(setProvinces).catch(() => setProvinces([]));
+  }, []);
+
+  // Cities depend on the selected province
+  useEffect(() => {
+    if (!address.province) {
+      setCities([]);
+      return;
+    }
+    getProvinceCities(address.province)
+      .then((response) => setCities(response.cities))
+      .catch(() => setCities([]));
+  }, [address.province]);
+
+  return (
+    <div className={styles.modal}>
+      <div className={styles.modalContent}>
+        <h2>{isEditing ? 'Edit Address' : 'New Address'}</h2>
+        <div className={styles.addressFormGrid}>
+          <div className={styles.formGroup}>
+            <label>Kind:</label>
+            <select name="kind" value={address.kind || 'other'} onChange={onInputChange}>
+              <option value="home">Home</option>
+              <option value="work">Work</option>
+              <option value="other">Other</option>
+            </select>
+          </div>
+          <div className={styles.formGroup}>
+            <label>Subject:</label>
+            <input
+              type="text"
+              name="subject"
+              value={address.subject}
+              onChange={onInputChange}
+              required
+            />
+          </div>
+          <div className={styles.formGroup}>
+            <label>Province:</label>
+            <select name="province" value={address.province || ''} onChange={onInputChange}>
+              <option value="">Select province</option>
+              {provinces.map((province) => (
+                <option key={province.id} value={province.name}>{province.name}</option>
+              ))}
+            </select>
+          </div>
+          <div className={styles.formGroup}>
+            <label>City:</label>
+            <select
+              name="city"
+              value={address.city || ''}
+              onChange={onInputChange}
+              disabled={!address.province}
+            >
+              <option value="">Select city</option>
+              {cities.map((city) => (
+                <option key={city} value={city}>{city}</option>
+              ))}
+            </select>
+          </div>
+          <div className={styles.formGroup}>
+            <label>Details:</label>
+            <input
+              type="text"
+              name="details"
+              value={address.details}
+              onChange={onInputChange}
+              required
+            />
+          </div>
+          <div className={styles.formGroup}>
+            <label>Postal Code:</label>
+            <input
+              type="text"
+              name="postal_code"
+              value={address.postal_code || ''}
+              onChange={onInputChange}
+              inputMode="numeric"
+              maxLength={10}
+            />
+          </div>
+          <div className={styles.formGroup}>
+            <label>Plate:</label>
+            <input type="text" name="plate" value={address.plate || ''} onChange={onInputChange} />
+          </div>
+          <div className={styles.formGroup}>
+            <label>Unit:</label>
+            <input type="text" name="unit" value={address.unit || ''} onChange={onInputChange} />
+          </div>
         </div>
-        <div className={styles.formGroup}>
-          <label>Details:</label>
-          <input
-            type="text"
-            name="details"
-            value={address.details}
-            onChange={onInputChange}
-            required
-          />
+        <div className={styles.buttonGroup}>
+          <button 
+            type="button" 
+            onClick={onSubmit}
+            disabled={!address.subject || !address.details}
+          >
+            {isEditing ? 'Update' : 'Add'}
+          </button>
+          <button type="button" onClick={onClose}>
+            Cancel
+          </button>
         </div>
       </div>
-      <div className={styles.buttonGroup}>
-        <button 
-          type="button" 
-          onClick={onSubmit}
-          disabled={!address.subject || !address.details}
-        >
-          {isEditing ? 'Update' : 'Add'}
-        </button>
-        <button type="button" onClick={onClose}>
-          Cancel
-        </button>
-      </div>
     </div>
-  </div>
-));
+  );
+});
 
 // Memoized Users Grid
 const UsersGrid = memo(({ 
@@ -322,7 +456,7 @@ const UsersGrid = memo(({
           <tr key={user.id}>
             <td>{user.firstname}</td>
             <td>{user.lastname}</td>
-            <td>{user.phone_number}</td>
+            <td title={user.phone_number}>{user.phone_input || user.phone_number}</td>
             <td>{user.gender}</td>
             <td>
               <button 
@@ -354,6 +488,7 @@ function SubmitUserPage() {
   const [editingAddress, setEditingAddress] = useState<{address: Address, index: number} | null>(null);
   const [deletedAddresses, setDeletedAddresses] = useState<number[]>([]);
   const [editedAddresses, setEditedAddresses] = useState<{ [key: number]: Address }>({});
+  const [fieldErrors, setFieldErrors] = useState<FieldErrors>({});
 
   useEffect(() => {
     loadUsers();
@@ -364,7 +499,7 @@ function SubmitUserPage() {
     setError(null);
     try {
       const response = await getUsers();
-      setUsers(response);
+      setUsers(response.data);
     } catch (error) {
       setError("Failed to load users");
       console.error('Failed to load users:', error);
@@ -396,10 +531,11 @@ function SubmitUserPage() {
     setFormData({
       firstname: user.firstname,
       lastname: user.lastname,
-      phone_number: user.phone_number,
+      phone_number: user.phone_input || user.phone_number,
       gender: user.gender,
       persian_date: user.persian_date ? user.persian_date.replace(/\//g, '') : "",
       addresses: user.addresses || [],
+      version: user.version,
     });
 
     if (user.persian_date) {
@@ -423,14 +559,16 @@ function SubmitUserPage() {
     e.preventDefault();
     setLoading(true);
     setError(null);
+    setFieldErrors({});
 
     try {
       if (isEditing && editingUserId) {
         // First update the user data
-        await submitUser({ 
+        const updated = await submitUser({ 
           ...formData, 
           id: editingUserId 
         });
+        showWarnings(updated.warnings);
 
         // Handle edited addresses
         const editPromises = Object.entries(editedAddresses).map(([id, address]) => 
@@ -454,7 +592,8 @@ function SubmitUserPage() {
         await Promise.all([...editPromises, ...deletePromises]);
       } else {
         // Create new user
-        await submitUser(formData);
+        const created = await submitUser(formData);
+        showWarnings(created.warnings);
       }
 
       // Refresh the users list
@@ -462,7 +601,12 @@ function SubmitUserPage() {
       setShowUserModal(false);
       resetForm();
     } catch (error) {
-      setError(isEditing ? "Failed to update user" : "Failed to create user");
+      const errors = toFieldErrors(error);
+      if (errors) {
+        setFieldErrors(errors);
+      } else {
+        setError(isEditing ? "Failed to update user" : "Failed to create user");
+      }
       console.error('Submission error:', error);
     } finally {
       setLoading(false);
@@ -486,6 +630,7 @@ function SubmitUserPage() {
     setEditingAddress(null);
     setDeletedAddresses([]); // Clear deleted addresses
     setEditedAddresses({}); // Clear edited addresses
+    setFieldErrors({});
   }, []);
   
   const handleDateChange = useCallback((date: any) => {
@@ -514,11 +659,13 @@ function SubmitUserPage() {
     }
   }, []);
 
-  const handleAddressInputChange = useCallback((e: React.ChangeEvent<HTMLInputElement>) => {
+  const handleAddressInputChange = useCallback((e: React.ChangeEvent<HTMLInputElement | HTMLSelectElement>) => {
     const { name, value } = e.target;
     setNewAddress(prev => ({
       ...prev,
-      [name]: value
+      [name]: value,
+      // A new province invalidates the selected city
+      ...(name === 'province' ? { city: '' } : {})
     }));
   }, []);
 
@@ -599,6 +746,7 @@ function SubmitUserPage() {
               isEditing={isEditing}
               onEditAddress={handleEditAddress}
               onDeleteAddress={handleDeleteAddress}
+              fieldErrors={fieldErrors}
             />
           </div>
 
@@ -1,8 +1,18 @@
 // types.ts
+export type AddressKind = 'home' | 'work' | 'other';
+
 export interface Address {
     id?: number;
+    kind?: AddressKind;
     subject: string;
     details: string;
+    province?: string;
+    city?: string;
+    postal_code?: string;
+    plate?: string;
+    unit?: string;
+    deleted_at?: string | null;
+    version?: number;
 }
 
 export interface User {
@@ -10,28 +20,149 @@ export interface User {
     firstname: string;
     lastname: string;
     phone_number: string;
+    phone_input?: string;
     gender: string;
     persian_date: string;
     created_at: string;
     deleted_at: string | null;
     addresses?: Address[];
+    version?: number;
+    merged_into_id?: number;
 }
 
-export interface WeeklyGenderStats {
-    week: number;
-    male_count: number;
-    female_count: number;
+export interface DuplicateSignals {
+    same_phone: boolean;
+    name_similarity: number;
+    shared_addresses: number;
 }
 
-export interface MonthlyGenderStats {
-    persian_date: string;
+export interface DuplicateCandidate {
+    users: [User, User];
+    score: number;
+    signals: DuplicateSignals;
+}
+
+export interface DuplicateListResponse {
+    data: DuplicateCandidate[];
+    meta: ListMeta;
+}
+
+export type MergeSource = 'survivor' | 'loser';
+
+export interface MergeRequest {
+    survivor_id: number;
+    loser_id: number;
+    fields?: Partial<Record<'firstname' | 'lastname' | 'phone_number' | 'gender' | 'persian_date', MergeSource>>;
+    survivor_version?: number;
+    loser_version?: number;
+}
+
+export interface MergeResponse {
+    user: User;
+    merged_user_id: number;
+    moved_addresses: number[];
+}
+
+export interface Province {
+    id: string;
+    name: string;
+    name_en: string;
+}
+
+export interface ProvinceCities {
+    province: Province;
+    cities: string[];
+}
+
+export interface UserListParams {
+    page?: number;
+    page_size?: number;
+    limit?: number;
+    cursor?: string;
+    gender?: string;
+    date_from?: string;
+    date_to?: string;
+    name?: string;
+    phone?: string;
+    sort?: string;
+    include?: string;
+    include_deleted?: boolean;
+}
+
+export interface ListMeta {
+    total: number;
+    page?: number;
+    page_size: number;
+    next_cursor?: string;
+}
+
+export interface UserListResponse {
+    data: User[];
+    meta: ListMeta;
+}
+
+export interface GenderStats {
+    date: string;
     male_count: number;
     female_count: number;
+    male_percentage: number;
+    female_percentage: number;
 }
 
 export interface ReportData {
-    WeeklyStats: WeeklyGenderStats[];
-    MonthlyStats: MonthlyGenderStats[];
+    total: GenderStats;
+    daily: GenderStats[] | null;
+    weekly: GenderStats[] | null;
+    monthly: GenderStats[] | null;
+}
+
+export interface TokenPair {
+    access_token: string;
+    token_type: string;
+    expires_in: number;
+    expires_at: string;
+    refresh_token: string;
+}
+
+export type Permission = "users:read" | "users:write" | "users:delete" | "reports:read" | "admin:manage";
+
+export interface Role {
+    id: number;
+    name: string;
+    description: string;
+    permissions: Permission[];
+}
+
+export interface Operator {
+    id: number;
+    username: string;
+    disabled: boolean;
+    created_at: string;
+    last_login_at: string | null;
+    roles: Role[];
+}
+
+export interface ApiKey {
+    id: number;
+    name: string;
+    hint: string;
+    scopes: Permission[];
+    expires_at: string | null;
+    last_used_at: string | null;
+    revoked_at: string | null;
+    created_by: string;
+    created_at: string;
+    rotated_at: string | null;
+}
+
+export interface ApiKeyWithSecret extends ApiKey {
+    key: string;
+}
+
+export interface ForbiddenResponse {
+    error: "forbidden";
+    message: string;
+    required?: Permission[];
 }
 
 export interface ApiResponse<T> {
@@ -40,6 +171,20 @@ export interface ApiResponse<T> {
     message?: string;
 }
 
+export interface FieldError {
+    field: string;
+    code: string;
+    message: string;
+}
+
+export interface UserWithWarnings extends User {
+    warnings?: FieldError[];
+}
+
+export interface ValidationErrorResponse {
+    errors: FieldError[];
+}
+
 export interface EditedAddresses {
   [key: number]: Address;
 }